@@ -15,7 +15,14 @@ import (
 )
 
 var (
-	muxNewOVI sync.RWMutex
+	muxNewOVI          sync.RWMutex
+	REORDER_SPAMFILTER  bool   = false // ReOrderOverview drops lines matching SPAMFILTER
+	REORDER_LIMIT_BYTES uint64 = 0     // ReOrderOverview drops lines of bigger articles, 0 disables
+	// ReorderChain decides which lines ReOrderOverview drops
+	ReorderChain = NewFilterChain(
+		&FlagFilter{Enabled: &REORDER_SPAMFILTER, Filter: &SpamFilter{Spam: &OV_Spamfilter, Verdict: VerdictReject}},
+		&LimitBytesFilter{Max: &REORDER_LIMIT_BYTES},
+	)
 )
 
 func CMD_NewOverviewIndex(file string, group string) bool {
@@ -48,6 +55,21 @@ func CMD_NewOverviewIndex(file string, group string) bool {
 	return true
 } // end func CMD_NewOverviewIndex
 
+func RebuildOverviewIndex(file string, group string) bool {
+	// removes an existing .Index file and creates a new one
+	OV_Index_File := fmt.Sprintf("%s.Index", file)
+	muxNewOVI.Lock()
+	if utils.FileExists(OV_Index_File) {
+		if err := os.Remove(OV_Index_File); err != nil {
+			muxNewOVI.Unlock()
+			log.Printf("Error RebuildOverviewIndex os.Remove fp='%s' err='%v'", OV_Index_File, err)
+			return false
+		}
+	}
+	muxNewOVI.Unlock()
+	return CMD_NewOverviewIndex(file, group)
+} // end func RebuildOverviewIndex
+
 func WriteOverviewIndex(file string, msgnums []uint64, offsets map[uint64]int64) {
 	if offsets == nil {
 		log.Printf("Error WriteOverviewIndex fp='%s' offsets=nil", filepath.Base(file))
@@ -328,6 +350,9 @@ func (ovi *OverviewIndex) MemDropIndexCache(group string, fnum uint64) {
 		ovi.IndexMap = make(map[string]map[uint64]CachedOffset, ovi.IndexCacheSize)
 		ovi.IndexCache = []string{}
 	} else {
+		if ovi.IndexMap == nil {
+			return
+		}
 		// drop index cache for group
 		switch fnum {
 		case 0:
@@ -363,23 +388,48 @@ func OV_AutoIndex() {
 } // end func OV_Indexer
 
 func ReOrderOverview(file string, group string, doWritestamps bool, hashdb *sql.DB) bool {
+	_, retbool := ReOrderOverviewRemap(file, group, doWritestamps, hashdb)
+	return retbool
+} // end func ReOrderOverview
+
+// ReOrderOverviewRemap renumbers the overview by Date and returns the old -> new msgnum mapping
+func ReOrderOverviewRemap(file string, group string, doWritestamps bool, hashdb *sql.DB) ([]ReMap, bool) {
 	/*
 	if strings.HasSuffix(group, ".test") {
-		return false
+		return nil, false
 	}
 	*/
 	debug := false
+	if fi, err := os.Stat(file); err == nil && fi.Size() > REORDER_MAX_INMEM_SIZE {
+		// too big to sort in memory, resumes an interrupted run
+		return ReOrderOverviewExternal(file, group, doWritestamps, hashdb, &ReOrderOpts{Resume: true})
+	}
 	newfile := file + ".new"
-	if utils.FileExists(newfile) {
-		if debug {
-			log.Printf("Error ReOrderOverview FileExists newfile='%s'", newfile)
-		}
-		return false
+	if utils.FileExists(file + ".reorder") {
+		// checkpoint of an interrupted ReOrderOverviewExternal, it owns the .new file
+		return ReOrderOverviewExternal(file, group, doWritestamps, hashdb, &ReOrderOpts{Resume: true})
 	}
 	if !utils.FileExists(file) {
 		log.Printf("Error ReOrderOverview !FileExists file='%s' group='%s'", file, group)
-		return false
+		return nil, false
 	}
+	hash, err := get_hash_from_filename(file)
+	if err != nil {
+		log.Printf("Error ReOrderOverview file='%s' err='%v'", filepath.Base(file), err)
+		return nil, false
+	}
+	// hold the group lock from reading the file until the .new file is swapped in
+	// so no writer appends lines we would lose with the rename
+	who := "ReOrderOV"
+	if err := OV_handler.LockGroup(who, hash); err != nil {
+		log.Printf("Error ReOrderOverview LockGroup file='%s' err='%v'", filepath.Base(file), err)
+		return nil, false
+	}
+	defer OV_handler.UnlockGroup(who, hash)
+	if remap, done, ok := reorder_stale_newfile(who, file, newfile, group); done {
+		return remap, ok
+	}
+
 	var a, b uint64
 	a = 1
 	fields := "ReOrderOV"
@@ -395,12 +445,12 @@ func ReOrderOverview(file string, group string, doWritestamps bool, hashdb *sql.
 	var header string
 	var footer []string
 	var readfooter bool
-	spamfilter := &SPAMFILTER{}
+	var remap []ReMap // New is 0 if line was dropped
 readlines:
 	for i, line := range lines {
 		if line == "" {
 			log.Printf("Error OV ReOrderOverview i=%d line=nil ll=%d", i, ll)
-			return false
+			return nil, false
 		}
 
 		if i == 0 {
@@ -422,7 +472,7 @@ readlines:
 		datafields := strings.Split(line, "\t")
 		if len(datafields) < OVERVIEW_FIELDS {
 			log.Printf("Error OV ReOrderOverview file='%s' len(datafields)=%d < OVERVIEW_FIELDS=%d i=%d", filepath.Base(file), len(datafields), OVERVIEW_FIELDS, i)
-			return false
+			return nil, false
 		}
 
 		//if !isvalidmsgid(datafields[4], true) {
@@ -431,7 +481,7 @@ readlines:
 		//	//	continue
 		//	//}
 		//	log.Printf("Error OV ReOrderOverview file='%s' lc=%d field[4] err='!isvalidmsgid' f4='%s' f8='%s'", filepath.Base(file), i, datafields[4], datafields[8])
-		//	return false
+		//	return nil, false
 		//}
 
 		//msgnum := utils.Str2uint64(datafields[0])
@@ -443,6 +493,7 @@ readlines:
 				log.Printf("Ignore Duplicate msgid='%s' file='%s' i=%d", msgid, filepath.Base(file), i)
 			}
 			//time.Sleep(time.Second)
+			remap = append(remap, ReMap{Old: utils.Str2uint64(datafields[0]), Msgid: msgid})
 			continue readlines
 		case false:
 			uniq_msgids[msgid] = true
@@ -451,7 +502,8 @@ readlines:
 		unixepoch, err := ParseDate(datafields[3])
 		if err != nil {
 			log.Printf("IGNORE Error OV ReOrderOverview ParseDate file='%s' i=%d err='%v' unixepoch=%d msgid='%s' subj='%s' xref='%s'", filepath.Base(file), i, err, unixepoch, msgid, datafields[1], datafields[8])
-			//return false
+			//return nil, false
+			remap = append(remap, ReMap{Old: utils.Str2uint64(datafields[0]), Msgid: msgid})
 			continue readlines
 		}
 		mapdata[unixepoch] = append(mapdata[unixepoch], line)
@@ -470,7 +522,6 @@ readlines:
 	var new_msgnum uint64 = 1
 	var writeLines []string
 	var writestamps []string
-	var useSpamfilter bool = false
 	for _, timestamp := range unixstamps {
 		//log.Printf("ReOrderOV timestamp=%d i=%d/l=%d", timestamp, i, l)
 		if debug && len(mapdata[timestamp]) > 1 {
@@ -482,99 +533,18 @@ readlines:
 			if old_msgnum <= 0 {
 				continue
 			}
-			subj := datafields[1]
-			from := datafields[2]
-			date := datafields[3]
 			msgid := datafields[4]
 			if doWritestamps {
 				writestamps = append(writestamps, fmt.Sprintf("%d %s", timestamp, utils.Hash256(datafields[4])))
 			}
 
-			//xref := ""
-			//full_xref_str := datafields[8]
-			var new_xrefs []string
-			// check xrefs
-			xrefs := strings.Split(datafields[8], " ")
-			// first xref has to be "nntp", then group:n
-			if len(xrefs) >= 2 && xrefs[0] == "nntp" {
-				// loop over all xrefs we have
-			loop_xrefs:
-				for x := 1; x < len(xrefs); x++ {
-
-					axref := xrefs[x]
-					xrefdata := strings.Split(axref, ":")
-					len_xrefdata := len(xrefdata)
-
-					if len_xrefdata != 2 {
-						log.Printf("Error ReOrderOV len_xrefdata != 2 old=%d new=%d msgid='%s'", old_msgnum, new_msgnum, msgid)
-						continue loop_xrefs
-					}
-
-					xrefgroup := xrefdata[0]
-					if group != xrefgroup {
-						//log.Printf("WARN ReOrderOV IGNORE xrefgroup='%s' group='%s' msgid='%s'", xrefgroup, group, msgid)
-						continue loop_xrefs
-					}
-
-					new_xrefs = append(new_xrefs, fmt.Sprintf("%s:%d", xrefgroup, new_msgnum))
-				}
-			}
-
-			//parsedTime := time.Unix(timestamp, 0)
-			//rfc5322date := parsedTime.Format(time.RFC1123Z)
-			//date := rfc5322date
-
-			if old_msgnum != new_msgnum {
-				if debug {
-					log.Printf("ReOrderOV old_msgnum=%d -> new_msgnum=%d date='%s' msgid='%s'", old_msgnum, new_msgnum, date, msgid)
-				}
-			}
-
-
-			if useSpamfilter {
-
-				if spamfilter.Spamfilter(subj, "subj", msgid) {
-					//log.Printf("ReOrderOV IGNORED msgid='%s' spamfilter 'subj'='%s'", msgid, subj)
-					if hashdb != nil {
-						MsgIDhash2mysqlStat(utils.Hash256(msgid), "r", hashdb)
-					}
-					continue
-				}
-
-				if spamfilter.Spamfilter(from, "from", msgid) {
-					//log.Printf("ReOrderOV IGNORED msgid='%s' spamfilter 'from'='%s'", msgid, from)
-					if hashdb != nil {
-						MsgIDhash2mysqlStat(utils.Hash256(msgid), "r", hashdb)
-					}
-					continue
-				}
-
-				doLimitBytes := false  // hardcoded flag
-				if doLimitBytes {
-					bytes := utils.Str2uint64(datafields[6])
-					var limit_bytes uint64 = 256 * 1024 // hardcoded 256K
-					if bytes > limit_bytes {
-						log.Printf("ReOrderOV IGNORED msgid='%s' bytes=%d", msgid, bytes)
-						continue
-					}
-				}
-
-			}
-			new_xref := "nntp"
-			for x := 0; x < len(new_xrefs); x++ {
-				new_xref = new_xref + " " + new_xrefs[x]
-			}
-
-			/*
-			flags := "_"
-			if len(datafields) == 10 {
-				flags = datafields[9]
+			newline, keep := reorder_line(group, datafields, old_msgnum, new_msgnum, hashdb, debug)
+			if !keep {
+				remap = append(remap, ReMap{Old: old_msgnum, Msgid: msgid})
+				continue
 			}
-			*/
-
-			//newline := fmt.Sprintf("%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s", new_msgnum, subj, from, date, msgid, datafields[5], datafields[6], datafields[7], new_xref, flags)
-			newline := fmt.Sprintf("%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s", new_msgnum, subj, from, date, msgid, datafields[5], datafields[6], datafields[7], new_xref)
 			writeLines = append(writeLines, newline)
+			remap = append(remap, ReMap{Old: old_msgnum, New: new_msgnum, Msgid: msgid})
 			if debug {
 				log.Printf("newline='%s'", newline)
 			}
@@ -584,13 +554,13 @@ readlines:
 
 	if len(header) <= 0 || len(header) > 128 || len(footer) != 3 {
 		log.Printf("Error OV ReOrderOverview head=%d foot=%d file='%s'", len(header), len(footer), filepath.Base(file))
-		return false
+		return nil, false
 	}
 	if len(writestamps) > 0 {
 		newfhs, err := os.Create(newfile+".stamps")
 		if err != nil {
 			log.Printf("Error OV ReOrderOverview writestamps os.Create(newfile='%s') err='%v'", filepath.Base(newfile), err)
-			return false
+			return nil, false
 		}
 		defer newfhs.Close()
 		for _, line := range writestamps {
@@ -604,39 +574,185 @@ readlines:
 		newfh, err := os.Create(newfile)
 		if err != nil {
 			log.Printf("Error OV ReOrderOverview os.Create(newfile='%s') err='%v'", filepath.Base(newfile), err)
-			return false
+			return nil, false
 		}
 		fmt.Fprintf(newfh, "%s\n", header)
-		for i, line := range writeLines {
+		for _, line := range writeLines {
 			if line == "" {
-				return false
-			}
-
-			fmt.Fprintf(newfh, "%s", line)
-			if i < len(writeLines)-1 {
-				fmt.Fprint(newfh, "\n") // do not append newline on last line!
+				return nil, false
 			}
+			// terminate the last line too: Rescan_Overview mode 999 sets Findex
+			// after the last newline and a file swapped in gets appended there
+			fmt.Fprintf(newfh, "%s\n", line)
 		}
 		//fmt.Fprintf(newfh, "\x00")
 		err = newfh.Close()
 		if err != nil {
 			log.Printf("Error OV ReOrderOV newfh='%s' err='%v'", filepath.Base(newfile), err)
-			return false
+			return nil, false
 		}
 		log.Printf("wrote %d lines to newfh='%s'", len(writeLines), filepath.Base(newfile))
-		who := "ReOrderOV"
 		debug_rescan := false
 		var db *sql.DB = nil
 		retbool, last := Rescan_Overview(who, newfile, group, 999, debug_rescan, db, nil)
 		if retbool {
 			log.Printf("OK ReOrderOV Rescan_Overview newfh='%s' retbool=%t last=%d", filepath.Base(newfile), retbool, last)
-			return true
+			sort.Sort(AsortReMap(remap))
+			if !WriteReMap(newfile+".remap", remap) {
+				return nil, false
+			}
+			if !swap_reordered_overview(who, file, newfile, group) {
+				return nil, false
+			}
+			return remap, true
 		}
 		log.Printf("Error OV ReOrderOV Rescan_Overview newfh='%s' retbool=%t last=%d", filepath.Base(newfile), retbool, last)
 
 	}
-	return false
-} // end func ReOrderOverview
+	return nil, false
+} // end func ReOrderOverviewRemap
+
+func reorder_stale_newfile(who string, file string, newfile string, group string) ([]ReMap, bool, bool) {
+	// cleans up after an interrupted in-memory reorder, caller holds the group lock
+	// a .new file was not swapped in: file is untouched, the .new and its sidecars are removed
+	// sidecars without .new: crashed in the swap, finishes it and returns done
+	if utils.FileExists(newfile) {
+		log.Printf("WARN %s removes stale newfile='%s' of an interrupted reorder", who, filepath.Base(newfile))
+		for _, fp := range []string{newfile, newfile + ".stamps", newfile + ".remap"} {
+			if err := os.Remove(fp); err != nil && !os.IsNotExist(err) {
+				log.Printf("Error OV %s remove stale fp='%s' err='%v'", who, filepath.Base(fp), err)
+				return nil, true, false
+			}
+		}
+		return nil, false, false
+	}
+	if !utils.FileExists(newfile+".stamps") && !utils.FileExists(newfile+".remap") {
+		return nil, false, false
+	}
+	log.Printf("WARN %s resumes interrupted swap file='%s'", who, filepath.Base(file))
+	if !finish_reordered_overview(who, file, newfile, group) {
+		return nil, true, false
+	}
+	remap, err := ReadReMap(file + ".remap")
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Error OV %s ReadReMap file='%s' err='%v'", who, filepath.Base(file), err)
+	}
+	return remap, true, true
+} // end func reorder_stale_newfile
+
+func swap_reordered_overview(who string, file string, newfile string, group string) bool {
+	// renames the rescanned .new file over the live overview file
+	// caller has to hold OV_handler.LockGroup so no writer has the file open
+	if err := os.Rename(newfile, file); err != nil {
+		log.Printf("Error OV swap_reordered_overview rename newfile='%s' err='%v'", filepath.Base(newfile), err)
+		return false
+	}
+	return finish_reordered_overview(who, file, newfile, group)
+} // end func swap_reordered_overview
+
+func finish_reordered_overview(who string, file string, newfile string, group string) bool {
+	// renames the sidecars of newfile and rebuilds the index after newfile was renamed to file
+	for _, ext := range []string{".stamps", ".remap"} {
+		if !utils.FileExists(newfile + ext) {
+			continue
+		}
+		if err := os.Rename(newfile+ext, file+ext); err != nil {
+			log.Printf("Error OV swap_reordered_overview rename fp='%s' err='%v'", filepath.Base(newfile+ext), err)
+			return false
+		}
+	}
+	// msgnums changed: cached and stored index offsets are invalid
+	OVIndex.MemDropIndexCache(group, 0)
+	if !RebuildOverviewIndex(file, group) {
+		log.Printf("Error OV swap_reordered_overview RebuildOverviewIndex file='%s' group='%s'", filepath.Base(file), group)
+		return false
+	}
+	if SHORT_HASH_DB != nil {
+		// offsets changed: the s_xxx rows of file point to other lines
+		if _, err := ShortHashReindex(file, SHORT_HASH_DB); err != nil {
+			log.Printf("Error OV swap_reordered_overview ShortHashReindex file='%s' group='%s' err='%v'", filepath.Base(file), group, err)
+		}
+	}
+	// msgnums changed: followers have to copy the file
+	REPLICATION_FEED.emit_resync(file, group)
+	log.Printf("OK %s swapped reordered overview file='%s' group='%s'", who, filepath.Base(file), group)
+	return true
+} // end func finish_reordered_overview
+
+func reorder_line(group string, datafields []string, old_msgnum uint64, new_msgnum uint64, hashdb *sql.DB, debug bool) (string, bool) {
+	// rewrites one overview line of ReOrderOverview to new_msgnum
+	// returns false if the line gets dropped
+	subj := datafields[1]
+	from := datafields[2]
+	date := datafields[3]
+	msgid := datafields[4]
+
+	//xref := ""
+	//full_xref_str := datafields[8]
+	var new_xrefs []string
+	// check xrefs
+	xrefs := strings.Split(datafields[8], " ")
+	// first xref has to be "nntp", then group:n
+	if len(xrefs) >= 2 && xrefs[0] == "nntp" {
+		// loop over all xrefs we have
+	loop_xrefs:
+		for x := 1; x < len(xrefs); x++ {
+
+			axref := xrefs[x]
+			xrefdata := strings.Split(axref, ":")
+			len_xrefdata := len(xrefdata)
+
+			if len_xrefdata != 2 {
+				log.Printf("Error ReOrderOV len_xrefdata != 2 old=%d new=%d msgid='%s'", old_msgnum, new_msgnum, msgid)
+				continue loop_xrefs
+			}
+
+			xrefgroup := xrefdata[0]
+			if group != xrefgroup {
+				//log.Printf("WARN ReOrderOV IGNORE xrefgroup='%s' group='%s' msgid='%s'", xrefgroup, group, msgid)
+				continue loop_xrefs
+			}
+
+			new_xrefs = append(new_xrefs, fmt.Sprintf("%s:%d", xrefgroup, new_msgnum))
+		}
+	}
+
+	//parsedTime := time.Unix(timestamp, 0)
+	//rfc5322date := parsedTime.Format(time.RFC1123Z)
+	//date := rfc5322date
+
+	if old_msgnum != new_msgnum {
+		if debug {
+			log.Printf("ReOrderOV old_msgnum=%d -> new_msgnum=%d date='%s' msgid='%s'", old_msgnum, new_msgnum, date, msgid)
+		}
+	}
+
+	ovl := Parse_OVL(datafields)
+	if verdict, filter, reason := ReorderChain.Run(&ovl, nil); verdict == VerdictReject || verdict == VerdictQuarantine {
+		if debug {
+			log.Printf("ReOrderOV IGNORED msgid='%s' filter='%s' reason='%s'", msgid, filter, reason)
+		}
+		if hashdb != nil {
+			SetStat(utils.Hash256(msgid), StatRejected, NewMySQLStore(hashdb))
+		}
+		return "", false
+	}
+	new_xref := "nntp"
+	for x := 0; x < len(new_xrefs); x++ {
+		new_xref = new_xref + " " + new_xrefs[x]
+	}
+
+	/*
+	flags := "_"
+	if len(datafields) == 10 {
+		flags = datafields[9]
+	}
+	*/
+
+	//newline := fmt.Sprintf("%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s", new_msgnum, subj, from, date, msgid, datafields[5], datafields[6], datafields[7], new_xref, flags)
+	newline := fmt.Sprintf("%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s", new_msgnum, subj, from, date, msgid, datafields[5], datafields[6], datafields[7], new_xref)
+	return newline, true
+} // end func reorder_line
 
 type AsortFuncInt64 []int64
 
@@ -4,21 +4,23 @@ import (
 	"log"
 	"strings"
 	"sync"
+	"time"
 )
 
 type SPAMFILTER struct {
 	mux sync.RWMutex
-	/*
-	FILE_BAD_FROM_MATCH string  // filter.from.match
-	FILE_BAD_FROM_CONTAINS string // filter.from.contains
-	FILE_BAD_FROM_SUFFIX string // filter.from.suffix
-	FILE_BAD_SUBJ_CONTAINS string // filter.subject.contains
-	SP_BAD_FROM_MATCH []string
-	SP_BAD_FROM_CONTAINS []string
-	SP_BAD_SUBJ_CONTAINS []string
-	*/
+	// rule files or directories, see LoadRules
+	// without files the builtin BAD_* lists are used
+	paths     []string
+	signature string // names, sizes and mtimes of loaded rule files
+	rules     map[string][]*SpamRule // key: "subj", "from" or "msgid"
+	temp      map[string]*temp_rule  // key: rule id, added by AddTempRule
 }
 
+type temp_rule struct {
+	rule    *SpamRule
+	expires int64 // unix
+}
 
 var (
 	/* subject
@@ -308,55 +310,84 @@ var (
 )
 
 func (s *SPAMFILTER) Spamfilter(input string, spamtype string, msgid string) bool {
+	return s.Hit(input, spamtype, msgid) != ""
+} // end func spamfilter
+
+func (s *SPAMFILTER) Hit(input string, spamtype string, msgid string) string {
+	// returns the id of the first rule matching input or an empty string
 	if input == "" {
 		log.Printf("Error OV spamfilter input=nil")
-		return true
+		return "input=nil"
 	}
-	switch spamtype {
-	case "subj":
-		for _, bad := range BAD_SUBJ_MATCH {
-			if input == bad {
-				//log.Printf("SPAMFILTER BAD_SUBJ_MATCH msgid='%s' subj='%s' bad='%s'", msgid, input, bad)
-				return true
-			}
-		}
-		for _, bad := range BAD_SUBJ_PREFIX {
-			if strings.HasPrefix(strings.ToLower(input), strings.ToLower(bad)) {
-				//log.Printf("SPAMFILTER BAD_SUBJ_PREFIX msgid='%s' subj='%s' bad='%s'", msgid, input, bad)
-				return true
-			}
-		}
-		for _, bad := range BAD_SUBJ_SUFFIX {
-			if strings.HasSuffix(strings.ToLower(input), strings.ToLower(bad)) {
-				//log.Printf("SPAMFILTER BAD_SUBJ_SUFFIX msgid='%s' subj='%s' bad='%s'", msgid, input, bad)
-				return true
-			}
-		}
-		for _, bad := range BAD_SUBJ_CONTAINS {
-			if strings.Contains(strings.ToLower(input), strings.ToLower(bad)) {
-				//log.Printf("SPAMFILTER BAD_SUBJ_CONTAINS msgid='%s' subj='%s' bad='%s'", msgid, input, bad)
-				return true
+	s.mux.RLock()
+	rules := s.rules
+	temp := s.temp_rules(spamtype)
+	s.mux.RUnlock()
+	if rules == nil {
+		rules = builtin_spamrules()
+	}
+	lower := strings.ToLower(input)
+	for _, list := range [][]*SpamRule{rules[spamtype], temp} {
+		for _, rule := range list {
+			if rule.Match(input, lower) {
+				log.Printf("SPAMFILTER hit id='%s' kind=%s %s='%s' msgid='%s'", rule.Id, rule.Kind, spamtype, input, msgid)
+				return rule.Id
 			}
 		}
-	case "from":
-		for _, bad := range BAD_FROM_MATCH {
-			if strings.ToLower(bad) == strings.ToLower(input) {
-				//log.Printf("SPAMFILTER BAD_FROM_MATCH msgid='%s' from='%s' bad='%s'", msgid, input, bad)
-				return true
-			}
+	}
+	return ""
+} // end func SPAMFILTER.Hit
+
+func (s *SPAMFILTER) TempHit(input string, spamtype string, msgid string) string {
+	// like Hit but checks only the rules added by AddTempRule
+	if input == "" {
+		return ""
+	}
+	s.mux.RLock()
+	temp := s.temp_rules(spamtype)
+	s.mux.RUnlock()
+	lower := strings.ToLower(input)
+	for _, rule := range temp {
+		if rule.Match(input, lower) {
+			log.Printf("SPAMFILTER temp hit id='%s' kind=%s %s='%s' msgid='%s'", rule.Id, rule.Kind, spamtype, input, msgid)
+			return rule.Id
 		}
-		for _, bad := range BAD_FROM_SUFFIX {
-			if strings.ToLower(bad) == strings.ToLower(input) {
-				//log.Printf("SPAMFILTER BAD_FROM_SUFFIX msgid='%s' from='%s' bad='%s'", msgid, input, bad)
-				return true
+	}
+	return ""
+} // end func SPAMFILTER.TempHit
+
+func (s *SPAMFILTER) temp_rules(spamtype string) []*SpamRule {
+	// returns the not expired temporary rules of spamtype, caller holds s.mux
+	var temp []*SpamRule
+	if len(s.temp) > 0 {
+		now := time.Now().Unix()
+		for _, tr := range s.temp {
+			if tr.rule.Field == spamtype && tr.expires > now {
+				temp = append(temp, tr.rule)
 			}
 		}
-		for _, bad := range BAD_FROM_CONTAINS {
-			if strings.Contains(strings.ToLower(input), strings.ToLower(bad)) {
-				//log.Printf("SPAMFILTER BAD_FROM_CONTAINS msgid='%s' from='%s' bad='%s'", msgid, input, bad)
-				return true
-			}
+	}
+	return temp
+} // end func SPAMFILTER.temp_rules
+
+func (s *SPAMFILTER) AddTempRule(rule *SpamRule, ttl time.Duration) bool {
+	// adds a rule that expires after ttl, returns false if the id exists and is not expired
+	// temporary rules survive LoadRules and Reload
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	now := time.Now().Unix()
+	if s.temp == nil {
+		s.temp = make(map[string]*temp_rule)
+	}
+	for id, tr := range s.temp {
+		if tr.expires <= now {
+			delete(s.temp, id)
 		}
 	}
-	return false
-} // end func spamfilter
+	if s.temp[rule.Id] != nil {
+		return false
+	}
+	s.temp[rule.Id] = &temp_rule{rule: rule, expires: now + int64(ttl/time.Second)}
+	log.Printf("SPAMFILTER AddTempRule id='%s' %s %s='%s' ttl=%v", rule.Id, rule.Field, rule.Kind, rule.Pattern, ttl)
+	return true
+} // end func SPAMFILTER.AddTempRule
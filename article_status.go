@@ -0,0 +1,267 @@
+package overview
+
+/*
+ * typed stat of the msgidhash tables
+ *
+ * the stat column holds one letter or NULL (StatNone).
+ * every stat means the article gets dropped, Valid accepts only the letters below.
+ *
+ *   SetStat(msgidhash, StatCancel, store)  // marks a msgidhash
+ *   ClearStat(StatCancel, store)           // deletes msgidhashs without size having the stat
+ *   CountByStat(store)                     // counts per table and stat, see StatReport
+ *
+ * StatCommand is the entry point of cmd/ovstat.
+ */
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"time"
+)
+
+// ArticleStatus is the stat of a msgidhash
+type ArticleStatus byte
+
+const (
+	StatNone         ArticleStatus = 0   // NULL in the tables
+	StatAbuse        ArticleStatus = 'a' // abuse takedown
+	StatBanned       ArticleStatus = 'b' // banned / no accepted newsgroups
+	StatCancel       ArticleStatus = 'c' // cancel
+	StatDelete       ArticleStatus = 'd' // to delete
+	StatExpired      ArticleStatus = 'e' // expired
+	StatCleanfeed    ArticleStatus = 'f' // filtered by cleanfeed
+	StatGroupRemoved ArticleStatus = 'g' // group removed
+	StatBadArticle   ArticleStatus = 'h' // bad/nil head/body
+	StatNoCeM        ArticleStatus = 'n' // nocem, listed in an applied NoCeM notice
+	StatBadChecksum  ArticleStatus = 'o' // bad header overview checksum
+	StatPyClean      ArticleStatus = 'p' // filtered by pyClean
+	StatRejected     ArticleStatus = 'r' // removed by overview spamfilter or a filter chain
+	StatSpamAssassin ArticleStatus = 's' // filtered by spam assasin
+	StatCrosspost    ArticleStatus = 'x' // crosspost
+	StatPrefetch     ArticleStatus = 'z' // prefetch/proxy/binary filter
+)
+
+var article_status_names = map[ArticleStatus]string{
+	StatAbuse:        "abuse",
+	StatBanned:       "banned",
+	StatCancel:       "cancel",
+	StatDelete:       "delete",
+	StatExpired:      "expired",
+	StatCleanfeed:    "cleanfeed",
+	StatGroupRemoved: "groupremoved",
+	StatBadArticle:   "badarticle",
+	StatNoCeM:        "nocem",
+	StatBadChecksum:  "badchecksum",
+	StatPyClean:      "pyclean",
+	StatRejected:     "rejected",
+	StatSpamAssassin: "spamassassin",
+	StatCrosspost:    "crosspost",
+	StatPrefetch:     "prefetch",
+}
+
+func ParseArticleStatus(s string) (ArticleStatus, error) {
+	// parses a stat letter, "" is StatNone
+	if s == "" {
+		return StatNone, nil
+	}
+	if len(s) != 1 || !ArticleStatus(s[0]).Valid() {
+		return StatNone, fmt.Errorf("ERROR overview.ParseArticleStatus invalid stat='%s'", s)
+	}
+	return ArticleStatus(s[0]), nil
+} // end func ParseArticleStatus
+
+func (st ArticleStatus) Valid() bool {
+	// true for the named letters, StatNone is not valid
+	_, ok := article_status_names[st]
+	return ok
+} // end func ArticleStatus.Valid
+
+func (st ArticleStatus) String() string {
+	// returns the letter stored in the tables
+	if st == StatNone {
+		return ""
+	}
+	return string(rune(st))
+} // end func ArticleStatus.String
+
+func (st ArticleStatus) Name() string {
+	if st == StatNone {
+		return "none"
+	}
+	if name, ok := article_status_names[st]; ok {
+		return name
+	}
+	return "stat_" + st.String()
+} // end func ArticleStatus.Name
+
+func SetStat(messageidhash string, st ArticleStatus, store MsgidHashStore) (bool, error) {
+	// sets the stat of messageidhash, inserts it without size if missing
+	if !st.Valid() {
+		return false, fmt.Errorf("ERROR overview.SetStat invalid stat=%d", st)
+	}
+	return store.SetStat(messageidhash, st.String())
+} // end func SetStat
+
+func ClearStat(st ArticleStatus, store MsgidHashStore) (int64, error) {
+	// deletes msgidhashs without size having stat st
+	if !st.Valid() {
+		return 0, fmt.Errorf("ERROR overview.ClearStat invalid stat=%d", st)
+	}
+	start := time.Now()
+	deleted, err := store.ClearStat(st.String())
+	log.Printf("ClearStat stat='%s' deleted=%d took=(%d ms) err='%v'", st, deleted, time.Since(start).Milliseconds(), err)
+	return deleted, err
+} // end func ClearStat
+
+func CountByStat(store MsgidHashStore) (map[string]map[ArticleStatus]int64, error) {
+	// returns the number of msgidhashs per stat, key: table name
+	// a MySQLStore counts per h_xxx table, other stores have one table "all"
+	if s, ok := store.(*MySQLStore); ok {
+		return s.count_by_stat()
+	}
+	counts := map[string]map[ArticleStatus]int64{"all": make(map[ArticleStatus]int64)}
+	err := store.Iterate(func(msgidhash string, size int, stat string) bool {
+		counts["all"][status_of(stat)]++
+		return true
+	})
+	if err != nil {
+		log.Printf("ERROR overview.CountByStat err='%v'", err)
+		return nil, err
+	}
+	return counts, nil
+} // end func CountByStat
+
+func status_of(stat string) ArticleStatus {
+	// unknown letters are counted too, the report shows them
+	st, err := ParseArticleStatus(stat)
+	if err != nil {
+		st = ArticleStatus(stat[0])
+	}
+	return st
+} // end func status_of
+
+func (s *MySQLStore) count_by_stat() (map[string]map[ArticleStatus]int64, error) {
+	counts := make(map[string]map[ArticleStatus]int64)
+	for _, width := range shard_widths() {
+		for _, key := range shard_keys(width) {
+			table := "h_" + key
+			rows, err := s.db.Query("SELECT stat, COUNT(*) FROM " + table + " GROUP BY stat")
+			if err != nil {
+				log.Printf("ERROR overview.CountByStat table='%s' err='%v'", table, err)
+				return nil, err
+			}
+			counts[table] = make(map[ArticleStatus]int64)
+			for rows.Next() {
+				var stat sql.NullString
+				var n int64
+				if err := rows.Scan(&stat, &n); err != nil {
+					rows.Close()
+					return nil, err
+				}
+				counts[table][status_of(stat.String)] += n
+			}
+			err = rows.Err()
+			rows.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return counts, nil
+} // end func MySQLStore.count_by_stat
+
+func StatReport(store MsgidHashStore, w io.Writer) error {
+	// writes counts per stat for every table with rows and a total line
+	counts, err := CountByStat(store)
+	if err != nil {
+		return err
+	}
+	total := make(map[ArticleStatus]int64)
+	var tables []string
+	for table, stats := range counts {
+		for st, n := range stats {
+			total[st] += n
+		}
+		if len(stats) > 0 {
+			tables = append(tables, table)
+		}
+	}
+	sort.Strings(tables)
+	var stats []ArticleStatus
+	for st := range total {
+		stats = append(stats, st)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i] < stats[j] })
+
+	fmt.Fprintf(w, "%-8s", "table")
+	for _, st := range stats {
+		fmt.Fprintf(w, " %12s", st.Name())
+	}
+	fmt.Fprintln(w)
+	line := func(name string, stat map[ArticleStatus]int64) {
+		fmt.Fprintf(w, "%-8s", name)
+		for _, st := range stats {
+			fmt.Fprintf(w, " %12d", stat[st])
+		}
+		fmt.Fprintln(w)
+	}
+	for _, table := range tables {
+		line(table, counts[table])
+	}
+	line("total", total)
+	return nil
+} // end func StatReport
+
+func StatCommand(args []string, w io.Writer) error {
+	// entry point of cmd/ovstat: prints StatReport, -clear deletes msgidhashs without size having a stat
+	//   ovstat -host 127.0.0.1:3306 -user ov -pass secret -db overview [-clear n]
+	//   ovstat -kv /ov/msgidhash.kv [-clear n]
+	fs := flag.NewFlagSet("ovstat", flag.ContinueOnError)
+	fs.SetOutput(w)
+	kvfile := fs.String("kv", "", "KVStore file, instead of mysql")
+	host := fs.String("host", "", "mysql host")
+	user := fs.String("user", "", "mysql user")
+	pass := fs.String("pass", "", "mysql password")
+	dbname := fs.String("db", "", "mysql database")
+	clear := fs.String("clear", "", "stat letter to clear before the report")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var store MsgidHashStore
+	switch {
+	case *kvfile != "":
+		kv, err := OpenKVStore(*kvfile)
+		if err != nil {
+			return err
+		}
+		store = kv
+	case *dbname != "":
+		db, err := ConnSQL(*user, *pass, *host, *dbname)
+		if err != nil {
+			return err
+		}
+		if err := LoadSchema(db); err != nil {
+			db.Close()
+			return err
+		}
+		store = NewMySQLStore(db)
+	default:
+		fs.Usage()
+		return fmt.Errorf("ERROR overview.StatCommand need -kv or -db")
+	}
+	defer store.Close()
+	if *clear != "" {
+		st, err := ParseArticleStatus(*clear)
+		if err != nil {
+			return err
+		}
+		if _, err := ClearStat(st, store); err != nil {
+			return err
+		}
+	}
+	return StatReport(store, w)
+} // end func StatCommand
@@ -0,0 +1,273 @@
+package overview
+
+/*
+ * naive bayes spam scoring of overview lines
+ *
+ * tokens: words of Subject (s:), words and domain of From (f:, fd:)
+ *         and the domain of the Message-ID (md:)
+ *
+ * train from overview files with the stat of every msgid:
+ *   bf := NewBayesFilter()
+ *   bf.TrainFromOverview(file, MySQLViewStat(db))
+ *   bf.Save("/ov/bayes.db")
+ *   IngestChain.Add(bf)
+ *
+ * the model file has one "token spamcount hamcount" per line
+ * after a first line "#bayes nspam nham".
+ */
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+var (
+	BAYES_THRESHOLD     float64 = 0.95 // default score from which a line is spam
+	BAYES_MIN_TRAINED   uint64  = 100  // BayesFilter accepts everything until it saw this many spam and ham lines
+	BAYES_SPAM_STATS    string  = "r"  // msgidhash stats counted as spam by TrainFromOverview
+	BAYES_MAX_TOKEN_LEN int     = 32
+)
+
+// BayesFilter is a Filter scoring lines with a naive bayes model
+type BayesFilter struct {
+	mux       sync.RWMutex
+	spam      map[string]uint64 // lines of spam with this token
+	ham       map[string]uint64 // lines of ham with this token
+	nspam     uint64
+	nham      uint64
+	Threshold float64 // score >= Threshold returns Verdict
+	Verdict   Verdict
+	DryRun    bool // only log scores, always accept
+}
+
+func NewBayesFilter() *BayesFilter {
+	return &BayesFilter{
+		spam:      make(map[string]uint64),
+		ham:       make(map[string]uint64),
+		Threshold: BAYES_THRESHOLD,
+		Verdict:   VerdictReject,
+	}
+} // end func NewBayesFilter
+
+func (bf *BayesFilter) Name() string { return "Bayes" }
+
+func (bf *BayesFilter) Check(ovl *OVL, headers map[string][]string) (Verdict, string) {
+	bf.mux.RLock()
+	trained := bf.nspam >= BAYES_MIN_TRAINED && bf.nham >= BAYES_MIN_TRAINED
+	bf.mux.RUnlock()
+	if !trained {
+		return VerdictAccept, ""
+	}
+	score := bf.Score(ovl)
+	if bf.DryRun {
+		log.Printf("Bayes DryRun score=%.4f msgid='%s' subj='%s'", score, ovl.Messageid, ovl.Subject)
+		return VerdictAccept, ""
+	}
+	if score >= bf.Threshold {
+		return bf.Verdict, fmt.Sprintf("bayes=%.4f", score)
+	}
+	return VerdictAccept, ""
+}
+
+func BayesTokens(ovl *OVL) []string {
+	// returns the unique tokens of an overview line
+	uniq := make(map[string]bool)
+	var tokens []string
+	add := func(token string) {
+		if len(token) > BAYES_MAX_TOKEN_LEN || uniq[token] {
+			return
+		}
+		uniq[token] = true
+		tokens = append(tokens, token)
+	}
+	words := func(prefix string, input string) {
+		for _, word := range strings.FieldsFunc(strings.ToLower(input), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		}) {
+			if len(word) >= 2 {
+				add(prefix + word)
+			}
+		}
+	}
+	words("s:", ovl.Subject)
+	words("f:", ovl.From)
+	if domain := bayes_domain(ovl.From); domain != "" {
+		add("fd:" + domain)
+	}
+	if domain := bayes_domain(ovl.Messageid); domain != "" {
+		add("md:" + domain)
+	}
+	return tokens
+} // end func BayesTokens
+
+func bayes_domain(input string) string {
+	// returns the lowercased domain after the last @ of "<local@domain>" or "name <a@domain>"
+	i := strings.LastIndex(input, "@")
+	if i < 0 {
+		return ""
+	}
+	domain := strings.ToLower(input[i+1:])
+	if j := strings.IndexFunc(domain, func(r rune) bool { return r == '>' || unicode.IsSpace(r) }); j >= 0 {
+		domain = domain[:j]
+	}
+	return domain
+} // end func bayes_domain
+
+func (bf *BayesFilter) Train(ovl *OVL, spam bool) {
+	tokens := BayesTokens(ovl)
+	bf.mux.Lock()
+	defer bf.mux.Unlock()
+	counts := bf.ham
+	if spam {
+		counts = bf.spam
+		bf.nspam++
+	} else {
+		bf.nham++
+	}
+	for _, token := range tokens {
+		counts[token]++
+	}
+} // end func BayesFilter.Train
+
+func (bf *BayesFilter) Score(ovl *OVL) float64 {
+	// returns the probability that ovl is spam, 0.5 if the model is empty
+	tokens := BayesTokens(ovl)
+	bf.mux.RLock()
+	defer bf.mux.RUnlock()
+	if bf.nspam == 0 || bf.nham == 0 {
+		return 0.5
+	}
+	nspam, nham := float64(bf.nspam), float64(bf.nham)
+	logspam := math.Log(nspam / (nspam + nham))
+	logham := math.Log(nham / (nspam + nham))
+	for _, token := range tokens {
+		s, h := bf.spam[token], bf.ham[token]
+		if s == 0 && h == 0 {
+			// unknown tokens say nothing
+			continue
+		}
+		// laplace smoothed share of lines containing the token
+		logspam += math.Log((float64(s) + 1) / (nspam + 2))
+		logham += math.Log((float64(h) + 1) / (nham + 2))
+	}
+	return 1 / (1 + math.Exp(logham-logspam))
+} // end func BayesFilter.Score
+
+func (bf *BayesFilter) TrainFromOverview(file string, stat func(msgid string) string) (int, int, error) {
+	// trains with every line of an overview file
+	// lines with a stat in BAYES_SPAM_STATS are spam, lines without stat (StatNone) ham
+	// lines with any other stat are skipped: nocem, cancel, crosspost... are not clean
+	fh, err := os.Open(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer fh.Close()
+	r := bufio.NewReaderSize(fh, 1024*1024)
+	var nspam, nham int
+	for lc := 0; ; lc++ {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nspam, nham, err
+		}
+		if lc > 0 && len(line) > 0 && line[0] != 0 {
+			datafields := strings.Split(strings.TrimRight(line, "\r\n"), "\t")
+			if len(datafields) >= OVERVIEW_FIELDS && isvalidmsgid(datafields[4], true) {
+				ovl := Parse_OVL(datafields)
+				switch s := stat(ovl.Messageid); {
+				case s == StatNone.String():
+					bf.Train(&ovl, false)
+					nham++
+				case strings.Contains(BAYES_SPAM_STATS, s):
+					bf.Train(&ovl, true)
+					nspam++
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	log.Printf("Bayes TrainFromOverview fp='%s' spam=%d ham=%d", filepath.Base(file), nspam, nham)
+	return nspam, nham, nil
+} // end func BayesFilter.TrainFromOverview
+
+func (bf *BayesFilter) Save(file string) error {
+	// writes the model to file.tmp and renames it to file
+	bf.mux.RLock()
+	defer bf.mux.RUnlock()
+	tmp := file + ".tmp"
+	fh, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fh)
+	fmt.Fprintf(w, "#bayes %d %d\n", bf.nspam, bf.nham)
+	for token, s := range bf.spam {
+		fmt.Fprintf(w, "%s %d %d\n", token, s, bf.ham[token])
+	}
+	for token, h := range bf.ham {
+		if bf.spam[token] == 0 {
+			fmt.Fprintf(w, "%s %d %d\n", token, 0, h)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+} // end func BayesFilter.Save
+
+func (bf *BayesFilter) Load(file string) error {
+	// replaces the model with the one saved in file
+	fh, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	spam, ham := make(map[string]uint64), make(map[string]uint64)
+	var nspam, nham uint64
+	fileScanner := bufio.NewScanner(fh)
+	lc := 0
+	for fileScanner.Scan() {
+		lc++
+		line := fileScanner.Text()
+		if lc == 1 {
+			if _, err := fmt.Sscanf(line, "#bayes %d %d", &nspam, &nham); err != nil {
+				return fmt.Errorf("Error BayesFilter.Load fp='%s' bad header err='%v'", filepath.Base(file), err)
+			}
+			continue
+		}
+		var token string
+		var s, h uint64
+		if _, err := fmt.Sscanf(line, "%s %d %d", &token, &s, &h); err != nil {
+			return fmt.Errorf("Error BayesFilter.Load fp='%s' lc=%d err='%v'", filepath.Base(file), lc, err)
+		}
+		if s > 0 {
+			spam[token] = s
+		}
+		if h > 0 {
+			ham[token] = h
+		}
+	}
+	if err := fileScanner.Err(); err != nil {
+		return err
+	}
+	if lc == 0 {
+		return fmt.Errorf("Error BayesFilter.Load fp='%s' empty", filepath.Base(file))
+	}
+	bf.mux.Lock()
+	bf.spam, bf.ham, bf.nspam, bf.nham = spam, ham, nspam, nham
+	bf.mux.Unlock()
+	return nil
+} // end func BayesFilter.Load
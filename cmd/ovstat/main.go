@@ -0,0 +1,18 @@
+package main
+
+/*
+ * ovstat prints the number of msgidhashs per stat, see overview.StatCommand
+ */
+
+import (
+	"github.com/go-while/nntp-overview"
+	"log"
+	"os"
+)
+
+func main() {
+	if err := overview.StatCommand(os.Args[1:], os.Stdout); err != nil {
+		log.Printf("ERROR ovstat err='%v'", err)
+		os.Exit(1)
+	}
+} // end func main
@@ -0,0 +1,181 @@
+package overview
+
+/*
+ * export the live lines of an overview file without header, footer, padding and tombstones
+ *
+ *   report, err := overview.ExportGroup("alt.test", "/ov", os.Stdout, overview.ExportOptions{
+ *       Format:     overview.ExportJSONL, // ExportXover, ExportJSONL or ExportCSV
+ *       FromMsgnum: 100,                  // 0 is no limit
+ *       Since:      time.Now().Add(-24 * time.Hour),
+ *   })
+ *
+ * ExportXover writes the lines like XOVER sends them, with "\r\n" but without the "." line,
+ * ImportOverview reads them back. ExportJSONL writes one ExportLine per line.
+ * ExportCSV writes a header row and the fields of ExportLine.
+ * with Since or Until lines whose Date does not parse are skipped and counted as BadDates.
+ */
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/go-while/go-utils"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	ExportXover = "xover"
+	ExportJSONL = "jsonl"
+	ExportCSV   = "csv"
+)
+
+// ExportOptions selects format and lines of an export, zero values do not filter
+type ExportOptions struct {
+	Format     string    // default ExportXover
+	FromMsgnum uint64    // first msgnum
+	ToMsgnum   uint64    // last msgnum
+	Since      time.Time // Date of the article at or after
+	Until      time.Time // Date of the article before
+}
+
+// ExportLine is an overview line with typed fields
+type ExportLine struct {
+	Msgnum     uint64   `json:"msgnum"`
+	Subject    string   `json:"subject"`
+	From       string   `json:"from"`
+	Date       string   `json:"date"`
+	Unix       int64    `json:"date_unix"` // 0 if Date does not parse
+	Messageid  string   `json:"message_id"`
+	References []string `json:"references"`
+	Bytes      int      `json:"bytes"`
+	Lines      int      `json:"lines"`
+	Xref       string   `json:"xref"`
+}
+
+// ExportReport is the result of ExportOverview
+type ExportReport struct {
+	File       string `json:"file"`
+	Exported   uint64 `json:"exported"`
+	Tombstones uint64 `json:"tombstones"`
+	Filtered   uint64 `json:"filtered"`  // outside of msgnum or date range
+	BadDates   uint64 `json:"bad_dates"` // Date did not parse with Since or Until set
+	BadLines   uint64 `json:"bad_lines"`
+}
+
+var export_csv_header = []string{"msgnum", "subject", "from", "date", "date_unix", "message_id", "references", "bytes", "lines", "xref"}
+
+func ExportGroup(group string, cachedir string, w io.Writer, opts ExportOptions) (*ExportReport, error) {
+	if !IsValidGroupName(group) {
+		return nil, fmt.Errorf("ERROR overview.ExportGroup invalid group='%s'", group)
+	}
+	return ExportOverview(cachedir+"/"+utils.Hash256(group)+".overview", w, opts)
+} // end func ExportGroup
+
+func ExportOverview(file string, w io.Writer, opts ExportOptions) (*ExportReport, error) {
+	// streams the live lines of file to w, reads without lock like Verify
+	switch opts.Format {
+	case "":
+		opts.Format = ExportXover
+	case ExportXover, ExportJSONL, ExportCSV:
+	default:
+		return nil, fmt.Errorf("ERROR overview.ExportOverview unknown format='%s'", opts.Format)
+	}
+	fh, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	if _, err := fh.Seek(int64(OV_RESERVE_BEG), io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	report := &ExportReport{File: file}
+	bw := bufio.NewWriterSize(w, 1024*1024)
+	cw := csv.NewWriter(bw)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+	if opts.Format == ExportCSV {
+		cw.Write(export_csv_header)
+	}
+	bydate := !opts.Since.IsZero() || !opts.Until.IsZero()
+	r := bufio.NewReaderSize(fh, 1024*1024)
+	for {
+		line, rerr := r.ReadString('\n')
+		if rerr != nil && rerr != io.EOF {
+			return report, rerr
+		}
+		if len(line) == 0 || line[0] == 0 {
+			// zero-filled space before the footer
+			break
+		}
+		line = strings.TrimRight(line, "\n")
+		fields := strings.Split(line, "\t")
+		msgnum := utils.Str2uint64(fields[0])
+		switch {
+		case len(fields) < OVERVIEW_FIELDS || msgnum == 0:
+			report.BadLines++
+		case len(fields[4]) == 0 || fields[4][0] != '<':
+			report.Tombstones++
+		case opts.ToMsgnum > 0 && msgnum > opts.ToMsgnum || msgnum < opts.FromMsgnum:
+			// checked per line: an unordered file can have lower msgnums later
+			report.Filtered++
+		default:
+			unix, derr := ParseDate(fields[3])
+			if bydate && derr != nil {
+				report.BadDates++
+				break
+			}
+			if bydate && (!opts.Since.IsZero() && unix < opts.Since.Unix() || !opts.Until.IsZero() && unix >= opts.Until.Unix()) {
+				report.Filtered++
+				break
+			}
+			if err := export_line(bw, cw, enc, opts.Format, fields, msgnum, unix); err != nil {
+				return report, err
+			}
+			report.Exported++
+		}
+		if rerr == io.EOF {
+			break
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return report, err
+	}
+	if err := bw.Flush(); err != nil {
+		return report, fmt.Errorf("ERROR overview.ExportOverview fp='%s' err='%v'", filepath.Base(file), err)
+	}
+	return report, nil
+} // end func ExportOverview
+
+func export_line(bw *bufio.Writer, cw *csv.Writer, enc *json.Encoder, format string, fields []string, msgnum uint64, unix int64) error {
+	if format == ExportXover {
+		bw.WriteString(strings.Join(fields, "\t"))
+		_, err := bw.WriteString(CRLF)
+		return err
+	}
+	el := ExportLine{
+		Msgnum:     msgnum,
+		Subject:    fields[1],
+		From:       fields[2],
+		Date:       fields[3],
+		Unix:       unix,
+		Messageid:  fields[4],
+		References: strings.Fields(fields[5]),
+		Bytes:      utils.Str2int(fields[6]),
+		Lines:      utils.Str2int(fields[7]),
+		Xref:       strings.Join(fields[8:], "\t"),
+	}
+	if el.References == nil {
+		el.References = []string{}
+	}
+	if format == ExportJSONL {
+		return enc.Encode(el)
+	}
+	return cw.Write([]string{fields[0], el.Subject, el.From, el.Date, fmt.Sprintf("%d", el.Unix), el.Messageid, fields[5], fields[6], fields[7], el.Xref})
+} // end func export_line
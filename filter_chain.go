@@ -0,0 +1,227 @@
+package overview
+
+import (
+	"fmt"
+	"github.com/go-while/go-utils"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ViewChain hides lines from readers in Scan_Overview, empty by default
+// operators opt in to filters, e.g. ViewChain.Add(&GoogleGroupsFilter{})
+var ViewChain = NewFilterChain()
+
+// Verdict of a Filter
+type Verdict int
+
+const (
+	VerdictAccept     Verdict = iota
+	VerdictReject             // do not store the article
+	VerdictQuarantine         // store the article in QUARANTINE_GROUP only
+	VerdictHide               // store the article but do not show it to readers
+)
+
+func (v Verdict) String() string {
+	switch v {
+	case VerdictAccept:
+		return "accept"
+	case VerdictReject:
+		return "reject"
+	case VerdictQuarantine:
+		return "quarantine"
+	case VerdictHide:
+		return "hide"
+	}
+	return fmt.Sprintf("verdict(%d)", int(v))
+}
+
+// Filter checks one article
+// headers are the parsed headers from ParseHeaderKeys and may be nil
+// if only the overview line is known. reason is logged and returned to the caller
+type Filter interface {
+	Name() string
+	Check(ovl *OVL, headers map[string][]string) (verdict Verdict, reason string)
+}
+
+// FilterMetrics counts the verdicts of one filter in a FilterChain
+type FilterMetrics struct {
+	Checked     uint64
+	Accepted    uint64
+	Rejected    uint64
+	Quarantined uint64
+	Hidden      uint64
+	Nanos       uint64 // time spent in Check
+}
+
+// FilterChain runs filters in order until one returns a verdict other than VerdictAccept
+type FilterChain struct {
+	mux     sync.RWMutex
+	filters []Filter
+	fmetric []*FilterMetrics // metrics of filters[i], filters with the same name share one
+	metrics map[string]*FilterMetrics
+}
+
+func NewFilterChain(filters ...Filter) *FilterChain {
+	fc := &FilterChain{metrics: make(map[string]*FilterMetrics)}
+	for _, f := range filters {
+		fc.Add(f)
+	}
+	return fc
+} // end func NewFilterChain
+
+func (fc *FilterChain) Add(f Filter) {
+	fc.mux.Lock()
+	defer fc.mux.Unlock()
+	if fc.metrics == nil {
+		fc.metrics = make(map[string]*FilterMetrics)
+	}
+	if fc.metrics[f.Name()] == nil {
+		fc.metrics[f.Name()] = &FilterMetrics{}
+	}
+	fc.filters = append(fc.filters, f)
+	fc.fmetric = append(fc.fmetric, fc.metrics[f.Name()])
+} // end func FilterChain.Add
+
+func (fc *FilterChain) Run(ovl *OVL, headers map[string][]string) (Verdict, string, string) {
+	// returns the first verdict that is not VerdictAccept with the filter name and reason
+	fc.mux.RLock()
+	// Add only appends, the copied slices stay valid without the lock
+	filters, fmetric := fc.filters, fc.fmetric
+	fc.mux.RUnlock()
+	for i, f := range filters {
+		start := time.Now()
+		verdict, reason := f.Check(ovl, headers)
+		if m := fmetric[i]; m != nil {
+			atomic.AddUint64(&m.Checked, 1)
+			atomic.AddUint64(&m.Nanos, uint64(time.Since(start)))
+			switch verdict {
+			case VerdictAccept:
+				atomic.AddUint64(&m.Accepted, 1)
+			case VerdictReject:
+				atomic.AddUint64(&m.Rejected, 1)
+			case VerdictQuarantine:
+				atomic.AddUint64(&m.Quarantined, 1)
+			case VerdictHide:
+				atomic.AddUint64(&m.Hidden, 1)
+			}
+		}
+		if verdict != VerdictAccept {
+			return verdict, f.Name(), reason
+		}
+	}
+	return VerdictAccept, "", ""
+} // end func FilterChain.Run
+
+func (fc *FilterChain) Metrics() map[string]FilterMetrics {
+	// returns a copy of the counters per filter name
+	fc.mux.RLock()
+	defer fc.mux.RUnlock()
+	ret := make(map[string]FilterMetrics, len(fc.metrics))
+	for name, m := range fc.metrics {
+		ret[name] = FilterMetrics{
+			Checked:     atomic.LoadUint64(&m.Checked),
+			Accepted:    atomic.LoadUint64(&m.Accepted),
+			Rejected:    atomic.LoadUint64(&m.Rejected),
+			Quarantined: atomic.LoadUint64(&m.Quarantined),
+			Hidden:      atomic.LoadUint64(&m.Hidden),
+			Nanos:       atomic.LoadUint64(&m.Nanos),
+		}
+	}
+	return ret
+} // end func FilterChain.Metrics
+
+// FlagFilter runs Filter only while *Enabled is true
+type FlagFilter struct {
+	Enabled *bool
+	Filter
+}
+
+func (f *FlagFilter) Check(ovl *OVL, headers map[string][]string) (Verdict, string) {
+	if f.Enabled == nil || !*f.Enabled {
+		return VerdictAccept, ""
+	}
+	return f.Filter.Check(ovl, headers)
+}
+
+// SpamFilter checks Subject, From and Message-ID with a SPAMFILTER
+type SpamFilter struct {
+	Spam    *SPAMFILTER
+	Verdict Verdict // returned on a hit
+}
+
+func (f *SpamFilter) Name() string { return "Spamfilter" }
+
+func (f *SpamFilter) Check(ovl *OVL, headers map[string][]string) (Verdict, string) {
+	if id := f.Spam.Hit(ovl.Subject, "subj", ovl.Messageid); id != "" {
+		return f.Verdict, id
+	}
+	if id := f.Spam.Hit(ovl.From, "from", ovl.Messageid); id != "" {
+		return f.Verdict, id
+	}
+	if id := f.Spam.Hit(ovl.Messageid, "msgid", ovl.Messageid); id != "" {
+		return f.Verdict, id
+	}
+	return VerdictAccept, ""
+}
+
+// MessageIDFilter rejects message-ids of binary posters, see FilterMessageID
+type MessageIDFilter struct {
+	Verdict Verdict // returned on a hit
+}
+
+func (f *MessageIDFilter) Name() string { return "FilterMessageID" }
+
+func (f *MessageIDFilter) Check(ovl *OVL, headers map[string][]string) (Verdict, string) {
+	if FilterMessageID(ovl.Messageid) {
+		return f.Verdict, "msgid"
+	}
+	return VerdictAccept, ""
+}
+
+// GoogleGroupsFilter hides googlegroups posts with an encoded-word subject from readers
+// the check hardcoded in Scan_Overview tested the message-id for the "=?UTF-8" prefix
+// and never matched, this tests the subject. not in ViewChain by default
+type GoogleGroupsFilter struct{}
+
+func (f *GoogleGroupsFilter) Name() string { return "GoogleGroups" }
+
+func (f *GoogleGroupsFilter) Check(ovl *OVL, headers map[string][]string) (Verdict, string) {
+	if strings.HasSuffix(ovl.Messageid, "googlegroups.com>") && strings.HasPrefix(strings.TrimLeft(ovl.Subject, " "), "=?UTF-8") {
+		return VerdictHide, "googlegroups"
+	}
+	return VerdictAccept, ""
+}
+
+// LimitBytesFilter rejects articles bigger than *Max bytes, 0 disables it
+type LimitBytesFilter struct {
+	Max *uint64
+}
+
+func (f *LimitBytesFilter) Name() string { return "LimitBytes" }
+
+func (f *LimitBytesFilter) Check(ovl *OVL, headers map[string][]string) (Verdict, string) {
+	if f.Max == nil || *f.Max == 0 || ovl.Bytes <= 0 || uint64(ovl.Bytes) <= *f.Max {
+		return VerdictAccept, ""
+	}
+	return VerdictReject, fmt.Sprintf("bytes=%d", ovl.Bytes)
+}
+
+func Parse_OVL(datafields []string) OVL {
+	// fills an OVL from the fields of a stored overview line
+	// datafields[0] is the msgnum, the line needs OVERVIEW_FIELDS fields
+	var ovl OVL
+	if len(datafields) < OVERVIEW_FIELDS {
+		return ovl
+	}
+	ovl.Subject = datafields[1]
+	ovl.From = datafields[2]
+	ovl.Date = datafields[3]
+	ovl.Messageid = datafields[4]
+	ovl.References = strings.Fields(datafields[5])
+	ovl.Bytes = utils.Str2int(datafields[6])
+	ovl.Lines = utils.Str2int(datafields[7])
+	ovl.Xref = datafields[8]
+	return ovl
+} // end func Parse_OVL
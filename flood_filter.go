@@ -0,0 +1,205 @@
+package overview
+
+/*
+ * flood detection for the ingest path
+ *
+ * FloodFilter counts posts in a sliding window per From, per right-hand side
+ * of the Message-ID and per normalized Subject, across all groups.
+ * a counter over its limit trips the filter: Check returns Verdict and,
+ * if RuleTTL is set, adds a temporary rule to Spam so the flood keeps
+ * getting caught after the window moved on. Check tests these temporary
+ * rules itself, they work without INGEST_SPAMFILTER.
+ */
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+var (
+	INGEST_FLOODFILTER bool = false // di_ov runs OV_Floodfilter
+	OV_Floodfilter          = NewFloodFilter(&OV_Spamfilter)
+)
+
+// FloodFilter is a Filter counting posts per key in a sliding window
+type FloodFilter struct {
+	mux       sync.Mutex
+	Window    time.Duration // length of the sliding window
+	Buckets   int           // window is counted in this many buckets
+	MaxFrom   int           // posts per From in Window, 0 disables
+	MaxDomain int           // posts per Message-ID domain in Window, 0 disables
+	MaxSubj   int           // posts per normalized Subject in Window, 0 disables
+	Verdict   Verdict       // returned while a counter is over its limit
+	RuleTTL   time.Duration // adds a temporary rule to Spam when tripped, 0 disables
+	Spam      *SPAMFILTER
+	counters  map[string]*flood_counter
+	lastpurge int64
+}
+
+type flood_counter struct {
+	counts []uint32
+	slots  []int64 // bucket number counted in counts[i]
+}
+
+func NewFloodFilter(spam *SPAMFILTER) *FloodFilter {
+	return &FloodFilter{
+		Window:    10 * time.Minute,
+		Buckets:   10,
+		MaxFrom:   100,
+		MaxDomain: 500, // raise it for busy gateways posting with one domain
+		MaxSubj:   50,
+		Verdict:   VerdictQuarantine,
+		RuleTTL:   6 * time.Hour,
+		Spam:      spam,
+		counters:  make(map[string]*flood_counter),
+	}
+} // end func NewFloodFilter
+
+func (ff *FloodFilter) Name() string { return "Flood" }
+
+func (ff *FloodFilter) Check(ovl *OVL, headers map[string][]string) (Verdict, string) {
+	now := time.Now().UnixNano()
+	domain := bayes_domain(ovl.Messageid)
+	subj := flood_subject(ovl.Subject)
+	type check struct {
+		key   string
+		max   int
+		field string
+		kind  string
+		input string
+	}
+	checks := []check{
+		{"from:" + strings.ToLower(ovl.From), ff.MaxFrom, "from", "match", ovl.From},
+		{"mdom:" + domain, ff.MaxDomain, "msgid", "suffix", "@" + domain + ">"},
+		// the rule matches the normalized subject like the counter, catching the variants too
+		{fmt.Sprintf("subj:%x", flood_hash(subj)), ff.MaxSubj, "subj", "normalized", subj},
+	}
+	if ff.RuleTTL > 0 && ff.Spam != nil {
+		// temporary rules added when a counter tripped before
+		for _, c := range checks {
+			input := map[string]string{"from": ovl.From, "msgid": ovl.Messageid, "subj": ovl.Subject}[c.field]
+			if id := ff.Spam.TempHit(input, c.field, ovl.Messageid); id != "" {
+				return ff.Verdict, "rule " + id
+			}
+		}
+	}
+	ff.mux.Lock()
+	ff.purge(now)
+	tripped := -1
+	var count int
+	for i, c := range checks {
+		if c.max <= 0 || c.input == "" || (c.field == "msgid" && domain == "") || (c.field == "subj" && subj == "") {
+			continue
+		}
+		n := ff.add(c.key, now)
+		if n > c.max && tripped < 0 {
+			tripped, count = i, n
+		}
+	}
+	ff.mux.Unlock()
+	if tripped < 0 {
+		return VerdictAccept, ""
+	}
+	c := checks[tripped]
+	reason := fmt.Sprintf("flood %s=%d/%v", c.field, count, ff.Window)
+	if ff.RuleTTL > 0 && ff.Spam != nil {
+		id := fmt.Sprintf("flood.%s.%x", c.field, flood_hash(c.key))
+		if rule, err := NewSpamRule(id, c.field, c.kind, c.input); err == nil {
+			ff.Spam.AddTempRule(rule, ff.RuleTTL)
+		}
+	}
+	return ff.Verdict, reason
+}
+
+func (ff *FloodFilter) add(key string, now int64) int {
+	// counts one post for key and returns the posts in the window
+	// caller holds ff.mux
+	buckets := ff.Buckets
+	if buckets <= 0 {
+		buckets = 1
+	}
+	slot := now / ff.bucket_len(buckets)
+	fc := ff.counters[key]
+	if fc == nil {
+		fc = &flood_counter{counts: make([]uint32, buckets), slots: make([]int64, buckets)}
+		ff.counters[key] = fc
+	}
+	i := int(slot % int64(buckets))
+	if fc.slots[i] != slot {
+		fc.slots[i], fc.counts[i] = slot, 0
+	}
+	fc.counts[i]++
+	total := 0
+	for j := range fc.counts {
+		if fc.slots[j] > slot-int64(buckets) {
+			total += int(fc.counts[j])
+		}
+	}
+	return total
+} // end func FloodFilter.add
+
+func (ff *FloodFilter) bucket_len(buckets int) int64 {
+	bl := int64(ff.Window) / int64(buckets)
+	if bl <= 0 {
+		bl = int64(time.Second)
+	}
+	return bl
+} // end func FloodFilter.bucket_len
+
+func (ff *FloodFilter) purge(now int64) {
+	// removes counters without posts in the window, once per window
+	// caller holds ff.mux
+	if now-ff.lastpurge < int64(ff.Window) {
+		return
+	}
+	ff.lastpurge = now
+	buckets := ff.Buckets
+	if buckets <= 0 {
+		buckets = 1
+	}
+	slot := now / ff.bucket_len(buckets)
+	for key, fc := range ff.counters {
+		stale := true
+		for j := range fc.slots {
+			if fc.slots[j] > slot-int64(buckets) {
+				stale = false
+				break
+			}
+		}
+		if stale {
+			delete(ff.counters, key)
+		}
+	}
+} // end func FloodFilter.purge
+
+func (ff *FloodFilter) Len() int {
+	// returns the number of tracked keys
+	ff.mux.Lock()
+	defer ff.mux.Unlock()
+	return len(ff.counters)
+} // end func FloodFilter.Len
+
+func flood_subject(subj string) string {
+	// normalizes a subject so near-identical posts count together:
+	// lowercase, drops "re:" prefixes, digits, punctuation and spaces
+	subj = strings.ToLower(strings.TrimSpace(subj))
+	for strings.HasPrefix(subj, "re:") {
+		subj = strings.TrimSpace(subj[3:])
+	}
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) {
+			return r
+		}
+		return -1
+	}, subj)
+} // end func flood_subject
+
+func flood_hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+} // end func flood_hash
@@ -0,0 +1,343 @@
+package overview
+
+/*
+ * spool wide fsck of all overview files
+ *
+ *   report, err := overview.Fsck(ctx, overview.FsckOptions{
+ *       Dir:      "/ov",
+ *       Workers:  4,
+ *       IOBudget: 64 * 1024 * 1024, // bytes per second of all workers
+ *       Groups:   groups,           // from the active file, nil skips the registry checks
+ *   })
+ *   report.WriteJSON(os.Stdout)
+ *
+ * every file is checked with Verify and its .Index against the lines.
+ * with Groups every file needs a group and every group a file.
+ * problems of all files are collected in one report, report.Problems counts them.
+ * a file written during its check gets only the problem "modified", check it again later
+ * or set LockGroups. an unreadable directory is a problem, the walk continues.
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-while/go-utils"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FsckOptions configures Fsck, zero values use the defaults
+type FsckOptions struct {
+	Dir      string        // overview spool
+	Workers  int           // files checked in parallel, default 4
+	IOBudget int64         // bytes per second read by all workers, 0 is unlimited
+	Groups   []string      // registered groups, nil skips the registry checks
+	Verify   VerifyOptions // default all checks
+	NoIndex  bool          // skip the .Index checks
+	// holds the group lock while a file is checked, writers of the group wait
+	LockGroups bool
+}
+
+// FsckProblem is one problem found by Fsck
+type FsckProblem struct {
+	File   string `json:"file,omitempty"`
+	Group  string `json:"group,omitempty"`
+	Kind   string `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+	Offset int64  `json:"offset,omitempty"`
+}
+
+// FsckFile is the result of one file
+type FsckFile struct {
+	File     string         `json:"file"`
+	Group    string         `json:"group,omitempty"`
+	Lines    uint64         `json:"lines"`
+	Last     uint64         `json:"last_msgnum"`
+	Problems []FsckProblem  `json:"problems,omitempty"`
+	Suggest  []RepairAction `json:"suggest,omitempty"`
+}
+
+// FsckReport is the result of Fsck
+type FsckReport struct {
+	Dir      string        `json:"dir"`
+	Started  time.Time     `json:"started"`
+	Finished time.Time     `json:"finished"`
+	Files    int           `json:"files"`
+	Problems int           `json:"problems"`
+	Results  []FsckFile    `json:"results"` // files with problems
+	Registry []FsckProblem `json:"registry,omitempty"`
+	Canceled bool          `json:"canceled,omitempty"`
+}
+
+func (r *FsckReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", " ")
+	return enc.Encode(r)
+} // end func FsckReport.WriteJSON
+
+type fsck_budget struct {
+	mux  sync.Mutex
+	rate int64 // bytes per second
+	next time.Time
+}
+
+func (b *fsck_budget) wait(ctx context.Context, n int64) error {
+	// reserves n bytes, sleeps until the budget allows reading them
+	if b == nil || b.rate <= 0 || n <= 0 {
+		return nil
+	}
+	b.mux.Lock()
+	now := time.Now()
+	if b.next.Before(now) {
+		b.next = now
+	}
+	at := b.next
+	b.next = b.next.Add(time.Duration(float64(n) / float64(b.rate) * float64(time.Second)))
+	b.mux.Unlock()
+	select {
+	case <-time.After(time.Until(at)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+} // end func fsck_budget.wait
+
+func Fsck(ctx context.Context, opts FsckOptions) (*FsckReport, error) {
+	// checks all overview files below opts.Dir
+	if opts.Dir == "" {
+		return nil, fmt.Errorf("ERROR overview.Fsck Dir empty")
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = 4
+	}
+	if opts.Verify == (VerifyOptions{}) {
+		opts.Verify = VerifyOptions{Header: true, Footer: true, Lines: true, Fields: true}
+	}
+	report := &FsckReport{Dir: opts.Dir, Started: time.Now()}
+
+	registry := make(map[string]string, len(opts.Groups)) // key: hash, value: group
+	for _, group := range opts.Groups {
+		registry[utils.Hash256(group)] = group
+	}
+	var checks []CHECK_GROUPS
+	err := filepath.WalkDir(opts.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == opts.Dir {
+				return err
+			}
+			// the rest of a directory that can not be read is skipped
+			report.Registry = append(report.Registry, FsckProblem{File: path, Kind: "unreadable", Detail: err.Error()})
+			return nil
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".overview") {
+			return nil
+		}
+		hash, err := get_hash_from_filename(path)
+		if err != nil {
+			report.Registry = append(report.Registry, FsckProblem{File: path, Kind: "bad-filename", Detail: err.Error()})
+			return nil
+		}
+		checks = append(checks, CHECK_GROUPS{group: registry[hash], hash: hash, file_path: path})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	report.Files = len(checks)
+
+	if opts.Groups != nil {
+		seen := make(map[string]bool, len(checks))
+		for _, check := range checks {
+			seen[check.hash] = true
+			if check.group == "" {
+				report.Registry = append(report.Registry, FsckProblem{File: check.file_path, Kind: "unregistered-file"})
+			}
+		}
+		for hash, group := range registry {
+			if !seen[hash] {
+				report.Registry = append(report.Registry, FsckProblem{Group: group, Kind: "missing-file"})
+			}
+		}
+	}
+
+	budget := &fsck_budget{rate: opts.IOBudget}
+	jobs := make(chan CHECK_GROUPS)
+	results := make(chan FsckFile, opts.Workers)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for check := range jobs {
+				results <- fsck_file(ctx, check, opts, budget)
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for _, check := range checks {
+			select {
+			case jobs <- check:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	for result := range results {
+		if len(result.Problems) > 0 {
+			report.Results = append(report.Results, result)
+			report.Problems += len(result.Problems)
+		}
+	}
+	report.Problems += len(report.Registry)
+	report.Canceled = ctx.Err() != nil
+	sort.Slice(report.Results, func(i, j int) bool { return report.Results[i].File < report.Results[j].File })
+	sort.Slice(report.Registry, func(i, j int) bool {
+		return report.Registry[i].File+report.Registry[i].Group < report.Registry[j].File+report.Registry[j].Group
+	})
+	report.Finished = time.Now()
+	return report, nil
+} // end func Fsck
+
+func fsck_file(ctx context.Context, check CHECK_GROUPS, opts FsckOptions, budget *fsck_budget) (result FsckFile) {
+	result = FsckFile{File: check.file_path, Group: check.group}
+	problem := func(kind string, detail string, offset int64) {
+		result.Problems = append(result.Problems, FsckProblem{File: check.file_path, Group: result.Group, Kind: kind, Detail: detail, Offset: offset})
+	}
+	if fi, err := os.Stat(check.file_path); err == nil {
+		if err := budget.wait(ctx, fi.Size()); err != nil {
+			problem("canceled", err.Error(), 0)
+			return result
+		}
+	}
+	if opts.LockGroups {
+		who := "Fsck"
+		if err := OV_handler.LockGroup(who, check.hash); err != nil {
+			problem("lock", err.Error(), 0)
+			return result
+		}
+		defer OV_handler.UnlockGroup(who, check.hash)
+	}
+	vopts := opts.Verify
+	vopts.Group = check.group
+	vr, err := Verify(check.file_path, vopts)
+	if err != nil {
+		problem("unreadable", err.Error(), 0)
+		return result
+	}
+	defer func() {
+		// problems of a file written during the check may be none
+		if fi, err := os.Stat(check.file_path); err == nil && (fi.Size() != vr.Size || fi.ModTime().UnixNano() != vr.mtime) {
+			result.Problems, result.Suggest = nil, nil
+			problem("modified", "written during the check, check again", 0)
+		}
+	}()
+	if result.Group == "" {
+		result.Group = vr.Group
+	}
+	result.Lines, result.Last, result.Suggest = vr.Lines, vr.LastMsgnum, vr.Suggest
+	if vr.Header == CheckBad {
+		problem("header", vr.HeaderErr, 0)
+	}
+	if vr.Footer == CheckBad {
+		problem("footer", vr.FooterErr, vr.Size-int64(OV_RESERVE_END))
+	}
+	if vr.Garbage > 0 {
+		problem("garbage", fmt.Sprintf("%d bytes", vr.Garbage), vr.DataEnd)
+	}
+	for _, gap := range vr.Gaps {
+		problem("gap", fmt.Sprintf("msgnums %d-%d missing", gap.From, gap.To), 0)
+	}
+	for _, issue := range vr.Order {
+		problem("order", fmt.Sprintf("msgnum=%d %s", issue.Msgnum, issue.Reason), issue.Offset)
+	}
+	for _, issue := range vr.Duplicates {
+		problem("duplicate", fmt.Sprintf("msgid='%s' first=%d", issue.Msgid, issue.First), issue.Offset)
+	}
+	for _, issue := range vr.BadLines {
+		problem("bad-line", fmt.Sprintf("msgnum=%d field=%s %s", issue.Msgnum, issue.Field, issue.Reason), issue.Offset)
+	}
+	if vr.Truncated {
+		problem("truncated", fmt.Sprintf("more than %d issues of a kind", vopts.MaxIssues), 0)
+	}
+	if !opts.NoIndex && vr.Header != CheckBad && vopts.Lines {
+		for _, p := range fsck_index(check.file_path, vr) {
+			problem(p.Kind, p.Detail, p.Offset)
+		}
+	}
+	return result
+} // end func fsck_file
+
+func fsck_index(file string, vr *VerifyReport) []FsckProblem {
+	// checks every line of file.Index points to its msgnums
+	var problems []FsckProblem
+	add := func(kind string, detail string, offset int64) {
+		problems = append(problems, FsckProblem{Kind: kind, Detail: detail, Offset: offset})
+	}
+	data, err := os.ReadFile(file + ".Index")
+	if err != nil {
+		if os.IsNotExist(err) {
+			if vr.Lines > 0 {
+				add("index-missing", "", 0)
+			}
+			return problems
+		}
+		add("index-unreadable", err.Error(), 0)
+		return problems
+	}
+	fh, err := os.Open(file)
+	if err != nil {
+		add("index-unreadable", err.Error(), 0)
+		return problems
+	}
+	defer fh.Close()
+	starts := func(offset int64, msgnum uint64) bool {
+		// true if the line at offset has msgnum
+		want := fmt.Sprintf("%d\t", msgnum)
+		buf := make([]byte, len(want))
+		if offset < int64(OV_RESERVE_BEG) || offset >= vr.DataEnd {
+			return false
+		}
+		if _, err := fh.ReadAt(buf, offset); err != nil {
+			return false
+		}
+		return string(buf) == want
+	}
+	var prev uint64
+	for lc, line := range strings.Split(strings.TrimRight(string(data), LF), LF) {
+		x := strings.Split(line, "|")
+		if len(x) != 6 {
+			add("index-line", fmt.Sprintf("line %d='%s'", lc+1, line), 0)
+			continue
+		}
+		a, b := utils.Str2uint64(x[1]), utils.Str2uint64(x[2])
+		y, z := utils.Str2int64(x[3]), utils.Str2int64(x[4])
+		switch {
+		case a == 0 || b < a:
+			add("index-line", fmt.Sprintf("line %d a=%d b=%d", lc+1, a, b), 0)
+		case a <= prev:
+			add("index-order", fmt.Sprintf("line %d a=%d after b=%d", lc+1, a, prev), 0)
+		case b > vr.LastMsgnum:
+			add("index-beyond", fmt.Sprintf("line %d b=%d > last msgnum=%d", lc+1, b, vr.LastMsgnum), z)
+		case !starts(y, a):
+			add("index-offset", fmt.Sprintf("line %d msgnum=%d", lc+1, a), y)
+		case !starts(z, b):
+			add("index-offset", fmt.Sprintf("line %d msgnum=%d", lc+1, b), z)
+		}
+		if b > prev {
+			prev = b
+		}
+	}
+	return problems
+} // end func fsck_index
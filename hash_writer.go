@@ -0,0 +1,271 @@
+package overview
+
+/*
+ * batching writer for msgidhashs into a MsgidHashStore
+ *
+ *   hw := overview.NewHashWriter(ctx, overview.NewMySQLStore(db), overview.HashWriterConfig{})
+ *   go overview.Rescan_Overview(who, file, group, 1000, false, nil, &hw.In)
+ *   ...
+ *   if err := hw.Close(); err != nil { ... }
+ *
+ * RescanHashStore does both for one file.
+ *
+ * items are deduped and batched per table. a batch is written when it has
+ * MaxBatch items or its oldest item waited MaxLatency, at most Parallel
+ * batches at once. lock wait timeouts and deadlocks are retried with
+ * exponential backoff and jitter, other errors go to Errors() and Close.
+ * cancelling ctx stops the writer, pending items are not written.
+ */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HashWriterConfig configures a HashWriter, zero values use the defaults
+type HashWriterConfig struct {
+	MaxBatch    int           // items per INSERT, default Flushmax
+	MaxLatency  time.Duration // max wait of an item before its batch is written, default 5s
+	Parallel    int           // concurrent INSERTs, default Psql
+	MaxRetries  int           // retries of a batch on retryable errors, default 10
+	BackoffBase time.Duration // first retry delay, default 100ms
+	BackoffMax  time.Duration // max retry delay, default 30s
+}
+
+// HashWriter writes msgidhashs in batches
+type HashWriter struct {
+	In      chan map[string][]Msgidhash_item // key: table key, see Rescan_Overview mode 1000
+	cfg     HashWriterConfig
+	store   MsgidHashStore
+	ctx     context.Context
+	sem     chan struct{}
+	errs    chan error
+	wg      sync.WaitGroup
+	done    chan struct{}
+	mux     sync.Mutex
+	err     error // first error
+	flushed uint64
+	dupes   uint64
+}
+
+type hash_batch struct {
+	items map[string]Msgidhash_item // key: msgidhash
+	first time.Time
+}
+
+func NewHashWriter(ctx context.Context, store MsgidHashStore, cfg HashWriterConfig) *HashWriter {
+	if cfg.MaxBatch <= 0 {
+		cfg.MaxBatch = Flushmax
+	}
+	if cfg.MaxLatency <= 0 {
+		cfg.MaxLatency = 5 * time.Second
+	}
+	if cfg.Parallel <= 0 {
+		cfg.Parallel = Psql
+	}
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = 10
+	}
+	if cfg.BackoffBase <= 0 {
+		cfg.BackoffBase = 100 * time.Millisecond
+	}
+	if cfg.BackoffMax <= 0 {
+		cfg.BackoffMax = 30 * time.Second
+	}
+	hw := &HashWriter{
+		In:    make(chan map[string][]Msgidhash_item, cfg.Parallel),
+		cfg:   cfg,
+		store: store,
+		ctx:   ctx,
+		sem:   make(chan struct{}, cfg.Parallel),
+		errs:  make(chan error, 16),
+		done:  make(chan struct{}),
+	}
+	go hw.run()
+	return hw
+} // end func NewHashWriter
+
+func (hw *HashWriter) Add(hashmap map[string][]Msgidhash_item) error {
+	// sends hashmap to the writer, returns the ctx error if cancelled
+	select {
+	case hw.In <- hashmap:
+		return nil
+	case <-hw.ctx.Done():
+		return hw.ctx.Err()
+	}
+} // end func HashWriter.Add
+
+func (hw *HashWriter) Errors() <-chan error {
+	// returns write errors as they happen, errors are dropped while nobody reads
+	return hw.errs
+} // end func HashWriter.Errors
+
+func (hw *HashWriter) Close() error {
+	// closes In, writes pending batches and returns the first error
+	close(hw.In)
+	<-hw.done
+	hw.mux.Lock()
+	defer hw.mux.Unlock()
+	return hw.err
+} // end func HashWriter.Close
+
+func (hw *HashWriter) Stats() (flushed uint64, dupes uint64) {
+	return atomic.LoadUint64(&hw.flushed), atomic.LoadUint64(&hw.dupes)
+} // end func HashWriter.Stats
+
+func (hw *HashWriter) fail(err error) {
+	hw.mux.Lock()
+	if hw.err == nil {
+		hw.err = err
+	}
+	hw.mux.Unlock()
+	select {
+	case hw.errs <- err:
+	default:
+	}
+} // end func HashWriter.fail
+
+func (hw *HashWriter) run() {
+	defer close(hw.done)
+	batches := make(map[string]*hash_batch)
+	tick := hw.cfg.MaxLatency / 4
+	if tick < 10*time.Millisecond {
+		tick = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	start := time.Now()
+	for {
+		select {
+		case <-hw.ctx.Done():
+			hw.wg.Wait()
+			hw.fail(hw.ctx.Err())
+			return
+		case hashmap, ok := <-hw.In:
+			if !ok {
+				for key, batch := range batches {
+					hw.flush(key, batch)
+				}
+				hw.wg.Wait()
+				flushed, dupes := hw.Stats()
+				log.Printf("HashWriter closed flushed=%d dupes=%d rt=(%d s)", flushed, dupes, int64(time.Since(start).Seconds()))
+				return
+			}
+			for key, items := range hashmap {
+				batch := batches[key]
+				if batch == nil {
+					batch = &hash_batch{items: make(map[string]Msgidhash_item, len(items)), first: time.Now()}
+					batches[key] = batch
+				}
+				for _, item := range items {
+					if _, exists := batch.items[item.Hash]; exists {
+						atomic.AddUint64(&hw.dupes, 1)
+						continue
+					}
+					batch.items[item.Hash] = item
+					if len(batch.items) >= hw.cfg.MaxBatch {
+						hw.flush(key, batch)
+						batch = &hash_batch{items: make(map[string]Msgidhash_item, hw.cfg.MaxBatch), first: time.Now()}
+						batches[key] = batch
+					}
+				}
+				if len(batch.items) == 0 {
+					delete(batches, key)
+				}
+			}
+		case now := <-ticker.C:
+			for key, batch := range batches {
+				if now.Sub(batch.first) >= hw.cfg.MaxLatency {
+					hw.flush(key, batch)
+					delete(batches, key)
+				}
+			}
+		} // end select
+	} // end for
+} // end func HashWriter.run
+
+func (hw *HashWriter) flush(key string, batch *hash_batch) {
+	// writes batch in the background, blocks while Parallel batches are running
+	list := make([]Msgidhash_item, 0, len(batch.items))
+	for _, item := range batch.items {
+		list = append(list, item)
+	}
+	select {
+	case hw.sem <- struct{}{}:
+	case <-hw.ctx.Done():
+		return
+	}
+	hw.wg.Add(1)
+	go func() {
+		defer hw.wg.Done()
+		defer func() { <-hw.sem }()
+		insert := func() error { return hw.store.InsertMany(list) }
+		if err := insert_retry(hw.ctx, key, insert, hw.cfg); err != nil {
+			log.Printf("ERROR HashWriter key=%s list=%d err='%v'", key, len(list), err)
+			hw.fail(err)
+			return
+		}
+		atomic.AddUint64(&hw.flushed, uint64(len(list)))
+	}()
+} // end func HashWriter.flush
+
+func sql_retryable(err error) bool {
+	// lock wait timeout and deadlock can succeed on retry
+	var driverErr *mysql.MySQLError
+	if errors.As(err, &driverErr) {
+		switch driverErr.Number {
+		case 1205: // Lock wait timeout exceeded
+			return true
+		case 1213: // Deadlock found when trying to get lock
+			return true
+		}
+	}
+	return false
+} // end func sql_retryable
+
+func sql_backoff(attempt int, base time.Duration, max time.Duration) time.Duration {
+	// exponential backoff with jitter: a random delay in [d/2, d]
+	d := base << uint(attempt)
+	if d > max || d <= 0 {
+		d = max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+} // end func sql_backoff
+
+func insert_retry(ctx context.Context, key string, insert func() error, cfg HashWriterConfig) error {
+	for attempt := 0; ; attempt++ {
+		err := insert()
+		if err == nil {
+			return nil
+		}
+		if !sql_retryable(err) || attempt >= cfg.MaxRetries {
+			return fmt.Errorf("insert key=%s attempt=%d err='%v'", key, attempt+1, err)
+		}
+		select {
+		case <-time.After(sql_backoff(attempt, cfg.BackoffBase, cfg.BackoffMax)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+} // end func insert_retry
+
+func RescanHashStore(who string, file_path string, group string, store MsgidHashStore, cfg HashWriterConfig) (uint64, error) {
+	// inserts the msgidhashs of file_path into store like Rescan_Overview mode 1000
+	// returns the last msgnum and the first write error
+	hw := NewHashWriter(context.Background(), store, cfg)
+	retbool, last := Rescan_Overview(who, file_path, group, 1000, false, nil, &hw.In)
+	if err := hw.Close(); err != nil {
+		return last, err
+	}
+	if !retbool {
+		return last, fmt.Errorf("ERROR overview.RescanHashStore Rescan_Overview failed group='%s'", group)
+	}
+	return last, nil
+} // end func RescanHashStore
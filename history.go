@@ -0,0 +1,495 @@
+package overview
+
+/*
+ * history of accepted and rejected message-ids for the transit side
+ *
+ * dir/history.log   one line per msgidhash, append only:
+ *                     msgidhash <TAB> arrival <TAB> expires <TAB> token
+ *                   arrival and expires are unix seconds, expires 0 means
+ *                   the article expires by other means. an empty token
+ *                   remembers a rejected or removed article.
+ * dir/history.index open addressing hash table over the log:
+ *                     header: "OVHIST1\n" slots(uint64) logsize(uint64)
+ *                     slots:  key(uint64) offset+1(uint64), 0 is empty
+ *                   logsize says up to where the log is indexed,
+ *                   lines after it get indexed again on OpenHistory.
+ *
+ * usage on IHAVE/CHECK:
+ *   h, err := overview.OpenHistory("/ov/history", &overview.Known_msgids)
+ *   if !h.Wanted(msgidhash) { return "435 Duplicate" }
+ *   // after the article is stored:
+ *   h.Add(overview.HistoryEntry{Msgidhash: msgidhash, Arrival: now, Token: token})
+ *   // or if the transfer failed: overview.Known_msgids.UnsetKnown(msgidhash)
+ *
+ * Expire drops entries older than HISTORY_REMEMBER unless their article is not
+ * expired yet. articles older than HISTORY_REMEMBER have to be refused with TooOld,
+ * history can't tell if we had them.
+ */
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	HISTORY_REMEMBER  time.Duration = 11 * 24 * time.Hour // keep entries this long after arrival
+	HISTORY_MIN_SLOTS uint64        = 1 << 16             // initial index size
+	HISTORY_MAX_LINE  int           = 1024
+)
+
+const (
+	history_magic     = "OVHIST1\n"
+	history_headerlen = 24
+	history_slotlen   = 16
+)
+
+// HistoryEntry is one line of the history log
+type HistoryEntry struct {
+	Msgidhash string
+	Arrival   int64  // unix seconds
+	Expires   int64  // unix seconds, 0 if unknown
+	Token     string // storage token, empty if not stored
+}
+
+// History is an embedded on-disk store of msgidhashs
+type History struct {
+	mux     sync.RWMutex
+	dir     string
+	logfh   *os.File
+	idxfh   *os.File
+	logsize int64
+	slots   uint64
+	count   uint64
+	Known   *Known_MessageIDs // front cache for Wanted, may be nil
+}
+
+func OpenHistory(dir string, known *Known_MessageIDs) (*History, error) {
+	// opens or creates the history in dir and indexes lines missing in the index
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	h := &History{dir: dir, Known: known}
+	logfh, err := os.OpenFile(filepath.Join(dir, "history.log"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	h.logfh = logfh
+	if h.logsize, err = history_truncate_partial(logfh); err != nil {
+		logfh.Close()
+		return nil, err
+	}
+	if err := h.open_index(); err != nil {
+		log.Printf("OV History open_index dir='%s' err='%v', rebuilding", dir, err)
+		if err := h.rebuild(); err != nil {
+			logfh.Close()
+			return nil, err
+		}
+	}
+	log.Printf("OV History open dir='%s' entries=%d slots=%d logsize=%d", dir, h.count, h.slots, h.logsize)
+	return h, nil
+} // end func OpenHistory
+
+func history_truncate_partial(fh *os.File) (int64, error) {
+	// cuts a line without newline left by a crash, returns the log size
+	size, err := fh.Seek(0, io.SeekEnd)
+	if err != nil || size == 0 {
+		return size, err
+	}
+	buf := make([]byte, 1)
+	end := size
+	for end > 0 {
+		if _, err := fh.ReadAt(buf, end-1); err != nil {
+			return 0, err
+		}
+		if buf[0] == '\n' {
+			break
+		}
+		end--
+	}
+	if end != size {
+		log.Printf("OV History truncate partial line fp='%s' size=%d end=%d", filepath.Base(fh.Name()), size, end)
+		if err := fh.Truncate(end); err != nil {
+			return 0, err
+		}
+	}
+	return end, nil
+} // end func history_truncate_partial
+
+func (h *History) open_index() error {
+	// opens the index and indexes log lines after the indexed logsize
+	idxfh, err := os.OpenFile(filepath.Join(h.dir, "history.index"), os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, history_headerlen)
+	if _, err := idxfh.ReadAt(header, 0); err != nil {
+		idxfh.Close()
+		return err
+	}
+	slots := binary.LittleEndian.Uint64(header[8:16])
+	indexed := int64(binary.LittleEndian.Uint64(header[16:24]))
+	if string(header[:8]) != history_magic || slots == 0 || slots&(slots-1) != 0 || indexed > h.logsize {
+		idxfh.Close()
+		return fmt.Errorf("bad index header slots=%d indexed=%d logsize=%d", slots, indexed, h.logsize)
+	}
+	if fi, err := idxfh.Stat(); err != nil || fi.Size() != history_headerlen+int64(slots)*history_slotlen {
+		idxfh.Close()
+		return fmt.Errorf("bad index size")
+	}
+	h.idxfh, h.slots = idxfh, slots
+	// count is needed to grow the index in time
+	h.count = 0
+	buf := make([]byte, history_slotlen*4096)
+	for pos := int64(history_headerlen); pos < history_headerlen+int64(slots)*history_slotlen; pos += int64(len(buf)) {
+		n, err := idxfh.ReadAt(buf, pos)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		for i := 0; i+history_slotlen <= n; i += history_slotlen {
+			if binary.LittleEndian.Uint64(buf[i+8:i+16]) != 0 {
+				h.count++
+			}
+		}
+	}
+	if indexed < h.logsize {
+		log.Printf("OV History indexing log tail from=%d to=%d", indexed, h.logsize)
+		if err := h.index_log(indexed); err != nil {
+			return err
+		}
+	}
+	return nil
+} // end func History.open_index
+
+func (h *History) rebuild() error {
+	// writes a new index for the whole log
+	if h.idxfh != nil {
+		h.idxfh.Close()
+		h.idxfh = nil
+	}
+	lines, err := history_count_lines(h.logfh, h.logsize)
+	if err != nil {
+		return err
+	}
+	slots := HISTORY_MIN_SLOTS
+	for slots < 2*lines+2 {
+		slots *= 2
+	}
+	idxfile := filepath.Join(h.dir, "history.index")
+	idxfh, err := os.OpenFile(idxfile+".new", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err := idxfh.Truncate(history_headerlen + int64(slots)*history_slotlen); err != nil {
+		idxfh.Close()
+		return err
+	}
+	h.idxfh, h.slots, h.count = idxfh, slots, 0
+	if err := h.index_log(0); err != nil {
+		return err
+	}
+	if err := h.write_header(); err != nil {
+		return err
+	}
+	if err := h.idxfh.Sync(); err != nil {
+		return err
+	}
+	return os.Rename(idxfile+".new", idxfile)
+} // end func History.rebuild
+
+func history_count_lines(fh *os.File, size int64) (uint64, error) {
+	var lines uint64
+	buf := make([]byte, 1024*1024)
+	for pos := int64(0); pos < size; {
+		n, err := fh.ReadAt(buf, pos)
+		if n > int(size-pos) {
+			n = int(size - pos)
+		}
+		for _, c := range buf[:n] {
+			if c == '\n' {
+				lines++
+			}
+		}
+		pos += int64(n)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	return lines, nil
+} // end func history_count_lines
+
+func (h *History) index_log(from int64) error {
+	// inserts all log lines from offset into the index
+	r := bufio.NewReaderSize(io.NewSectionReader(h.logfh, from, h.logsize-from), 1024*1024)
+	offset := from
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		entry, perr := history_parse(line)
+		if perr != nil {
+			log.Printf("Error OV History index_log offset=%d err='%v'", offset, perr)
+		} else if _, found, err := h.find(entry.Msgidhash); err != nil {
+			return err
+		} else if !found {
+			if err := h.insert(entry.Msgidhash, offset); err != nil {
+				return err
+			}
+		}
+		offset += int64(len(line))
+	}
+} // end func History.index_log
+
+func (h *History) write_header() error {
+	header := make([]byte, history_headerlen)
+	copy(header, history_magic)
+	binary.LittleEndian.PutUint64(header[8:16], h.slots)
+	binary.LittleEndian.PutUint64(header[16:24], uint64(h.logsize))
+	_, err := h.idxfh.WriteAt(header, 0)
+	return err
+} // end func History.write_header
+
+func history_key(msgidhash string) uint64 {
+	key := flood_hash(msgidhash)
+	if key == 0 {
+		key = 1
+	}
+	return key
+} // end func history_key
+
+func (h *History) find(msgidhash string) (*HistoryEntry, bool, error) {
+	// looks up msgidhash, caller holds h.mux
+	key := history_key(msgidhash)
+	mask := h.slots - 1
+	slot := make([]byte, history_slotlen)
+	for i := key & mask; ; i = (i + 1) & mask {
+		if _, err := h.idxfh.ReadAt(slot, history_headerlen+int64(i)*history_slotlen); err != nil {
+			return nil, false, err
+		}
+		offset := binary.LittleEndian.Uint64(slot[8:16])
+		if offset == 0 {
+			return nil, false, nil
+		}
+		if binary.LittleEndian.Uint64(slot[0:8]) != key {
+			continue
+		}
+		entry, err := h.read_entry(int64(offset - 1))
+		if err != nil {
+			return nil, false, err
+		}
+		if entry.Msgidhash == msgidhash {
+			return entry, true, nil
+		}
+	}
+} // end func History.find
+
+func (h *History) insert(msgidhash string, offset int64) error {
+	// adds msgidhash at log offset to the index, caller holds h.mux
+	if 2*(h.count+1) > h.slots {
+		// the line is in the log already, rebuild indexes it
+		return h.rebuild()
+	}
+	key := history_key(msgidhash)
+	mask := h.slots - 1
+	slot := make([]byte, history_slotlen)
+	for i := key & mask; ; i = (i + 1) & mask {
+		pos := history_headerlen + int64(i)*history_slotlen
+		if _, err := h.idxfh.ReadAt(slot, pos); err != nil {
+			return err
+		}
+		if binary.LittleEndian.Uint64(slot[8:16]) != 0 {
+			continue
+		}
+		binary.LittleEndian.PutUint64(slot[0:8], key)
+		binary.LittleEndian.PutUint64(slot[8:16], uint64(offset)+1)
+		if _, err := h.idxfh.WriteAt(slot, pos); err != nil {
+			return err
+		}
+		h.count++
+		return nil
+	}
+} // end func History.insert
+
+func (h *History) read_entry(offset int64) (*HistoryEntry, error) {
+	buf := make([]byte, HISTORY_MAX_LINE)
+	n, err := h.logfh.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	end := strings.IndexByte(string(buf[:n]), '\n')
+	if end < 0 {
+		return nil, fmt.Errorf("Error History read_entry offset=%d no newline", offset)
+	}
+	return history_parse(string(buf[:end+1]))
+} // end func History.read_entry
+
+func history_parse(line string) (*HistoryEntry, error) {
+	x := strings.Split(strings.TrimRight(line, "\n"), "\t")
+	if len(x) != 4 || x[0] == "" {
+		return nil, fmt.Errorf("Error history_parse fields=%d", len(x))
+	}
+	arrival, err1 := strconv.ParseInt(x[1], 10, 64)
+	expires, err2 := strconv.ParseInt(x[2], 10, 64)
+	if err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("Error history_parse bad times msgidhash='%s'", x[0])
+	}
+	return &HistoryEntry{Msgidhash: x[0], Arrival: arrival, Expires: expires, Token: x[3]}, nil
+} // end func history_parse
+
+func (h *History) Lookup(msgidhash string) (*HistoryEntry, bool) {
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+	entry, found, err := h.find(msgidhash)
+	if err != nil {
+		log.Printf("Error OV History Lookup msgidhash='%s' err='%v'", msgidhash, err)
+		return nil, false
+	}
+	return entry, found
+} // end func History.Lookup
+
+func (h *History) Wanted(msgidhash string) bool {
+	// returns true if we want the article: not in history and not offered by another peer right now
+	// on true the msgidhash is set in Known until the caller adds it or UnsetKnown
+	if h.Known != nil && !h.Known.CheckAndSet(msgidhash) {
+		return false
+	}
+	if _, found := h.Lookup(msgidhash); found {
+		return false
+	}
+	return true
+} // end func History.Wanted
+
+func (h *History) Add(entry HistoryEntry) (bool, error) {
+	// appends entry to the log, returns false if msgidhash exists
+	if entry.Msgidhash == "" || strings.ContainsAny(entry.Msgidhash+entry.Token, "\t\n") {
+		return false, fmt.Errorf("Error History Add invalid msgidhash='%s' token='%s'", entry.Msgidhash, entry.Token)
+	}
+	if entry.Arrival == 0 {
+		entry.Arrival = time.Now().Unix()
+	}
+	line := fmt.Sprintf("%s\t%d\t%d\t%s\n", entry.Msgidhash, entry.Arrival, entry.Expires, entry.Token)
+	if len(line) > HISTORY_MAX_LINE {
+		return false, fmt.Errorf("Error History Add line too long msgidhash='%s'", entry.Msgidhash)
+	}
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if _, found, err := h.find(entry.Msgidhash); err != nil || found {
+		return false, err
+	}
+	offset := h.logsize
+	if _, err := h.logfh.WriteAt([]byte(line), offset); err != nil {
+		return false, err
+	}
+	h.logsize += int64(len(line))
+	if err := h.insert(entry.Msgidhash, offset); err != nil {
+		return false, err
+	}
+	return true, nil
+} // end func History.Add
+
+func (h *History) Remember(msgidhash string) (bool, error) {
+	// adds a msgidhash without token: rejected articles are not offered again
+	return h.Add(HistoryEntry{Msgidhash: msgidhash})
+} // end func History.Remember
+
+func TooOld(date time.Time) bool {
+	// returns true if an article with this date is older than HISTORY_REMEMBER
+	return time.Since(date) > HISTORY_REMEMBER
+} // end func TooOld
+
+func (h *History) Len() uint64 {
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+	return h.count
+} // end func History.Len
+
+func (h *History) Sync() error {
+	// writes the indexed logsize and syncs both files
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if err := h.logfh.Sync(); err != nil {
+		return err
+	}
+	if err := h.write_header(); err != nil {
+		return err
+	}
+	return h.idxfh.Sync()
+} // end func History.Sync
+
+func (h *History) Close() error {
+	if err := h.Sync(); err != nil {
+		log.Printf("Error OV History Close dir='%s' err='%v'", h.dir, err)
+	}
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.idxfh.Close()
+	return h.logfh.Close()
+} // end func History.Close
+
+func (h *History) Expire(now time.Time) (kept int, dropped int, err error) {
+	// rewrites the log without entries past remember time and rebuilds the index
+	// an entry is kept until arrival+HISTORY_REMEMBER or expires, whichever is later
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	logfile := filepath.Join(h.dir, "history.log")
+	newfh, err := os.OpenFile(logfile+".new", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, 0, err
+	}
+	w := bufio.NewWriterSize(newfh, 1024*1024)
+	r := bufio.NewReaderSize(io.NewSectionReader(h.logfh, 0, h.logsize), 1024*1024)
+	remember := int64(HISTORY_REMEMBER / time.Second)
+	var newsize int64
+	for {
+		line, rerr := r.ReadString('\n')
+		if rerr == io.EOF {
+			break
+		} else if rerr != nil {
+			newfh.Close()
+			return 0, 0, rerr
+		}
+		entry, perr := history_parse(line)
+		if perr != nil || (entry.Arrival+remember <= now.Unix() && entry.Expires <= now.Unix()) {
+			dropped++
+			continue
+		}
+		if _, err := w.WriteString(line); err != nil {
+			newfh.Close()
+			return 0, 0, err
+		}
+		newsize += int64(len(line))
+		kept++
+	}
+	if err := w.Flush(); err != nil {
+		newfh.Close()
+		return 0, 0, err
+	}
+	if err := newfh.Sync(); err != nil {
+		newfh.Close()
+		return 0, 0, err
+	}
+	if err := os.Rename(logfile+".new", logfile); err != nil {
+		newfh.Close()
+		return 0, 0, err
+	}
+	h.logfh.Close()
+	h.logfh, h.logsize = newfh, newsize
+	if err := h.rebuild(); err != nil {
+		return kept, dropped, err
+	}
+	log.Printf("OV History Expire dir='%s' kept=%d dropped=%d", h.dir, kept, dropped)
+	return kept, dropped, nil
+} // end func History.Expire
@@ -0,0 +1,230 @@
+package overview
+
+/*
+ * import overview data from INN with the original article numbers
+ *
+ *   tradindexed .IDX/.DAT pair of a group:
+ *     src := &overview.INNTradIndexed{Dir: "/var/spool/news/overview", Group: "alt.test"}
+ *   XOVER output or any tab-separated overview dump, one group per dump:
+ *     src := &overview.XoverDump{R: fh}
+ *   report, err := overview.ImportOverview("alt.test", "/ov", src)
+ *
+ * ovdb has no reader here: dump its groups with XOVER and import the dumps.
+ *
+ * lines are written with Open_ov/Write_ov like GO_pi_ov does, numbers have to ascend
+ * and start above the last line of an existing file. the footer gets last= of the
+ * highest number + 1, then the .Index is rebuilt.
+ */
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/go-while/go-utils"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// size of struct index_entry in a tradindexed .IDX on 64-bit:
+	// off_t offset 8, int length 4 + 4 padding, time_t arrived 8, time_t expires 8,
+	// TOKEN token 18 (type, class, 16 bytes), padded to 56
+	INN_IDX_ENTRY_SIZE = 56
+)
+
+// OverviewLineSource yields overview lines "artnum\tsubject\t...", without line ending
+type OverviewLineSource interface {
+	EachLine(fn func(line string) error) error // stops on the first error of fn
+}
+
+// ImportReport is the result of ImportOverview
+type ImportReport struct {
+	File        string `json:"file"`
+	Lines       uint64 `json:"lines"`
+	Imported    uint64 `json:"imported"`
+	Invalid     uint64 `json:"invalid"`      // too few fields, bad number or msgid
+	OutOfOrder  uint64 `json:"out_of_order"` // number not above the previous one
+	FirstMsgnum uint64 `json:"first_msgnum"`
+	LastMsgnum  uint64 `json:"last_msgnum"`
+}
+
+func ImportOverview(group string, cachedir string, src OverviewLineSource) (*ImportReport, error) {
+	if !IsValidGroupName(group) {
+		return nil, fmt.Errorf("ERROR overview.ImportOverview invalid group='%s'", group)
+	}
+	who := "ImportOverview"
+	hash := utils.Hash256(group)
+	file := cachedir + "/" + hash + ".overview"
+	report := &ImportReport{File: file}
+
+	ovfh, err := Open_ov(who, file)
+	if err != nil || ovfh == nil {
+		return nil, fmt.Errorf("ERROR overview.ImportOverview Open_ov err='%v'", err)
+	}
+	var prev uint64 // highest msgnum in the file
+	if ovfh.Last > 0 {
+		prev = ovfh.Last - 1
+	}
+	err = src.EachLine(func(line string) error {
+		report.Lines++
+		msgnum, data, ok := import_line(line)
+		if !ok {
+			report.Invalid++
+			return nil
+		}
+		if msgnum <= prev {
+			report.OutOfOrder++
+			return nil
+		}
+		new_ovfh, err, errstr := Write_ov(who, ovfh, fmt.Sprintf("%d\t%s\t%s\n", msgnum, data, XREF_PREFIX), false, false, false, false)
+		if err != nil {
+			return fmt.Errorf("ERROR overview.ImportOverview Write_ov msgnum=%d err='%v' errstr='%s'", msgnum, err, errstr)
+		}
+		if new_ovfh != nil && new_ovfh.Mmap_handle != nil {
+			ovfh = new_ovfh
+		}
+		ovfh.Last = msgnum + 1
+		prev = msgnum
+		if report.FirstMsgnum == 0 {
+			report.FirstMsgnum = msgnum
+		}
+		report.LastMsgnum = msgnum
+		report.Imported++
+		return nil
+	})
+	// write the footer even after an error, the lines written so far are valid
+	if _, ferr := Update_Footer(who, ovfh, who); ferr != nil && err == nil {
+		err = ferr
+	}
+	if cerr := Close_ov(who, ovfh, true, false); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return report, err
+	}
+	if report.Imported > 0 && !RebuildOverviewIndex(file, group) {
+		return report, fmt.Errorf("ERROR overview.ImportOverview RebuildOverviewIndex fp='%s'", filepath.Base(file))
+	}
+	log.Printf("ImportOverview group='%s' lines=%d imported=%d invalid=%d out_of_order=%d last=%d", group, report.Lines, report.Imported, report.Invalid, report.OutOfOrder, report.LastMsgnum)
+	return report, nil
+} // end func ImportOverview
+
+func import_line(line string) (uint64, string, bool) {
+	// returns the msgnum and subject..lines of an XOVER line
+	fields := strings.Split(strings.TrimRight(line, "\r\n"), "\t")
+	if len(fields) < OVERVIEW_FIELDS-1 {
+		return 0, "", false
+	}
+	msgnum := utils.Str2uint64(fields[0])
+	if msgnum == 0 || !utils.IsDigit(fields[0]) || !isvalidmsgid(fields[4], true) || fields[4][0] != '<' {
+		return 0, "", false
+	}
+	// the xref and extra fields are dropped, GO_pi_ov writes only XREF_PREFIX
+	return msgnum, strings.Join(fields[1:OVERVIEW_FIELDS-1], "\t"), true
+} // end func import_line
+
+// XoverDump reads XOVER output, a "." line ends it
+type XoverDump struct {
+	R io.Reader
+}
+
+func (d *XoverDump) EachLine(fn func(line string) error) error {
+	r := bufio.NewReaderSize(d.R, 1024*1024)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "." {
+			return nil
+		}
+		if line != "" {
+			if ferr := fn(line); ferr != nil {
+				return ferr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+} // end func XoverDump.EachLine
+
+// INNTradIndexed reads the .IDX/.DAT pair of a group from INN's tradindexed overview
+type INNTradIndexed struct {
+	Dir       string
+	Group     string
+	BigEndian bool // byte order of the server that wrote the .IDX
+	EntrySize int  // size of an .IDX entry, 0 uses INN_IDX_ENTRY_SIZE
+}
+
+func INNTradIndexedPath(dir string, group string) string {
+	// returns the path without .IDX/.DAT: alt.test -> dir/a/t/alt.test
+	path := dir
+	for _, part := range strings.Split(group, ".") {
+		if part != "" {
+			path = filepath.Join(path, part[:1])
+		}
+	}
+	return filepath.Join(path, group)
+} // end func INNTradIndexedPath
+
+func (t *INNTradIndexed) EachLine(fn func(line string) error) error {
+	// reads the entries of the .IDX in order, each points to a line in the .DAT
+	base := INNTradIndexedPath(t.Dir, t.Group)
+	idx, err := os.Open(base + ".IDX")
+	if err != nil {
+		return err
+	}
+	defer idx.Close()
+	size := t.EntrySize
+	if size <= 0 {
+		size = INN_IDX_ENTRY_SIZE
+	}
+	if fi, err := idx.Stat(); err != nil {
+		return err
+	} else if fi.Size()%int64(size) != 0 {
+		return fmt.Errorf("ERROR overview.INNTradIndexed .IDX size=%d is no multiple of entry size=%d", fi.Size(), size)
+	}
+	dat, err := os.Open(base + ".DAT")
+	if err != nil {
+		return err
+	}
+	defer dat.Close()
+	var order binary.ByteOrder = binary.LittleEndian
+	if t.BigEndian {
+		order = binary.BigEndian
+	}
+	r := bufio.NewReaderSize(idx, 1024*1024)
+	entry := make([]byte, size)
+	var buf []byte
+	for n := 0; ; n++ {
+		if _, err := io.ReadFull(r, entry); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("ERROR overview.INNTradIndexed entry=%d err='%v'", n, err)
+		}
+		offset := int64(order.Uint64(entry[0:8]))
+		length := int(int32(order.Uint32(entry[8:12])))
+		if length <= 0 {
+			// expired or never stored
+			continue
+		}
+		if length > 1024*1024 || offset < 0 {
+			return fmt.Errorf("ERROR overview.INNTradIndexed entry=%d offset=%d length=%d", n, offset, length)
+		}
+		if cap(buf) < length {
+			buf = make([]byte, length)
+		}
+		if _, err := dat.ReadAt(buf[:length], offset); err != nil {
+			return fmt.Errorf("ERROR overview.INNTradIndexed entry=%d read .DAT err='%v'", n, err)
+		}
+		if err := fn(strings.TrimRight(string(buf[:length]), "\r\n")); err != nil {
+			return err
+		}
+	}
+} // end func INNTradIndexed.EachLine
@@ -0,0 +1,75 @@
+package overview
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func innTradIndexedFixture(t *testing.T, dir string, group string, order binary.ByteOrder, lines []string) {
+	// writes a .DAT with lines and a .IDX of 56-byte entries, an empty line is an expired entry
+	base := INNTradIndexedPath(dir, group)
+	if err := os.MkdirAll(filepath.Dir(base), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var dat []byte
+	var idx []byte
+	for i, line := range lines {
+		entry := make([]byte, 56)
+		if line != "" {
+			order.PutUint64(entry[0:8], uint64(len(dat)))
+			order.PutUint32(entry[8:12], uint32(len(line)+2))
+			dat = append(dat, line+"\r\n"...)
+		}
+		order.PutUint64(entry[16:24], uint64(1700000000+i)) // arrived
+		entry[32] = 'T'                                     // token type, not read
+		idx = append(idx, entry...)
+	}
+	if err := os.WriteFile(base+".DAT", dat, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(base+".IDX", idx, 0644); err != nil {
+		t.Fatal(err)
+	}
+} // end func innTradIndexedFixture
+
+func TestINNTradIndexedEachLine(t *testing.T) {
+	lines := []string{
+		"1\tsub 1\ta@b\tMon, 02 Jan 2006 15:04:05 -0700\t<1@x>\t\t100\t3\tXref: host alt.test:1",
+		"",
+		"3\tsub 3\ta@b\tMon, 02 Jan 2006 15:04:05 -0700\t<3@x>\t\t100\t3\tXref: host alt.test:3",
+		"4\tsub 4\ta@b\tMon, 02 Jan 2006 15:04:05 -0700\t<4@x>\t\t100\t3\tXref: host alt.test:4",
+	}
+	for _, bigendian := range []bool{false, true} {
+		dir := t.TempDir()
+		var order binary.ByteOrder = binary.LittleEndian
+		if bigendian {
+			order = binary.BigEndian
+		}
+		innTradIndexedFixture(t, dir, "alt.test", order, lines)
+		var got []string
+		src := &INNTradIndexed{Dir: dir, Group: "alt.test", BigEndian: bigendian}
+		if err := src.EachLine(func(line string) error {
+			got = append(got, line)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		want := []string{lines[0], lines[2], lines[3]}
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Fatalf("bigendian=%t got %q", bigendian, got)
+		}
+	}
+} // end func TestINNTradIndexedEachLine
+
+func TestINNTradIndexedEntrySize(t *testing.T) {
+	// a .IDX written with another entry size is refused, not misread
+	dir := t.TempDir()
+	innTradIndexedFixture(t, dir, "alt.test", binary.LittleEndian, []string{"1\ts\ta@b\td\t<1@x>\t\t1\t1\t"})
+	src := &INNTradIndexed{Dir: dir, Group: "alt.test", EntrySize: 48}
+	if err := src.EachLine(func(line string) error { return nil }); err == nil {
+		t.Fatal("EachLine with EntrySize=48 read a 56-byte .IDX")
+	}
+} // end func TestINNTradIndexedEntrySize
@@ -0,0 +1,56 @@
+package overview
+
+import (
+	"github.com/go-while/go-utils"
+	"log"
+)
+
+var (
+	INGEST_SPAMFILTER   bool           = false // di_ov checks Subject and From with OV_Spamfilter
+	INGEST_FILTER_MSGID bool           = false // di_ov checks Message-ID with FilterMessageID
+	QUARANTINE_GROUP    string         = ""    // quarantined articles go to this group, empty rejects them
+	INGEST_HASHSTORE    MsgidHashStore = nil   // marks filtered msgidhashs with StatRejected
+
+	// IngestChain runs in di_ov before the overview line gets a msgnum
+	// add custom filters with IngestChain.Add
+	IngestChain = NewFilterChain(
+		&FlagFilter{Enabled: &INGEST_FILTER_MSGID, Filter: &MessageIDFilter{Verdict: VerdictQuarantine}},
+		&FlagFilter{Enabled: &INGEST_SPAMFILTER, Filter: &SpamFilter{Spam: &OV_Spamfilter, Verdict: VerdictQuarantine}},
+		&FlagFilter{Enabled: &INGEST_FLOODFILTER, Filter: OV_Floodfilter},
+	)
+)
+
+// IngestDecision is the result of IngestChain for one article
+type IngestDecision struct {
+	Verdict Verdict
+	Filter  string // name of the filter that decided
+	Reason  string // rule id or short text, passed to ReturnChannelData
+}
+
+func (ov *OV) ingest_filter(who string, ovl *OVL) (IngestDecision, []*ReturnChannelData) {
+	// runs IngestChain for di_ov
+	// VerdictHide stores the article normally, readers filter it with the view chain
+	// returns a non nil retlist if the article must not be written to its groups
+	verdict, filter, reason := IngestChain.Run(ovl, nil)
+	decision := IngestDecision{Verdict: verdict, Filter: filter, Reason: reason}
+	if verdict == VerdictAccept || verdict == VerdictHide {
+		return decision, nil
+	}
+	log.Printf("who='%s' di_ov filtered verdict=%s filter='%s' reason='%s' msgid='%s'", who, verdict, filter, reason, ovl.Messageid)
+	if INGEST_HASHSTORE != nil {
+		msgidhash := ovl.Messageidhash
+		if msgidhash == "" {
+			msgidhash = utils.Hash256(ovl.Messageid)
+		}
+		if _, err := SetStat(msgidhash, StatRejected, INGEST_HASHSTORE); err != nil {
+			log.Printf("who='%s' ERROR di_ov SetStat msgid='%s' err='%v'", who, ovl.Messageid, err)
+		}
+	}
+	if verdict == VerdictQuarantine && QUARANTINE_GROUP != "" {
+		// caller writes to the quarantine group and marks the results
+		ovl.Newsgroups = []string{QUARANTINE_GROUP}
+		return decision, nil
+	}
+	decision.Verdict = VerdictReject
+	return decision, []*ReturnChannelData{{Rejected: true, Filter: filter, Reason: reason}}
+} // end func ingest_filter
@@ -1,40 +1,182 @@
 package overview
 
+/*
+ * Known_MessageIDs suppresses duplicate offers of the same msgidhash
+ * while an article is being transferred (IHAVE, CHECK, TAKETHIS, POST).
+ *
+ * the cache is split into shards by msgidhash so peers don't wait on one mutex.
+ * every shard keeps its entries in insertion order: entries share one TTL,
+ * so the oldest entry expires first and is evicted first when a shard is full.
+ */
+
 import (
+	"container/list"
 	"log"
 	"sync"
 	"time"
 )
 
+var (
+	KNOWN_MSGIDS_TTL    time.Duration = 15 * time.Second // default Known_MessageIDs.TTL
+	KNOWN_MSGIDS_SHARDS int           = 16               // default Known_MessageIDs.Shards
+)
+
 type Known_MessageIDs struct {
-	v          map[string]int64 // key: messageidhash, val: true (or false if unknown/not set)
-	Debug      bool            // print debug messages
-	MAP_MSGIDS int             // capacity
-	mux        sync.Mutex
+	Debug      bool          // print debug messages
+	MAP_MSGIDS int           // capacity over all shards, 0 is unlimited
+	TTL        time.Duration // a msgidhash is known for TTL after SetKnown, 0 uses KNOWN_MSGIDS_TTL
+	Shards     int           // 0 uses KNOWN_MSGIDS_SHARDS
+	once       sync.Once
+	expirer    sync.Once
+	ttl        time.Duration
+	shards     []*known_shard
+}
+
+type known_shard struct {
+	mux     sync.Mutex
+	v       map[string]*list.Element // key: messageidhash
+	order   *list.List               // *known_entry, front is newest
+	max     int                      // capacity of this shard, 0 is unlimited
+	evicted uint64                   // removed for capacity before expiry
+}
+
+type known_entry struct {
+	msgidhash string
+	expires   int64  // unixnano
+	value     string // set by SetValue
 }
 
+func (km *Known_MessageIDs) init() {
+	km.once.Do(func() {
+		km.ttl = km.TTL
+		if km.ttl <= 0 {
+			km.ttl = KNOWN_MSGIDS_TTL
+		}
+		n := km.Shards
+		if n <= 0 {
+			n = KNOWN_MSGIDS_SHARDS
+		}
+		max := 0
+		if km.MAP_MSGIDS > 0 {
+			max = (km.MAP_MSGIDS + n - 1) / n
+		}
+		km.shards = make([]*known_shard, n)
+		for i := range km.shards {
+			km.shards[i] = &known_shard{v: make(map[string]*list.Element, max), order: list.New(), max: max}
+		}
+	})
+} // end func init
+
+func (km *Known_MessageIDs) shard(msgidhash string) *known_shard {
+	km.init()
+	return km.shards[flood_hash(msgidhash)%uint64(len(km.shards))]
+} // end func shard
+
+func (ks *known_shard) expire(now int64) (expired int) {
+	// removes expired entries from the back, caller holds ks.mux
+	for e := ks.order.Back(); e != nil; e = ks.order.Back() {
+		entry := e.Value.(*known_entry)
+		if entry.expires > now {
+			break
+		}
+		ks.order.Remove(e)
+		delete(ks.v, entry.msgidhash)
+		expired++
+	}
+	return
+} // end func known_shard.expire
 
 func (km *Known_MessageIDs) ExpireThread() {
-	go func(){
-		log.Print("Known_msgids.ExpireThread() start")
-		for {
-			deleted := 0
-			time.Sleep(time.Second*5)
-			km.mux.Lock()
-			for msgidhash, expires := range km.v {
-				if expires > time.Now().Unix() {
-					go km.UnsetKnown(msgidhash)
-					deleted++
+	// removes expired entries in the background, starts once
+	// not required: SetKnown expires and evicts on its own
+	km.expirer.Do(func() {
+		km.init()
+		interval := km.ttl / 2
+		if interval < time.Second {
+			interval = time.Second
+		}
+		go func() {
+			log.Print("Known_msgids.ExpireThread() start")
+			for {
+				time.Sleep(interval)
+				deleted := 0
+				for _, ks := range km.shards {
+					ks.mux.Lock()
+					deleted += ks.expire(time.Now().UnixNano())
+					ks.mux.Unlock()
+				}
+				if deleted > 0 && km.Debug {
+					log.Printf("KnownMsgIds ExpireThread deleted=%d", deleted)
 				}
 			}
-			km.mux.Unlock()
-			if deleted > 0 {
-				log.Printf("KnownMsgIds ExpireThread deleted=%d", deleted)
-			}
-		}
-	}()
+		}()
+	})
 } // end func ExpireThread
 
+func (km *Known_MessageIDs) CheckAndSet(msgidhash string) bool {
+	/*
+	 *  CheckAndSet:
+	 *      + returns true if msgidhash was not known, it is known now
+	 *      - returns false if msgidhash is known
+	 *  check and set happen under one shard lock:
+	 *  of two peers offering the same msgidhash at once only one gets true
+	 *
+	 */
+	ks := km.shard(msgidhash)
+	now := time.Now().UnixNano()
+	ks.mux.Lock()
+	defer ks.mux.Unlock()
+	ks.expire(now)
+	if e, exists := ks.v[msgidhash]; exists {
+		if km.Debug {
+			log.Printf("NOT SetKnown msgidhash=%s expires in='%d sec'", msgidhash, (e.Value.(*known_entry).expires-now)/int64(time.Second))
+		}
+		return false
+	}
+	ks.push(&known_entry{msgidhash: msgidhash, expires: now + int64(km.ttl)})
+	if km.Debug {
+		log.Printf("SetKnown msgidhash=%s", msgidhash)
+	}
+	return true
+} // end func CheckAndSet
+
+func (ks *known_shard) push(entry *known_entry) {
+	// adds entry as newest, evicts the oldest entry if full, caller holds ks.mux
+	if ks.max > 0 && ks.order.Len() >= ks.max {
+		oldest := ks.order.Back()
+		ks.order.Remove(oldest)
+		delete(ks.v, oldest.Value.(*known_entry).msgidhash)
+		ks.evicted++
+	}
+	ks.v[entry.msgidhash] = ks.order.PushFront(entry)
+} // end func known_shard.push
+
+func (km *Known_MessageIDs) SetValue(key string, value string) {
+	// remembers value for TTL, replaces a known value
+	ks := km.shard(key)
+	now := time.Now().UnixNano()
+	ks.mux.Lock()
+	defer ks.mux.Unlock()
+	ks.expire(now)
+	if e, exists := ks.v[key]; exists {
+		ks.order.Remove(e)
+		delete(ks.v, key)
+	}
+	ks.push(&known_entry{msgidhash: key, expires: now + int64(km.ttl), value: value})
+} // end func SetValue
+
+func (km *Known_MessageIDs) Value(key string) (string, bool) {
+	// returns the value of SetValue while it is not expired
+	ks := km.shard(key)
+	ks.mux.Lock()
+	defer ks.mux.Unlock()
+	e, exists := ks.v[key]
+	if !exists || e.Value.(*known_entry).expires <= time.Now().UnixNano() {
+		return "", false
+	}
+	return e.Value.(*known_entry).value, true
+} // end func Value
+
 func (km *Known_MessageIDs) SetKnown(msgidhash string) bool {
 	/*
 	 *  SetKnown:
@@ -48,50 +190,52 @@ func (km *Known_MessageIDs) SetKnown(msgidhash string) bool {
 	 *      // else: reply OK to command, and receive data
 	 *
 	 */
-	km.mux.Lock()
-	defer km.mux.Unlock()
-
-	if km.v == nil {
-		log.Printf("ERROR OVERVIEW SetKnown km.v nil")
-		return false
-	}
-
-	if km.v[msgidhash] >= time.Now().Unix() {
-		if km.Debug {
-			log.Printf("NOT SetKnown msgidhash=%s expires in='%d sec'", msgidhash, km.v[msgidhash]-time.Now().Unix())
-		}
-		return false
-	}
-
-	km.v[msgidhash] = time.Now().Unix()+15         // adds new msgidhash to map
-
-	if km.Debug {
-		log.Printf("SetKnown msgidhash=%s", msgidhash)
-	}
-	return true
+	return km.CheckAndSet(msgidhash)
 } // end func SetKnown
 
+func (km *Known_MessageIDs) IsKnown(msgidhash string) bool {
+	// returns true if msgidhash is known and not expired, does not set it
+	ks := km.shard(msgidhash)
+	ks.mux.Lock()
+	defer ks.mux.Unlock()
+	e, exists := ks.v[msgidhash]
+	return exists && e.Value.(*known_entry).expires > time.Now().UnixNano()
+} // end func IsKnown
+
 func (km *Known_MessageIDs) UnsetKnownQuick(msgidhash string) {
-	km.mux.Lock()
-	delete(km.v, msgidhash)
-	km.mux.Unlock()
+	ks := km.shard(msgidhash)
+	ks.mux.Lock()
+	if e, exists := ks.v[msgidhash]; exists {
+		ks.order.Remove(e)
+		delete(ks.v, msgidhash)
+	}
+	ks.mux.Unlock()
 } // end func UnsetKnownQuick
 
 func (km *Known_MessageIDs) UnsetKnown(msgidhash string) {
 	/*
-	 *  NOTE: calling UnsetKnown() is expensive
-	 *         SetKnown clears up map when full
+	 *  UnsetKnown:
+	 *      : call when a transfer failed, so the msgidhash can be offered again
 	 *
 	 *  usage:
 	 *      overview.Known_msgids.UnsetKnown(msgidhash)
 	 *
-	 *
 	 */
-	km.mux.Lock()
-	delete(km.v, msgidhash)
-	km.mux.Unlock()
-
+	km.UnsetKnownQuick(msgidhash)
 	if km.Debug {
 		log.Printf("unsetKnown msgidhash=%s", msgidhash)
 	}
 } // end func UnsetKnown
+
+func (km *Known_MessageIDs) Len() (entries int, evicted uint64) {
+	// returns the number of entries, expired ones included until removed,
+	// and the number of entries evicted for capacity
+	km.init()
+	for _, ks := range km.shards {
+		ks.mux.Lock()
+		entries += ks.order.Len()
+		evicted += ks.evicted
+		ks.mux.Unlock()
+	}
+	return
+} // end func Len
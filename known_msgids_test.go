@@ -0,0 +1,94 @@
+package overview
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKnownMessageIDsTTL(t *testing.T) {
+	km := &Known_MessageIDs{TTL: 50 * time.Millisecond, Shards: 1}
+	if !km.CheckAndSet("a") {
+		t.Fatal("first CheckAndSet returned false")
+	}
+	if km.CheckAndSet("a") || !km.IsKnown("a") {
+		t.Fatal("a is not known after CheckAndSet")
+	}
+	km.SetValue("v", "n")
+	if value, ok := km.Value("v"); !ok || value != "n" {
+		t.Fatalf("Value='%s' ok=%t", value, ok)
+	}
+	time.Sleep(80 * time.Millisecond)
+	if km.IsKnown("a") {
+		t.Fatal("a is known after TTL")
+	}
+	if _, ok := km.Value("v"); ok {
+		t.Fatal("value is known after TTL")
+	}
+	if !km.CheckAndSet("a") {
+		t.Fatal("CheckAndSet after TTL returned false")
+	}
+	if entries, _ := km.Len(); entries != 1 {
+		t.Fatalf("entries=%d want 1", entries)
+	}
+} // end func TestKnownMessageIDsTTL
+
+func TestKnownMessageIDsEvictOldest(t *testing.T) {
+	km := &Known_MessageIDs{MAP_MSGIDS: 3, TTL: time.Minute, Shards: 1}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if !km.SetKnown(key) {
+			t.Fatalf("SetKnown key='%s' returned false", key)
+		}
+	}
+	if km.IsKnown("a") {
+		t.Fatal("oldest entry a was not evicted")
+	}
+	for _, key := range []string{"b", "c", "d"} {
+		if !km.IsKnown(key) {
+			t.Fatalf("key='%s' was evicted", key)
+		}
+	}
+	// a replaced value is the newest entry
+	km.SetValue("b", "x")
+	km.SetKnown("e")
+	if km.IsKnown("c") || !km.IsKnown("b") {
+		t.Fatal("eviction did not follow insertion order")
+	}
+	if entries, evicted := km.Len(); entries != 3 || evicted != 2 {
+		t.Fatalf("entries=%d evicted=%d want 3 2", entries, evicted)
+	}
+	km.UnsetKnown("d")
+	if !km.SetKnown("d") {
+		t.Fatal("SetKnown after UnsetKnown returned false")
+	}
+} // end func TestKnownMessageIDsEvictOldest
+
+func TestKnownMessageIDsConcurrentCheckAndSet(t *testing.T) {
+	// of many goroutines offering the same msgids only one wins each
+	km := &Known_MessageIDs{TTL: time.Minute, Shards: 4}
+	const goroutines, msgids = 32, 200
+	wins := make([]int32, msgids)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			for i := 0; i < msgids; i++ {
+				if km.CheckAndSet(fmt.Sprintf("msgidhash%d", i)) {
+					atomic.AddInt32(&wins[i], 1)
+				}
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	for i, n := range wins {
+		if n != 1 {
+			t.Fatalf("msgidhash%d won %d times", i, n)
+		}
+	}
+} // end func TestKnownMessageIDsConcurrentCheckAndSet
@@ -0,0 +1,212 @@
+package overview
+
+/*
+ * bloom filter over msgidhashs in front of the h_xxx tables
+ *
+ * IsMsgidHashSQL asks OV_MsgidBloom first when it is Ready:
+ * a miss answers "not seen" without a query, only possible hits go to SQL.
+ * MsgIDhash2mysql* and Rescan mode 1000 add every hash they insert.
+ *
+ * startup:
+ *   bloom, err := overview.LoadMsgidBloom("/ov/msgid.bloom")
+ *   if err != nil {
+ *       bloom = overview.NewMsgidBloom(100000000, 0.001)
+ *       bloom.BuildFromSQL(db)
+ *   }
+ *   overview.OV_MsgidBloom = bloom
+ *   bloom.SetReady(true)
+ *
+ * a snapshot misses hashs inserted after Save. load it only if nothing
+ * was inserted since, or run BuildFromSQL over it before SetReady.
+ * the filter can not delete, rebuild it when rows get deleted.
+ */
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+)
+
+var (
+	OV_MsgidBloom *MsgidBloom // nil disables the pre-check
+)
+
+// MsgidBloom is a concurrent bloom filter over msgidhashs
+type MsgidBloom struct {
+	bits      []uint64
+	m         uint64 // number of bits
+	k         uint64 // number of hashes
+	ready     int32
+	added     uint64
+	tests     uint64
+	negatives uint64
+	falsepos  uint64
+}
+
+func NewMsgidBloom(expected uint64, fprate float64) *MsgidBloom {
+	// sizes the filter for expected hashs at fprate false positives
+	if expected == 0 {
+		expected = 1
+	}
+	if fprate <= 0 || fprate >= 1 {
+		fprate = 0.001
+	}
+	m := uint64(math.Ceil(-float64(expected) * math.Log(fprate) / (math.Ln2 * math.Ln2)))
+	m = (m + 63) / 64 * 64
+	k := uint64(math.Round(float64(m) / float64(expected) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &MsgidBloom{bits: make([]uint64, m/64), m: m, k: k}
+} // end func NewMsgidBloom
+
+func bloom_hashes(msgidhash string) (uint64, uint64) {
+	// a sha256 hex hash is uniform already, other input gets hashed
+	if len(msgidhash) >= 32 {
+		h1, err1 := strconv.ParseUint(msgidhash[0:16], 16, 64)
+		h2, err2 := strconv.ParseUint(msgidhash[16:32], 16, 64)
+		if err1 == nil && err2 == nil {
+			return h1, h2 | 1
+		}
+	}
+	h1 := flood_hash(msgidhash)
+	return h1, flood_hash(msgidhash+"\x00") | 1
+} // end func bloom_hashes
+
+func (b *MsgidBloom) Add(msgidhash string) {
+	h1, h2 := bloom_hashes(msgidhash)
+	for i := uint64(0); i < b.k; i++ {
+		bit := (h1 + i*h2) % b.m
+		word, mask := &b.bits[bit/64], uint64(1)<<(bit%64)
+		for {
+			old := atomic.LoadUint64(word)
+			if old&mask != 0 || atomic.CompareAndSwapUint64(word, old, old|mask) {
+				break
+			}
+		}
+	}
+	atomic.AddUint64(&b.added, 1)
+} // end func MsgidBloom.Add
+
+func (b *MsgidBloom) Test(msgidhash string) bool {
+	// returns false if msgidhash was never added, true if it may have been
+	atomic.AddUint64(&b.tests, 1)
+	h1, h2 := bloom_hashes(msgidhash)
+	for i := uint64(0); i < b.k; i++ {
+		bit := (h1 + i*h2) % b.m
+		if atomic.LoadUint64(&b.bits[bit/64])&(uint64(1)<<(bit%64)) == 0 {
+			atomic.AddUint64(&b.negatives, 1)
+			return false
+		}
+	}
+	return true
+} // end func MsgidBloom.Test
+
+func (b *MsgidBloom) Ready() bool {
+	return b != nil && atomic.LoadInt32(&b.ready) == 1
+} // end func MsgidBloom.Ready
+
+func (b *MsgidBloom) SetReady(ready bool) {
+	// IsMsgidHashSQL uses the filter only while ready
+	var v int32
+	if ready {
+		v = 1
+	}
+	atomic.StoreInt32(&b.ready, v)
+} // end func MsgidBloom.SetReady
+
+func (b *MsgidBloom) false_positive() {
+	atomic.AddUint64(&b.falsepos, 1)
+} // end func MsgidBloom.false_positive
+
+func (b *MsgidBloom) Stats() (added uint64, tests uint64, negatives uint64, falsepos uint64) {
+	// falsepos counts possible hits SQL did not find
+	return atomic.LoadUint64(&b.added), atomic.LoadUint64(&b.tests), atomic.LoadUint64(&b.negatives), atomic.LoadUint64(&b.falsepos)
+} // end func MsgidBloom.Stats
+
+func (b *MsgidBloom) BuildFromSQL(db *sql.DB) (uint64, error) {
+	// adds all hashs of the h_xxx tables, returns the number added
+	return b.BuildFromStore(NewMySQLStore(db))
+} // end func MsgidBloom.BuildFromSQL
+
+func (b *MsgidBloom) BuildFromStore(store MsgidHashStore) (uint64, error) {
+	// adds all hashs of store, returns the number added
+	var added uint64
+	err := store.Iterate(func(msgidhash string, size int, stat string) bool {
+		b.Add(msgidhash)
+		added++
+		return true
+	})
+	if err != nil {
+		log.Printf("Error OV MsgidBloom BuildFromStore added=%d err='%v'", added, err)
+		return added, err
+	}
+	log.Printf("OV MsgidBloom BuildFromStore added=%d m=%d k=%d", added, b.m, b.k)
+	return added, nil
+} // end func MsgidBloom.BuildFromStore
+
+func (b *MsgidBloom) Save(file string) error {
+	// writes a snapshot to file.tmp and renames it to file
+	tmp := file + ".tmp"
+	fh, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(fh, 1024*1024)
+	fmt.Fprintf(w, "#msgidbloom %d %d %d\n", b.m, b.k, atomic.LoadUint64(&b.added))
+	buf := make([]byte, 8)
+	for i := range b.bits {
+		binary.LittleEndian.PutUint64(buf, atomic.LoadUint64(&b.bits[i]))
+		if _, err := w.Write(buf); err != nil {
+			fh.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Sync(); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+} // end func MsgidBloom.Save
+
+func LoadMsgidBloom(file string) (*MsgidBloom, error) {
+	// loads a snapshot written by Save, the filter is not ready
+	fh, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	r := bufio.NewReaderSize(fh, 1024*1024)
+	var m, k, added uint64
+	if _, err := fmt.Fscanf(r, "#msgidbloom %d %d %d\n", &m, &k, &added); err != nil {
+		return nil, fmt.Errorf("Error LoadMsgidBloom fp='%s' bad header err='%v'", filepath.Base(file), err)
+	}
+	if m == 0 || m%64 != 0 || k == 0 {
+		return nil, fmt.Errorf("Error LoadMsgidBloom fp='%s' bad header m=%d k=%d", filepath.Base(file), m, k)
+	}
+	b := &MsgidBloom{bits: make([]uint64, m/64), m: m, k: k, added: added}
+	buf := make([]byte, 8)
+	for i := range b.bits {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, fmt.Errorf("Error LoadMsgidBloom fp='%s' short file err='%v'", filepath.Base(file), err)
+		}
+		b.bits[i] = binary.LittleEndian.Uint64(buf)
+	}
+	log.Printf("OV LoadMsgidBloom fp='%s' m=%d k=%d added=%d", filepath.Base(file), m, k, added)
+	return b, nil
+} // end func LoadMsgidBloom
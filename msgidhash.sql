@@ -1,15 +1,13 @@
-use msgidhash;
+-- msgidhash database: the sharded h_<hex> tables are created by
+-- overview.CreateSchema(db, width, engine) or printed by overview.PrintHashMySQL.
+-- msgidhash_meta records version and shardwidth, see msgidhash_schema.go
 
-START TRANSACTION;
+CREATE DATABASE IF NOT EXISTS `msgidhash` DEFAULT CHARACTER SET latin1 COLLATE latin1_general_ci;
 
-CREATE TABLE `msgidhash` (
-  `hash` char(64) NOT NULL,
-  `fsize` int(11) DEFAULT NULL,
-  `stat` char(1) DEFAULT NULL
-) ENGINE=InnoDB DEFAULT CHARSET=latin1 COLLATE=latin1_general_ci;
+use msgidhash;
 
-ALTER TABLE `msgidhash`
-  ADD UNIQUE KEY `hash` (`hash`) USING HASH,
-  ADD KEY `fsize` (`fsize`),
-  ADD KEY `stat` (`stat`);
-COMMIT;
+CREATE TABLE IF NOT EXISTS `msgidhash_meta` (
+  `k` varchar(32) NOT NULL,
+  `v` varchar(255) NOT NULL,
+  PRIMARY KEY (`k`)
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
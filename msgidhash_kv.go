@@ -0,0 +1,252 @@
+package overview
+
+/*
+ * embedded MsgidHashStore for small sites and tests
+ *
+ * all hashs live in a map, changes are appended to one log file:
+ *   +msgidhash <TAB> size <TAB> stat
+ *   -msgidhash
+ * OpenKVStore replays the log, Compact rewrites it with the live entries.
+ * writes are buffered until Sync, Close, InsertMany or ClearStat.
+ * a partial last line from a crash is ignored.
+ */
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// KVStore is a MsgidHashStore in memory with an append log
+type KVStore struct {
+	mux     sync.RWMutex
+	file    string
+	fh      *os.File
+	w       *bufio.Writer
+	m       map[string]kv_entry
+	records int // lines in the log
+}
+
+type kv_entry struct {
+	size int
+	stat string
+}
+
+func OpenKVStore(file string) (*KVStore, error) {
+	kv := &KVStore{file: file, m: make(map[string]kv_entry)}
+	if err := kv.replay(); err != nil {
+		return nil, err
+	}
+	fh, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	kv.fh, kv.w = fh, bufio.NewWriterSize(fh, 64*1024)
+	log.Printf("OV OpenKVStore fp='%s' entries=%d records=%d", filepath.Base(file), len(kv.m), kv.records)
+	return kv, nil
+} // end func OpenKVStore
+
+func (kv *KVStore) replay() error {
+	fh, err := os.Open(kv.file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer fh.Close()
+	r := bufio.NewReaderSize(fh, 1024*1024)
+	var offset int64
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if line != "" {
+				// partial line of a crash, cut it so appends start on a new line
+				log.Printf("OV KVStore fp='%s' cut partial line at offset=%d", filepath.Base(kv.file), offset)
+				return os.Truncate(kv.file, offset)
+			}
+			return nil
+		}
+		offset += int64(len(line))
+		kv.records++
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "+"):
+			x := strings.Split(line[1:], "\t")
+			if len(x) != 3 {
+				return fmt.Errorf("Error KVStore replay fp='%s' offset=%d bad record", filepath.Base(kv.file), offset)
+			}
+			size, _ := strconv.Atoi(x[1])
+			kv.m[x[0]] = kv_entry{size: size, stat: x[2]}
+		case strings.HasPrefix(line, "-"):
+			delete(kv.m, line[1:])
+		default:
+			return fmt.Errorf("Error KVStore replay fp='%s' offset=%d bad record", filepath.Base(kv.file), offset)
+		}
+	}
+} // end func KVStore.replay
+
+func (kv *KVStore) put(msgidhash string, e kv_entry) error {
+	// caller holds kv.mux
+	if _, err := fmt.Fprintf(kv.w, "+%s\t%d\t%s\n", msgidhash, e.size, e.stat); err != nil {
+		return err
+	}
+	kv.m[msgidhash] = e
+	kv.records++
+	return nil
+} // end func KVStore.put
+
+func (kv *KVStore) Insert(msgidhash string, size int) (bool, error) {
+	if err := check_msgidhash(msgidhash); err != nil {
+		return false, err
+	}
+	if err := check_size(msgidhash, size); err != nil {
+		return false, err
+	}
+	kv.mux.Lock()
+	defer kv.mux.Unlock()
+	if _, exists := kv.m[msgidhash]; exists {
+		return false, nil
+	}
+	return true, kv.put(msgidhash, kv_entry{size: size})
+}
+
+func (kv *KVStore) InsertMany(list []Msgidhash_item) error {
+	// check all items before the first insert
+	for _, item := range list {
+		if err := check_msgidhash(item.Hash); err != nil {
+			return err
+		}
+		if err := check_size(item.Hash, item.Size); err != nil {
+			return err
+		}
+	}
+	kv.mux.Lock()
+	defer kv.mux.Unlock()
+	for _, item := range list {
+		if _, exists := kv.m[item.Hash]; exists {
+			continue
+		}
+		if err := kv.put(item.Hash, kv_entry{size: item.Size}); err != nil {
+			return err
+		}
+	}
+	return kv.w.Flush()
+}
+
+func (kv *KVStore) Lookup(msgidhash string) (bool, string, error) {
+	kv.mux.RLock()
+	defer kv.mux.RUnlock()
+	e, exists := kv.m[msgidhash]
+	return exists, e.stat, nil
+}
+
+func (kv *KVStore) SetStat(msgidhash string, stat string) (bool, error) {
+	if err := check_msgidhash(msgidhash); err != nil {
+		return false, err
+	}
+	if err := check_stat(stat); err != nil {
+		return false, err
+	}
+	kv.mux.Lock()
+	defer kv.mux.Unlock()
+	e, exists := kv.m[msgidhash]
+	e.stat = stat
+	return !exists, kv.put(msgidhash, e)
+}
+
+func (kv *KVStore) ClearStat(stat string) (int64, error) {
+	if err := check_stat(stat); err != nil {
+		return 0, err
+	}
+	kv.mux.Lock()
+	defer kv.mux.Unlock()
+	var deleted int64
+	for msgidhash, e := range kv.m {
+		if e.size != 0 || e.stat != stat {
+			continue
+		}
+		if _, err := fmt.Fprintf(kv.w, "-%s\n", msgidhash); err != nil {
+			return deleted, err
+		}
+		delete(kv.m, msgidhash)
+		kv.records++
+		deleted++
+	}
+	return deleted, kv.w.Flush()
+}
+
+func (kv *KVStore) Iterate(fn func(msgidhash string, size int, stat string) bool) error {
+	// holds a read lock, fn must not change the store
+	kv.mux.RLock()
+	defer kv.mux.RUnlock()
+	for msgidhash, e := range kv.m {
+		if !fn(msgidhash, e.size, e.stat) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (kv *KVStore) Len() int {
+	kv.mux.RLock()
+	defer kv.mux.RUnlock()
+	return len(kv.m)
+} // end func KVStore.Len
+
+func (kv *KVStore) Sync() error {
+	kv.mux.Lock()
+	defer kv.mux.Unlock()
+	if err := kv.w.Flush(); err != nil {
+		return err
+	}
+	return kv.fh.Sync()
+} // end func KVStore.Sync
+
+func (kv *KVStore) Compact() error {
+	// rewrites the log with one record per live entry
+	kv.mux.Lock()
+	defer kv.mux.Unlock()
+	if err := kv.w.Flush(); err != nil {
+		return err
+	}
+	tmp := kv.file + ".tmp"
+	fh, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(fh, 1024*1024)
+	for msgidhash, e := range kv.m {
+		fmt.Fprintf(w, "+%s\t%d\t%s\n", msgidhash, e.size, e.stat)
+	}
+	if err := w.Flush(); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Sync(); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := os.Rename(tmp, kv.file); err != nil {
+		fh.Close()
+		return err
+	}
+	// fh was opened without O_APPEND but sits at the end after the writes
+	kv.fh.Close()
+	kv.fh, kv.w, kv.records = fh, bufio.NewWriterSize(fh, 64*1024), len(kv.m)
+	log.Printf("OV KVStore Compact fp='%s' entries=%d", filepath.Base(kv.file), len(kv.m))
+	return nil
+} // end func KVStore.Compact
+
+func (kv *KVStore) Close() error {
+	if err := kv.Sync(); err != nil {
+		log.Printf("Error OV KVStore Close fp='%s' err='%v'", filepath.Base(kv.file), err)
+	}
+	kv.mux.Lock()
+	defer kv.mux.Unlock()
+	return kv.fh.Close()
+}
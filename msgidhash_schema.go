@@ -0,0 +1,324 @@
+package overview
+
+/*
+ * schema of the msgidhash database
+ *
+ * the hashs are sharded into 16^width tables h_<first width hex chars of the hash>,
+ * a table stores the rest of the hash. msgidhash_meta records:
+ *   version     SCHEMA_VERSION
+ *   shardwidth  width of the table names
+ *   migrating   target width while MigrateShardWidth runs
+ *   oldwidth    width of the tables MigrateShardWidth still has to drop
+ *
+ * setup:
+ *   overview.CreateSchema(db, 3, "InnoDB") // creates missing tables, loads the schema
+ * later starts:
+ *   overview.LoadSchema(db)
+ *
+ * MigrateShardWidth copies all rows to tables of a new width while the server runs:
+ * writes go to the new tables, lookups try the new tables first and the old ones after.
+ * other processes using the database notice a migration with WatchSchema.
+ * an interrupted migration continues when MigrateShardWidth is called again,
+ * also one that was interrupted after switching shardwidth and before dropping the old tables.
+ */
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const SCHEMA_VERSION = 1
+
+var (
+	shard_width   int32 = 3 // width of the h_ table names, set by LoadSchema
+	shard_migrate int32 = 0 // target width while a migration runs, 0 if none
+
+	// MigrateShardWidth waits this long after changing the meta table,
+	// so processes running WatchSchema switch tables before rows are copied or dropped
+	SCHEMA_RELOAD_DELAY time.Duration = 30 * time.Second
+)
+
+func ShardWidth() int {
+	return int(atomic.LoadInt32(&shard_width))
+} // end func ShardWidth
+
+func write_width() int {
+	// new rows go to the target width while migrating
+	if m := atomic.LoadInt32(&shard_migrate); m > 0 {
+		return int(m)
+	}
+	return ShardWidth()
+} // end func write_width
+
+func shard_widths() []int {
+	// returns the widths with tables holding rows, the write width first
+	if m := int(atomic.LoadInt32(&shard_migrate)); m > 0 {
+		return []int{m, ShardWidth()}
+	}
+	return []int{ShardWidth()}
+} // end func shard_widths
+
+func shard_keys(width int) []string {
+	// returns the table keys of a width: "0".."f", "00".."ff", ...
+	keys := []string{""}
+	for i := 0; i < width; i++ {
+		var next []string
+		for _, key := range keys {
+			for _, c := range cs {
+				next = append(next, key+string(c))
+			}
+		}
+		keys = next
+	}
+	return keys
+} // end func shard_keys
+
+func shard_create_sql(key string, engine string) string {
+	collate := "latin1_general_ci"
+	if strings.EqualFold(engine, "RocksDB") {
+		collate = "latin1_bin"
+	}
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS `h_%s` (  `hash` char(%d) NOT NULL,  `fsize` int(11) DEFAULT NULL,  `stat` char(1) DEFAULT NULL, PRIMARY KEY (`hash`)) ENGINE=%s DEFAULT CHARSET=latin1 COLLATE=%s;", key, 64-len(key), engine, collate)
+} // end func shard_create_sql
+
+func check_width(width int) error {
+	if width < 1 || width > 4 {
+		return fmt.Errorf("ERROR overview.schema shardwidth=%d not in 1..4", width)
+	}
+	return nil
+} // end func check_width
+
+func read_meta(db *sql.DB) (map[string]string, error) {
+	rows, err := db.Query("SELECT k, v FROM msgidhash_meta")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	meta := make(map[string]string)
+	for rows.Next() {
+		var k, v string
+		if err := rows.Scan(&k, &v); err != nil {
+			return nil, err
+		}
+		meta[k] = v
+	}
+	return meta, rows.Err()
+} // end func read_meta
+
+func write_meta(db *sql.DB, k string, v string) error {
+	_, err := db.Exec("INSERT INTO msgidhash_meta (k, v) VALUES (?,?) ON DUPLICATE KEY UPDATE v = ?", k, v, v)
+	return err
+} // end func write_meta
+
+func LoadSchema(db *sql.DB) error {
+	// reads shardwidth and migrating from msgidhash_meta
+	meta, err := read_meta(db)
+	if err != nil {
+		log.Printf("ERROR overview.LoadSchema err='%v'", err)
+		return err
+	}
+	version, _ := strconv.Atoi(meta["version"])
+	if version != SCHEMA_VERSION {
+		return fmt.Errorf("ERROR overview.LoadSchema version=%d want=%d", version, SCHEMA_VERSION)
+	}
+	width, err := strconv.Atoi(meta["shardwidth"])
+	if err != nil || check_width(width) != nil {
+		return fmt.Errorf("ERROR overview.LoadSchema bad shardwidth='%s'", meta["shardwidth"])
+	}
+	migrate, _ := strconv.Atoi(meta["migrating"])
+	if migrate != 0 && check_width(migrate) != nil {
+		return fmt.Errorf("ERROR overview.LoadSchema bad migrating='%s'", meta["migrating"])
+	}
+	if migrate == width {
+		// MigrateShardWidth stopped after switching shardwidth, all rows are in width
+		migrate = 0
+	}
+	// set the target first, writes never go to a width without tables
+	atomic.StoreInt32(&shard_migrate, int32(migrate))
+	atomic.StoreInt32(&shard_width, int32(width))
+	return nil
+} // end func LoadSchema
+
+func CreateSchema(db *sql.DB, width int, engine string) error {
+	// creates the meta table and the tables of width if missing, then loads the schema
+	// an existing schema with another width has to be changed with MigrateShardWidth
+	if err := check_width(width); err != nil {
+		return err
+	}
+	if engine == "" {
+		engine = "InnoDB"
+	}
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS `msgidhash_meta` (`k` varchar(32) NOT NULL, `v` varchar(255) NOT NULL, PRIMARY KEY (`k`)) ENGINE=InnoDB DEFAULT CHARSET=latin1;"); err != nil {
+		log.Printf("ERROR overview.CreateSchema meta err='%v'", err)
+		return err
+	}
+	meta, err := read_meta(db)
+	if err != nil {
+		return err
+	}
+	if have, exists := meta["shardwidth"]; exists {
+		if have != strconv.Itoa(width) {
+			return fmt.Errorf("ERROR overview.CreateSchema shardwidth=%s exists, want=%d: use MigrateShardWidth", have, width)
+		}
+		return LoadSchema(db)
+	}
+	start := time.Now()
+	for _, key := range shard_keys(width) {
+		if _, err := db.Exec(shard_create_sql(key, engine)); err != nil {
+			log.Printf("ERROR overview.CreateSchema table='h_%s' err='%v'", key, err)
+			return err
+		}
+	}
+	if err := write_meta(db, "version", strconv.Itoa(SCHEMA_VERSION)); err != nil {
+		return err
+	}
+	if err := write_meta(db, "shardwidth", strconv.Itoa(width)); err != nil {
+		return err
+	}
+	log.Printf("CreateSchema shardwidth=%d tables=%d engine=%s took=(%d ms)", width, len(shard_keys(width)), engine, time.Since(start).Milliseconds())
+	return LoadSchema(db)
+} // end func CreateSchema
+
+func MigrateShardWidth(db *sql.DB, width int, engine string) error {
+	// moves all rows to tables of width and drops the old tables
+	if err := check_width(width); err != nil {
+		return err
+	}
+	if engine == "" {
+		engine = "InnoDB"
+	}
+	if err := LoadSchema(db); err != nil {
+		return err
+	}
+	meta, err := read_meta(db)
+	if err != nil {
+		return err
+	}
+	old := ShardWidth()
+	if meta["migrating"] == strconv.Itoa(old) || meta["migrating"] == "" && meta["oldwidth"] != "" {
+		// stopped after switching shardwidth or before starting to copy:
+		// finish the cleanup, migrate_finish does not drop tables of the shardwidth
+		if err := migrate_finish(db, old); err != nil {
+			return err
+		}
+	}
+	if old == width {
+		return nil
+	}
+	if m := int(atomic.LoadInt32(&shard_migrate)); m != 0 && m != width {
+		return fmt.Errorf("ERROR overview.MigrateShardWidth migration to width=%d unfinished", m)
+	}
+	start := time.Now()
+	for _, key := range shard_keys(width) {
+		if _, err := db.Exec(shard_create_sql(key, engine)); err != nil {
+			log.Printf("ERROR overview.MigrateShardWidth create table='h_%s' err='%v'", key, err)
+			return err
+		}
+	}
+	if err := write_meta(db, "oldwidth", strconv.Itoa(old)); err != nil {
+		return err
+	}
+	if err := write_meta(db, "migrating", strconv.Itoa(width)); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&shard_migrate, int32(width))
+	time.Sleep(SCHEMA_RELOAD_DELAY)
+
+	var copied int64
+	for _, key := range shard_keys(old) {
+		for _, query := range migrate_queries(key, old, width) {
+			res, err := db.Exec(query)
+			if err != nil {
+				log.Printf("ERROR overview.MigrateShardWidth copy table='h_%s' err='%v'", key, err)
+				return err
+			}
+			if n, err := res.RowsAffected(); err == nil {
+				copied += n
+			}
+		}
+	}
+	if err := write_meta(db, "shardwidth", strconv.Itoa(width)); err != nil {
+		return err
+	}
+	if err := migrate_finish(db, width); err != nil {
+		return err
+	}
+	log.Printf("MigrateShardWidth from=%d to=%d copied=%d took=(%d ms)", old, width, copied, time.Since(start).Milliseconds())
+	return nil
+} // end func MigrateShardWidth
+
+func migrate_finish(db *sql.DB, width int) error {
+	// ends a migration to width which already is the shardwidth:
+	// clears migrating, waits for WatchSchema and drops the tables of oldwidth
+	if _, err := db.Exec("DELETE FROM msgidhash_meta WHERE k = 'migrating'"); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&shard_width, int32(width))
+	atomic.StoreInt32(&shard_migrate, 0)
+	meta, err := read_meta(db)
+	if err != nil {
+		return err
+	}
+	old, err := strconv.Atoi(meta["oldwidth"])
+	if err != nil || check_width(old) != nil {
+		log.Printf("WARN overview.MigrateShardWidth bad oldwidth='%s', old tables not dropped", meta["oldwidth"])
+		return nil
+	}
+	if old != width {
+		time.Sleep(SCHEMA_RELOAD_DELAY)
+		for _, key := range shard_keys(old) {
+			if _, err := db.Exec("DROP TABLE IF EXISTS `h_" + key + "`"); err != nil {
+				log.Printf("ERROR overview.MigrateShardWidth drop table='h_%s' err='%v'", key, err)
+				return err
+			}
+		}
+		log.Printf("MigrateShardWidth dropped oldwidth=%d tables=%d", old, len(shard_keys(old)))
+	}
+	_, err = db.Exec("DELETE FROM msgidhash_meta WHERE k = 'oldwidth'")
+	return err
+} // end func migrate_finish
+
+func migrate_queries(key string, old int, width int) []string {
+	// returns the queries copying table h_key of width old to the tables of width
+	// rows written to the new tables during the migration keep their values,
+	// missing fsize or stat are taken from the old row
+	upsert := func(target string) string {
+		return fmt.Sprintf(" ON DUPLICATE KEY UPDATE fsize = IFNULL(`h_%s`.fsize, VALUES(fsize)), stat = IFNULL(`h_%s`.stat, VALUES(stat))", target, target)
+	}
+	if width < old {
+		// h_abc -> h_ab: prepend the cut chars
+		target := key[:width]
+		return []string{fmt.Sprintf("INSERT INTO `h_%s` (hash, fsize, stat) SELECT CONCAT('%s', hash), fsize, stat FROM `h_%s`%s", target, key[width:], key, upsert(target))}
+	}
+	// h_ab -> h_ab0..h_abf: split by the first chars of the stored rest
+	var queries []string
+	for _, ext := range shard_keys(width - old) {
+		target := key + ext
+		queries = append(queries, fmt.Sprintf("INSERT INTO `h_%s` (hash, fsize, stat) SELECT SUBSTRING(hash, %d), fsize, stat FROM `h_%s` WHERE hash LIKE '%s%%'%s", target, len(ext)+1, key, ext, upsert(target)))
+	}
+	return queries
+} // end func migrate_queries
+
+func WatchSchema(db *sql.DB, interval time.Duration, stop chan struct{}) {
+	// reloads the schema every interval so a migration run by another process is noticed
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := LoadSchema(db); err != nil {
+				log.Printf("ERROR overview.WatchSchema err='%v'", err)
+			}
+		} // end select
+	} // end for
+} // end func WatchSchema
@@ -0,0 +1,301 @@
+package overview
+
+/*
+ * MsgidHashStore abstracts the msgidhash tables
+ *
+ *   NewMySQLStore(db)   the h_xxx tables, sharded by the first ShardWidth() hex chars (see msgidhash_schema.go)
+ *   NewSQLiteStore(db)  one table in a sqlite database, db is opened by the caller
+ *                       with a sqlite driver, e.g. sql.Open("sqlite", "/ov/msgidhash.db")
+ *   OpenKVStore(file)   embedded append log, no database server needed
+ *
+ * a stat is one ArticleStatus letter set by SetStat,
+ * size 0 means the article was never stored.
+ */
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/go-while/go-utils"
+	"log"
+)
+
+// MsgidHashStore keeps msgidhashs with size and stat
+type MsgidHashStore interface {
+	Insert(msgidhash string, size int) (bool, error) // true if inserted, false if exists
+	InsertMany(list []Msgidhash_item) error          // ignores existing hashs
+	Lookup(msgidhash string) (found bool, stat string, err error)
+	SetStat(msgidhash string, stat string) (bool, error)                 // inserts without size if missing
+	ClearStat(stat string) (int64, error)                                // deletes hashs without size having stat
+	Iterate(fn func(msgidhash string, size int, stat string) bool) error // stops when fn returns false
+	Close() error
+}
+
+func check_msgidhash(msgidhash string) error {
+	if len(msgidhash) != 64 { // printhashsql
+		return fmt.Errorf("ERROR overview.MsgidHashStore len(messageidhash)=%d != 64", len(msgidhash))
+	}
+	return nil
+} // end func check_msgidhash
+
+func check_size(msgidhash string, size int) error {
+	// only SetStat inserts a hash without size
+	if size <= 0 {
+		return fmt.Errorf("ERROR overview.MsgidHashStore size=%d hash='%s'", size, msgidhash)
+	}
+	return nil
+} // end func check_size
+
+func check_stat(stat string) error {
+	if st, err := ParseArticleStatus(stat); err != nil || !st.Valid() {
+		return fmt.Errorf("ERROR overview.MsgidHashStore invalid stat='%s'", stat)
+	}
+	return nil
+} // end func check_stat
+
+func StoreViewStat(store MsgidHashStore) func(msgid string) string {
+	// returns a ViewPolicy.Stat func reading the stat from store, cached like MySQLViewStat
+	return cached_view_stat(func(msgid string) (string, error) {
+		_, stat, err := store.Lookup(utils.Hash256(msgid))
+		return stat, err
+	})
+} // end func StoreViewStat
+
+// MySQLStore uses the h_xxx tables through the MsgIDhash2mysql funcs
+type MySQLStore struct {
+	db *sql.DB
+}
+
+func NewMySQLStore(db *sql.DB) *MySQLStore {
+	return &MySQLStore{db: db}
+} // end func NewMySQLStore
+
+func (s *MySQLStore) Insert(msgidhash string, size int) (bool, error) {
+	if err := check_size(msgidhash, size); err != nil {
+		return false, err
+	}
+	return MsgIDhash2mysql(msgidhash, size, s.db)
+}
+
+func (s *MySQLStore) InsertMany(list []Msgidhash_item) error {
+	// check all items before the first insert
+	// does not retry, HashWriter retries lock wait timeouts and deadlocks
+	bykey := make(map[string][]Msgidhash_item)
+	width := write_width()
+	for _, item := range list {
+		if err := check_msgidhash(item.Hash); err != nil {
+			return err
+		}
+		if err := check_size(item.Hash, item.Size); err != nil {
+			return err
+		}
+		key := item.Hash[0:width] // printhashsql cut first N chars
+		bykey[key] = append(bykey[key], item)
+	}
+	for key, items := range bykey {
+		if err := insert_many(key, items, s.db); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MySQLStore) Lookup(msgidhash string) (bool, string, error) {
+	found, _, stat, err := IsMsgidHashSQL(msgidhash, s.db)
+	return found, stat, err
+}
+
+func (s *MySQLStore) SetStat(msgidhash string, stat string) (bool, error) {
+	if err := check_msgidhash(msgidhash); err != nil {
+		return false, err
+	}
+	return MsgIDhash2mysqlStat(msgidhash, stat, s.db)
+}
+
+func (s *MySQLStore) ClearStat(stat string) (int64, error) {
+	if err := check_stat(stat); err != nil {
+		return 0, err
+	}
+	var deleted int64
+	for _, width := range shard_widths() {
+		for _, key := range shard_keys(width) {
+			res, err := s.db.Exec("DELETE FROM h_"+key+" WHERE fsize IS NULL AND stat = ?", stat)
+			if err != nil {
+				log.Printf("ERROR overview.MySQLStore.ClearStat table='h_%s' stat='%s' err='%v'", key, stat, err)
+				return deleted, err
+			}
+			if n, err := res.RowsAffected(); err == nil {
+				deleted += n
+			}
+		}
+	}
+	return deleted, nil
+}
+
+func (s *MySQLStore) Iterate(fn func(msgidhash string, size int, stat string) bool) error {
+	// while migrating a hash can show up twice
+	for _, width := range shard_widths() {
+		if more, err := s.iterate(width, fn); err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MySQLStore) iterate(width int, fn func(msgidhash string, size int, stat string) bool) (bool, error) {
+	// returns false if fn stopped
+	for _, key := range shard_keys(width) {
+		rows, err := s.db.Query("SELECT hash, fsize, stat FROM h_" + key)
+		if err != nil {
+			return false, err
+		}
+		for rows.Next() {
+			var hash string
+			var size sql.NullInt64
+			var stat sql.NullString
+			if err := rows.Scan(&hash, &size, &stat); err != nil {
+				rows.Close()
+				return false, err
+			}
+			if !fn(key+hash, int(size.Int64), stat.String) { // printhashsql cut first N chars
+				rows.Close()
+				return false, nil
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (s *MySQLStore) Close() error {
+	return s.db.Close()
+}
+
+// SQLiteStore keeps all hashs in one table "msgidhash"
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+func NewSQLiteStore(db *sql.DB) (*SQLiteStore, error) {
+	// creates the table if missing
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS msgidhash (hash TEXT PRIMARY KEY, fsize INTEGER, stat TEXT) WITHOUT ROWID"); err != nil {
+		log.Printf("ERROR overview.NewSQLiteStore create table err='%v'", err)
+		return nil, err
+	}
+	return &SQLiteStore{db: db}, nil
+} // end func NewSQLiteStore
+
+func (s *SQLiteStore) Insert(msgidhash string, size int) (bool, error) {
+	if err := check_msgidhash(msgidhash); err != nil {
+		return false, err
+	}
+	if err := check_size(msgidhash, size); err != nil {
+		return false, err
+	}
+	res, err := s.db.Exec("INSERT OR IGNORE INTO msgidhash (hash, fsize) VALUES (?,?)", msgidhash, size)
+	if err != nil {
+		return false, err
+	}
+	rowCnt, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowCnt == 1, nil
+}
+
+func (s *SQLiteStore) InsertMany(list []Msgidhash_item) error {
+	// inserts list in one transaction
+	for _, item := range list {
+		if err := check_msgidhash(item.Hash); err != nil {
+			return err
+		}
+		if err := check_size(item.Hash, item.Size); err != nil {
+			return err
+		}
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare("INSERT OR IGNORE INTO msgidhash (hash, fsize) VALUES (?,?)")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, item := range list {
+		if _, err := stmt.Exec(item.Hash, item.Size); err != nil {
+			stmt.Close()
+			tx.Rollback()
+			return err
+		}
+	}
+	stmt.Close()
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) Lookup(msgidhash string) (bool, string, error) {
+	var stat sql.NullString
+	if err := s.db.QueryRow("SELECT stat FROM msgidhash WHERE hash = ?", msgidhash).Scan(&stat); err != nil {
+		if err == sql.ErrNoRows {
+			return false, "", nil
+		}
+		return false, "", err
+	}
+	return true, stat.String, nil
+}
+
+func (s *SQLiteStore) SetStat(msgidhash string, stat string) (bool, error) {
+	if err := check_msgidhash(msgidhash); err != nil {
+		return false, err
+	}
+	if err := check_stat(stat); err != nil {
+		return false, err
+	}
+	res, err := s.db.Exec("INSERT INTO msgidhash (hash, stat) VALUES (?,?) ON CONFLICT(hash) DO UPDATE SET stat = excluded.stat", msgidhash, stat)
+	if err != nil {
+		return false, err
+	}
+	rowCnt, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowCnt == 1, nil
+}
+
+func (s *SQLiteStore) ClearStat(stat string) (int64, error) {
+	if err := check_stat(stat); err != nil {
+		return 0, err
+	}
+	res, err := s.db.Exec("DELETE FROM msgidhash WHERE fsize IS NULL AND stat = ?", stat)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *SQLiteStore) Iterate(fn func(msgidhash string, size int, stat string) bool) error {
+	rows, err := s.db.Query("SELECT hash, fsize, stat FROM msgidhash")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash string
+		var size sql.NullInt64
+		var stat sql.NullString
+		if err := rows.Scan(&hash, &size, &stat); err != nil {
+			return err
+		}
+		if !fn(hash, int(size.Int64), stat.String) {
+			return nil
+		}
+	}
+	return rows.Err()
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
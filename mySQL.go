@@ -2,77 +2,40 @@ package overview
 
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"os"
 	"time"
-	"math/rand"
 	"strings"
 	"sync"
 	"database/sql"
-	"github.com/go-while/go-utils"
-	"github.com/go-sql-driver/mysql"
 )
 
 var (
 	Psql = 256 // parallel sql threads
-	Flushmax = 4096 // * 16^idx = max cached to flush
-	idx = 3 // hardcoded
+	Flushmax = 4096 // * 16^ShardWidth() = max cached to flush
+	PROCESS_HASH2SQL_IDLE = 5*time.Second // ProcessHash2sql returns after done and this long without input
 	cs = "0123456789abcdef"
 )
 
 func PrintHashMySQL(printrocksdb bool) {
-	fmt.Println("# mySQL setup to fill database msgidhash  with tables h_0__ - h_f__")
+	// prints the setup for ShardWidth(), CreateSchema creates it through a connection
+	width := ShardWidth()
+	fmt.Printf("# mySQL setup to fill database msgidhash  with tables h_%s - h_%s\n", strings.Repeat("0", width), strings.Repeat("f", width))
+	engine := "InnoDB"
 	if !printrocksdb {
 		fmt.Println("CREATE DATABASE IF NOT EXISTS `msgidhash` DEFAULT CHARACTER SET latin1 COLLATE latin1_general_ci;")
 	} else {
+		engine = "RocksDB"
 		fmt.Println("CREATE DATABASE IF NOT EXISTS `msgidhash` DEFAULT CHARACTER SET latin1 COLLATE latin1_bin;")
 	}
 	fmt.Println("USE `msgidhash`;")
-
-	 // NOTE: to change tables to use idx 1-3 search overview for "printhashsql" and edit all "0:2" and "2:" to 3!
-	for _, c1 := range cs {
-		if idx == 1 {
-			if !printrocksdb {
-				innodb := fmt.Sprintf("CREATE TABLE `h_%s` (  `hash` char(63) NOT NULL,  `fsize` int(11) DEFAULT NULL,  `stat` char(1) DEFAULT NULL) ENGINE=InnoDB DEFAULT CHARSET=latin1 COLLATE=latin1_general_ci;", string(c1))
-				fmt.Println(innodb)
-			} else {
-				rocksd := fmt.Sprintf("CREATE TABLE `h_%s` (  `hash` char(63) NOT NULL,  `fsize` int(11) DEFAULT NULL,  `stat` char(1) DEFAULT NULL) ENGINE=RocksDB DEFAULT CHARSET=latin1 COLLATE=latin1_bin;", string(c1))
-				fmt.Println(rocksd)
-			}
-			alters := fmt.Sprintf("ALTER TABLE `h_%s`  ADD PRIMARY KEY (`hash`);", string(c1))
-			fmt.Println(alters)
-			continue
-		}
-		for _, c2 := range cs {
-			if idx == 2 {
-				if !printrocksdb {
-					innodb := fmt.Sprintf("CREATE TABLE `h_%s%s` (  `hash` char(62) NOT NULL,  `fsize` int(11) DEFAULT NULL,  `stat` char(1) DEFAULT NULL) ENGINE=InnoDB DEFAULT CHARSET=latin1 COLLATE=latin1_general_ci;", string(c1), string(c2))
-					fmt.Println(innodb)
-				} else {
-					rocksd := fmt.Sprintf("CREATE TABLE `h_%s%s` (  `hash` char(62) NOT NULL,  `fsize` int(11) DEFAULT NULL,  `stat` char(1) DEFAULT NULL) ENGINE=RocksDB DEFAULT CHARSET=latin1 COLLATE=latin1_bin;", string(c1), string(c2))
-					fmt.Println(rocksd)
-				}
-				alters := fmt.Sprintf("ALTER TABLE `h_%s%s`  ADD PRIMARY KEY (`hash`);", string(c1), string(c2))
-				fmt.Println(alters)
-				continue
-			}
-			for _, c3 := range cs {
-				if idx == 3 {
-					if !printrocksdb {
-						innodb := fmt.Sprintf("CREATE TABLE `h_%s%s%s` (  `hash` char(61) NOT NULL,  `fsize` int(11) DEFAULT NULL,  `stat` char(1) DEFAULT NULL) ENGINE=InnoDB DEFAULT CHARSET=latin1 COLLATE=latin1_general_ci;", string(c1), string(c2), string(c3))
-						fmt.Println(innodb)
-					} else {
-						rocksd := fmt.Sprintf("CREATE TABLE `h_%s%s%s` (  `hash` char(61) NOT NULL,  `fsize` int(11) DEFAULT NULL,  `stat` char(1) DEFAULT NULL) ENGINE=RocksDB DEFAULT CHARSET=latin1 COLLATE=latin1_bin;", string(c1), string(c2), string(c3))
-						fmt.Println(rocksd)
-					}
-					alters := fmt.Sprintf("ALTER TABLE `h_%s%s%s`  ADD PRIMARY KEY (`hash`);", string(c1), string(c2), string(c3))
-					fmt.Println(alters)
-				}
-			}
-		}
+	fmt.Println("CREATE TABLE IF NOT EXISTS `msgidhash_meta` (`k` varchar(32) NOT NULL, `v` varchar(255) NOT NULL, PRIMARY KEY (`k`)) ENGINE=InnoDB DEFAULT CHARSET=latin1;")
+	for _, key := range shard_keys(width) {
+		fmt.Println(shard_create_sql(key, engine))
 	}
-}
+	fmt.Printf("INSERT INTO `msgidhash_meta` (k, v) VALUES ('version', '%d'), ('shardwidth', '%d');\n", SCHEMA_VERSION, width)
+} // end func PrintHashMySQL
 
 func ConnSQL(username string, password string, hostname string, database string) (*sql.DB, error) {
 	params := "?timeout=86400s"
@@ -91,31 +54,36 @@ func ConnSQL(username string, password string, hostname string, database string)
 	return db, nil
 } // end func connSQL
 
-func ShortMsgIDhash2mysql(shorthash string, offset int, db *sql.DB) (bool, error) {
-	return false, nil
-} // end func ShortMsgIDhash2mysql
-
 func MsgIDhash2mysql(messageidhash string, size int, db *sql.DB) (bool, error) {
 	if len(messageidhash) != 64 || size == 0 {
 		return false, fmt.Errorf("ERROR overview.MsgIDhash2mysql len(messageidhash)=%d != 64 || size=%d", len(messageidhash), size)
 	}
 
-	//tablename := "h_"+string(messageidhash[0:2])
-	stmt, err := db.Prepare("INSERT INTO h_"+string(messageidhash[0:idx])+" (hash, fsize) VALUES (?,?)"); // printhashsql cut first N chars
+	width := write_width()
+	stmt, err := db.Prepare("INSERT INTO h_"+string(messageidhash[0:width])+" (hash, fsize) VALUES (?,?)"); // printhashsql cut first N chars
 	if err != nil {
 		log.Printf("ERROR overview.MsgIDhash2mysql db.Prepare() err='%v'", err)
 		return false, err
 	}
 	defer stmt.Close()
-	if res, err := stmt.Exec(messageidhash[idx:], size); err != nil { // printhashsql cut first N chars
+	if res, err := stmt.Exec(messageidhash[width:], size); err != nil { // printhashsql cut first N chars
 		//log.Printf("ERROR overview.MsgIDhash2mysql stmt.Exec() err='%v'", err)
 		return false, err
 	} else {
+		if OV_MsgidBloom != nil {
+			OV_MsgidBloom.Add(messageidhash)
+		}
 		if rowCnt, err := res.RowsAffected(); err != nil {
 			log.Printf("ERROR overview.MsgIDhash2mysql res.RowsAffected() err='%v'", err)
 			return false, err
 		} else {
 			if rowCnt == 1 {
+				if width != ShardWidth() {
+					// migrating: may exist in the old tables
+					if found, _, err := shard_lookup(messageidhash, ShardWidth(), db); err != nil || found {
+						return false, err
+					}
+				}
 				return true, nil // inserted
 			}
 			return false, nil // duplicate
@@ -125,22 +93,27 @@ func MsgIDhash2mysql(messageidhash string, size int, db *sql.DB) (bool, error) {
 } // end func MsgIDhash2mysql
 
 func MsgIDhash2mysqlStat(messageidhash string, stat string, db *sql.DB) (bool, error) {
-	if len(stat) != 1 {
-		return false, fmt.Errorf("ERROR overview.MsgIDhash2mysqlStat len(stat)=%d != 1", len(stat))
+	if st, err := ParseArticleStatus(stat); err != nil || !st.Valid() {
+		return false, fmt.Errorf("ERROR overview.MsgIDhash2mysqlStat invalid stat='%s'", stat)
+	}
+	if len(messageidhash) != 64 { // printhashsql
+		return false, fmt.Errorf("ERROR overview.MsgIDhash2mysqlStat len(messageidhash)=%d != 64", len(messageidhash))
 	}
 
-	//tablename := "h_"+string(messageidhash[0:2])
-	//query := "INSERT INTO h_"+string(messageidhash[0:2])+" (hash, fsize) VALUES (?,?)"
-	stmt, err := db.Prepare("INSERT INTO h_"+string(messageidhash[0:idx])+" (hash, stat) VALUES (?,?) ON DUPLICATE KEY UPDATE stat = ?"); // printhashsql cut first N chars
+	width := write_width()
+	stmt, err := db.Prepare("INSERT INTO h_"+string(messageidhash[0:width])+" (hash, stat) VALUES (?,?) ON DUPLICATE KEY UPDATE stat = ?"); // printhashsql cut first N chars
 	if err != nil {
 		log.Printf("ERROR overview.MsgIDhash2mysqlStat db.Prepare() err='%v'", err)
 		return false, err
 	}
 	defer stmt.Close()
-	if res, err := stmt.Exec(messageidhash[3:], stat, stat); err != nil { // printhashsql cut first N chars
+	if res, err := stmt.Exec(messageidhash[width:], stat, stat); err != nil { // printhashsql cut first N chars
 		//log.Printf("ERROR overview.MsgIDhash2mysqlStat stmt.Exec() err='%v'", err)
 		return false, err
 	} else {
+		if OV_MsgidBloom != nil {
+			OV_MsgidBloom.Add(messageidhash)
+		}
 		if rowCnt, err := res.RowsAffected(); err != nil {
 			log.Printf("ERROR overview.MsgIDhash2mysqlStat res.RowsAffected() err='%v'", err)
 			return false, err
@@ -155,116 +128,89 @@ func MsgIDhash2mysqlStat(messageidhash string, stat string, db *sql.DB) (bool, e
 } // end func MsgIDhash2mysqlStat
 
 func MsgIDhash2mysqlMany(key string, list []Msgidhash_item, db *sql.DB, tried int) (bool, error) {
-	if len(list) == 0 {
-		return false, fmt.Errorf("ERROR overview.MsgIDhash2mysqlMany key=%s list empty", key)
+	// inserts list into h_key, retries lock wait timeouts and deadlocks with backoff
+	// tried counts retries already done by the caller
+	cfg := HashWriterConfig{MaxRetries: 15 - tried, BackoffBase: time.Second, BackoffMax: 60 * time.Second}
+	insert := func() error { return insert_many(key, list, db) }
+	if err := insert_retry(context.Background(), key, insert, cfg); err != nil {
+		log.Printf("ERROR overview.MsgIDhash2mysqlMany key=%s list=%d err='%v'", key, len(list), err)
+		return false, err
 	}
-	if tried > 15 {
-		log.Printf("ERROR MsgIDhash2mysqlMany tried=%d")
-		os.Exit(1)
+	return true, nil
+} // end func MsgIDhash2mysqlMany
+
+func insert_many(key string, list []Msgidhash_item, db *sql.DB) error {
+	if len(list) == 0 {
+		return fmt.Errorf("ERROR overview.MsgIDhash2mysqlMany key=%s list empty", key)
 	}
 	var vals []interface{}
 
 	query := "INSERT IGNORE INTO h_"+key+" (hash, fsize) VALUES "
 	for i, item := range list {
-		if len(item.Hash) != 64 || item.Size <= 0 { // printhashsql
-			log.Printf("ERROR overview.MsgIDhash2mysqlMany item='%#v' len(list)=%d i=%d key=%s", item, len(list), i , key)
-			os.Exit(1)
+		if len(item.Hash) != 64 || item.Size <= 0 || item.Hash[:len(key)] != key { // printhashsql
+			return fmt.Errorf("ERROR overview.MsgIDhash2mysqlMany item='%#v' len(list)=%d i=%d key=%s", item, len(list), i , key)
 		}
 		query += "(?,?),"
-		vals = append(vals, string(item.Hash[3:]), item.Size) // printhashsql cut first N chars
+		vals = append(vals, string(item.Hash[len(key):]), item.Size) // printhashsql cut first N chars
 	}
 	query = strings.TrimSuffix(query, ",")
 	stmt, err := db.Prepare(query);
 	if err != nil {
 		log.Printf("ERROR overview.MsgIDhash2mysqlMany db.Prepare() key=%s err='%v'", key, err)
-		return false, err
+		return err
 	}
 	defer stmt.Close()
-	if _, sqlerr := stmt.Exec(vals...); sqlerr != nil {
-		if driverErr, isErr := sqlerr.(*mysql.MySQLError); isErr {
-			retry := false
-			switch driverErr.Number {
-				case 1205:
-					// Lock wait timeout exceeded; try restarting transaction
-					retry = true
-				case 1213:
-					// Deadlock found when trying to get lock; try restarting transaction
-					retry = true
-			}
-			if retry {
-				isleep := time.Duration(rand.Intn(60))*time.Second
-				if isleep < 5 {
-					isleep = 5
-				}
-				time.Sleep(isleep)
-				tried++
-				return MsgIDhash2mysqlMany(key, list, db, tried)
-			}
-			log.Printf("overview.MsgIDhash2mysqlMany driverErr='%v' num=%d sqlerr='%v'", driverErr, driverErr.Number, sqlerr)
+	if _, err := stmt.Exec(vals...); err != nil {
+		return err
+	}
+	if OV_MsgidBloom != nil {
+		for _, item := range list {
+			OV_MsgidBloom.Add(item.Hash)
 		}
-		return false, err
 	}
 	//log.Printf("OK MsgIDhash2mysqlMany key=%s list=%d", key, len(list))
-	return true, nil
-} // end func MsgIDhash2mysqlMany
+	return nil
+} // end func insert_many
 
 func IsMsgidHashSQL(messageidhash string, db *sql.DB) (bool, bool, string, error) {
 
 	if len(messageidhash) != 64 { // printhashsql
 		return false, false, "", fmt.Errorf("ERROR overview.IsMsgidHashSQL len(messageidhash) != 64")
 	}
-	var stat sql.NullString
-	if err := db.QueryRow("SELECT stat FROM "+"h_"+string(messageidhash[0:idx])+" WHERE hash = ? LIMIT 1", messageidhash[idx:]).Scan(&stat); err != nil { // printhashsql cut first N chars
-		if err == sql.ErrNoRows {
-			return false, false, "", nil
+	bloom := OV_MsgidBloom
+	if bloom.Ready() && !bloom.Test(messageidhash) {
+		return short_dupe_check(messageidhash) // never inserted in h_xxx
+	}
+	for _, width := range shard_widths() {
+		found, stat, err := shard_lookup(messageidhash, width, db)
+		if err != nil {
+			log.Printf("ERROR overview.IsMsgidHashSQL err='%v'", err)
+			return false, false, "", err
+		}
+		if found {
+			var drop bool
+			if stat.Valid && len(stat.String) == 1 {
+				drop = true
+			}
+			return true, drop, stat.String, nil
 		}
-		log.Printf("ERROR overview.IsMsgidHashSQL err='%v'", err)
-		return false, false, "", err
 	}
-	var drop bool
-	if stat.Valid && len(stat.String) == 1 {
-		drop = true
+	if bloom.Ready() {
+		bloom.false_positive()
 	}
-	return true, drop, stat.String, nil
+	return short_dupe_check(messageidhash)
 } // end func IsMsgidHashSQL
 
-func ClearStat(stat string, db *sql.DB) (error) {
-	/*
-	 * SELECT *  FROM `h_00a` WHERE
-	 * 		`stat` is not NULL AND
-	 * 		`stat` != 'b' AND
-	 * 		`stat` != 'z' AND
-	 * 		`stat` != 'x' AND
-	 * 		`stat` != 'o' AND
-	 * 		`stat` != 'h'
-	 * 		ORDER BY `stat` DESC;
-	*/
-	deleted := 0
-	start := utils.UnixTimeMilliSec()
-	for _, c1 := range cs {
-		for _, c2 := range cs {
-			for _, c3 := range cs {
-				table := string(c1)+string(c2)+string(c3)
-				query := "DELETE FROM "+"h_"+table+" WHERE fsize is NULL and stat = "+stat
-				res, err := db.Exec(query)
-				if err != nil {
-					log.Printf("ERROR overview.ClearStat stat='%s' err='%v'", stat, err)
-					return err
-				}
-				rowCnt, err := res.RowsAffected()
-				if err != nil {
-					log.Printf("ERROR overview.ClearStat stat='%s' res.RowsAffected() err='%v'", stat, err)
-					return err
-				}
-				log.Printf("ClearStat stat='%s' table='h_%s%s%s' deleted=%d", stat, table, rowCnt)
-				deleted++
-			}
+func shard_lookup(messageidhash string, width int, db *sql.DB) (bool, sql.NullString, error) {
+	var stat sql.NullString
+	if err := db.QueryRow("SELECT stat FROM "+"h_"+string(messageidhash[0:width])+" WHERE hash = ? LIMIT 1", messageidhash[width:]).Scan(&stat); err != nil { // printhashsql cut first N chars
+		if err == sql.ErrNoRows {
+			return false, stat, nil
 		}
+		return false, stat, err
 	}
-	took := utils.UnixTimeMilliSec() - start
-	log.Printf("ClearStat stat='%s' deleted=%d took=(%d ms)", stat, deleted, took)
-	return nil
-} // end func IsMsgidHashSQL
+	return true, stat, nil
+} // end func shard_lookup
 
 /*
 func IsMsgidSQL(messageid string, db *sql.DB) (bool, bool, string, error) {
@@ -288,158 +234,44 @@ func IsMsgidSQL(messageid string, db *sql.DB) (bool, bool, string, error) {
 } // end func IsMsgidHashSQL
 */
 
-	/*
-	switch stat.String {
-		case "a":
-			// abuse takedown
-			drop = true
-		case "b":
-			// banned / no accepted newsgroups
-			drop = true
-		case "c":
-			// cancel
-			drop = true
-		case "d":
-			// to delete
-			drop = true
-		case "e":
-			// expired
-			drop = true
-		case "f":
-			// filtered by cleanfeed
-			drop = true
-		case "g":
-			// group removed
-			drop = true
-		case "h":
-			// bad/nil head/body
-			drop = true
-		case "n":
-			// nocem
-			drop = true
-		case "o":
-			// bad header overview checksum
-			drop = true
-		case "p":
-			// filtered by pyClean
-			drop = true
-		case "r":
-			// removed by overview spamfilter
-			drop = true
-		case "s":
-			// filtered by spam assasin
-			drop = true
-		case "x":
-			// crosspost
-			drop = true
-		case "z":
-			// prefetch/proxy/binary filter
-			drop = true
-	}
-	*/
 
 func ProcessHash2sql(dbh *sql.DB, hash2sql *chan map[string][]Msgidhash_item, donechan *chan struct{}, sqldonechan *chan struct{}, sqlparchan *chan struct{}, wg *sync.WaitGroup) {
+	// Deprecated: use NewHashWriter and pass &hw.In to Rescan_Overview.
+	// forwards hash2sql to a HashWriter until donechan is signaled and hash2sql was idle
+	// for PROCESS_HASH2SQL_IDLE, sqlparchan only sets the parallelism.
 	defer dbh.Close()
 	wg.Add(1)
 	defer wg.Done()
-	done := false
-
-	waited, dupes, flushed := 0, 0, 0
-	tmpmap := make(map[string]map[string]Msgidhash_item, Flushmax) // key, msgidhash, size
-	start := utils.UnixTimeSec()
+	hw := NewHashWriter(context.Background(), NewMySQLStore(dbh), HashWriterConfig{Parallel: cap(*sqlparchan)})
+	go func() {
+		for err := range hw.Errors() {
+			log.Printf("ERROR process_hash2sql err='%v'", err)
+		}
+	}()
+	var idle <-chan time.Time // set after done
 	process_hash2sql:
 	for {
 		select {
 			case <- *donechan:
-				done = true
+				donechan = nil_chan()
+				idle = time.After(PROCESS_HASH2SQL_IDLE)
 			case hashmap := <- *hash2sql:
-				waited = 0
-				for key, items := range hashmap {
-					tryflush1 := len(tmpmap[key]) >= Flushmax/4
-					tryflush2 := len(*sqlparchan) > Psql/2
-					tryrand := rand.Intn(1000) <= 20 // flush 2% early?
-					flushnow := (tryflush1 && tryrand) || (tryflush1 && tryflush2)
-					forceflush := len(tmpmap[key]) >= Flushmax
-					if flushnow || forceflush {
-						//if flushnow {
-						//	log.Printf("process_hash2sql flushnow=%d", len(tmpmap[key]))
-						//}
-						// tmpmap for key is big! push to sql first
-						var list []Msgidhash_item
-						for _, item := range tmpmap[key] {
-							if len(item.Hash) == 64 && item.Size > 0 {
-								list = append(list, item)
-							} else {
-								log.Printf("WARN process_hash2sql got nil-hash item?")
-							}
-						}
-						<- *sqlparchan
-						wg.Add(1)
-						go func(key string, list []Msgidhash_item, dbh *sql.DB, sqlparchan *chan struct{}) {
-							//log.Printf("hash2sql key=%s flushing=%d list=%d", key, len(tmpmap[key]), len(list))
-							//startms := utils.UnixTimeMilliSec()
-							if retbool, sqlerr := MsgIDhash2mysqlMany(key, list, dbh, 0); sqlerr != nil || !retbool {
-								log.Printf("ERROR process_hash2sql tmpmap sqlerr='%v'", sqlerr)
-								os.Exit(1)
-							}
-							//log.Printf("hash2sql flushed=%d key=%s took=(%d ms)", len(list), key, utils.UnixTimeMilliSec()-startms)
-							*sqlparchan <- struct{}{}
-							wg.Done()
-						}(key, list, dbh, sqlparchan)
-
-						flushed += len(list)
-						// reset tmpmap
-						tmpmap[key] = make(map[string]Msgidhash_item, Flushmax)
-						list = nil
-					}
-					// merge items / dedupe up to Flushmax
-					for _, item := range items {
-						if tmpmap[key] == nil {
-							tmpmap[key] = make(map[string]Msgidhash_item, Flushmax)
-						}
-						if tmpmap[key][item.Hash].Size > 0 {
-							dupes++
-							continue
-						}
-						tmpmap[key][item.Hash] = item
-					} // end for item in items
-				} // end for items in hashmap
-				hashmap = nil
-
-			default:
-				time.Sleep(10*time.Millisecond)
-				if done {
-					waited++
-					if waited >= 6000 { // 60s
-						var keys []string
-						for key, _ := range tmpmap {
-							keys = append(keys, key)
-						}
-						for _, key := range keys {
-							var list []Msgidhash_item
-							for _, item := range tmpmap[key] {
-								list = append(list, item)
-							}
-							wg.Add(1)
-							go func(key string, list []Msgidhash_item, dbh *sql.DB, sqlparchan *chan struct{}) {
-								<- *sqlparchan
-								//log.Printf("hash2sql key=%s flushing=%d list=%d", key, len(tmpmap[key]), len(list))
-								if retbool, sqlerr := MsgIDhash2mysqlMany(key, list, dbh, 0); sqlerr != nil || !retbool {
-									log.Printf("ERROR process_hash2sql tmpmap sqlerr='%v'", sqlerr)
-									os.Exit(1)
-								}
-								//log.Printf("hash2sql flushed=%d key=%s took=(%d ms)", len(list), key, utils.UnixTimeMilliSec()-startms)
-								*sqlparchan <- struct{}{}
-								wg.Done()
-							}(key, list, dbh, sqlparchan)
-							flushed += len(list)
-							list = nil
-						}
-						break process_hash2sql
-					}
+				hw.Add(hashmap)
+				if idle != nil {
+					idle = time.After(PROCESS_HASH2SQL_IDLE)
 				}
+			case <- idle:
+				break process_hash2sql
 		} // end select
 	} // end for process_hash2sql
+	err := hw.Close()
 	*sqldonechan <- struct{}{}
-	log.Printf("process_hash2sql returned flushed=%d dupes=%d rt=(%d s)", flushed, dupes, utils.UnixTimeSec()-start)
+	flushed, dupes := hw.Stats()
+	log.Printf("process_hash2sql returned flushed=%d dupes=%d err='%v'", flushed, dupes, err)
 } // end ProcessHash2sql
+
+func nil_chan() *chan struct{} {
+	// a receive from a nil channel blocks forever, select ignores it
+	var ch chan struct{}
+	return &ch
+} // end func nil_chan
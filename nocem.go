@@ -0,0 +1,529 @@
+package overview
+
+/*
+ * NoCeM notice processing
+ *
+ * a NoCeM notice is a clearsigned message listing msgids and their groups:
+ *
+ *   @@BEGIN NCM HEADERS
+ *   Version: 0.93
+ *   Issuer: nocem@example.invalid
+ *   Type: spam
+ *   Action: hide
+ *   Count: 2
+ *   Notice-ID: nocem.1234
+ *   @@BEGIN NCM BODY
+ *   <spam1@example.invalid> alt.test misc.test
+ *   <spam2@example.invalid> alt.test
+ *   @@END NCM BODY
+ *
+ * the signature is checked against the local keyring (LoadKeyring, no key fetching)
+ * and the Issuer has to be an email of the signing key.
+ *
+ * Mode "hide": listed msgids get VerdictHide from NoCeM.Check,
+ *   add the processor to ViewChain or a ViewPolicy.Filters.
+ * Mode "tombstone": the msgid of listed lines in Cachedir gets overwritten
+ *   with 'X' and Scan_Overview skips them. line length and Index stay valid.
+ *
+ * with HashStore set both modes give the msgidhashs stat 'n',
+ * a ViewPolicy with HideStats "n" keeps hiding them after a restart.
+ *
+ * LoadState(file) loads the hidden msgids and applied Notice-IDs of earlier runs
+ * and appends every applied notice to file, a restart does not apply it again.
+ * a notice counts as applied only if tombstoning and SetStat did not fail.
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/go-while/go-utils"
+	"io"
+	"log"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	NOCEM_MAX_NOTICE_SIZE int           = 4 * 1024 * 1024 // bigger notices get rejected
+	NOCEM_STAT            ArticleStatus = StatNoCeM       // msgidhash stat of articles listed in applied notices
+)
+
+// NoCeMNotice is a parsed NoCeM notice
+type NoCeMNotice struct {
+	Version  string
+	Issuer   string
+	Type     string
+	Action   string
+	NoticeID string
+	Count    int
+	Msgids   []string            // unique, in notice order
+	Groups   map[string][]string // key: group, values: msgids listed for this group
+	Signer   string              // key id of the verified signature
+}
+
+// NoCeM verifies and applies NoCeM notices
+type NoCeM struct {
+	mux       sync.RWMutex
+	keyring   openpgp.EntityList
+	hidden    map[string]bool // msgids hidden by Check
+	applied   map[string]bool // Notice-IDs already applied
+	applying  map[string]bool // Notice-IDs in progress
+	statemux  sync.Mutex
+	state     *os.File       // appends applied notices, see LoadState
+	Mode      string         // "hide" or "tombstone"
+	Cachedir  string         // overview dir for Mode "tombstone"
+	HashStore MsgidHashStore // sets NOCEM_STAT if not nil
+	Types     []string       // accepted notice Types, empty accepts all
+}
+
+func NewNoCeM(mode string, cachedir string, store MsgidHashStore) *NoCeM {
+	return &NoCeM{
+		hidden:    make(map[string]bool),
+		applied:   make(map[string]bool),
+		applying:  make(map[string]bool),
+		Mode:      mode,
+		Cachedir:  cachedir,
+		HashStore: store,
+	}
+} // end func NewNoCeM
+
+func (nc *NoCeM) Name() string { return "NoCeM" }
+
+func (nc *NoCeM) Check(ovl *OVL, headers map[string][]string) (Verdict, string) {
+	nc.mux.RLock()
+	hidden := nc.hidden[ovl.Messageid]
+	nc.mux.RUnlock()
+	if hidden {
+		return VerdictHide, "nocem"
+	}
+	return VerdictAccept, ""
+}
+
+func (nc *NoCeM) LoadKeyring(paths ...string) error {
+	// loads public keys, a directory loads all files ending in .asc (armored) or .gpg (binary)
+	// replaces the keyring, a failed load keeps the active keyring
+	var keyring openpgp.EntityList
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		files := []string{path}
+		if fi.IsDir() {
+			entries, err := os.ReadDir(path)
+			if err != nil {
+				return err
+			}
+			files = files[:0]
+			for _, entry := range entries {
+				if ext := filepath.Ext(entry.Name()); !entry.IsDir() && (ext == ".asc" || ext == ".gpg") {
+					files = append(files, filepath.Join(path, entry.Name()))
+				}
+			}
+		}
+		for _, file := range files {
+			keys, err := nocem_read_keys(file)
+			if err != nil {
+				return fmt.Errorf("Error NoCeM.LoadKeyring fp='%s' err='%v'", file, err)
+			}
+			keyring = append(keyring, keys...)
+		}
+	}
+	nc.mux.Lock()
+	nc.keyring = keyring
+	nc.mux.Unlock()
+	log.Printf("NoCeM LoadKeyring paths=%d keys=%d", len(paths), len(keyring))
+	return nil
+} // end func NoCeM.LoadKeyring
+
+func nocem_read_keys(file string) (openpgp.EntityList, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if filepath.Ext(file) == ".gpg" {
+		return openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+	if keys, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data)); err == nil || filepath.Ext(file) == ".asc" {
+		return keys, err
+	}
+	return openpgp.ReadKeyRing(bytes.NewReader(data))
+} // end func nocem_read_keys
+
+func (nc *NoCeM) Verify(data []byte) (*NoCeMNotice, error) {
+	// checks the signature and issuer of a clearsigned notice and parses it
+	if len(data) > NOCEM_MAX_NOTICE_SIZE {
+		return nil, fmt.Errorf("Error NoCeM.Verify notice too big size=%d", len(data))
+	}
+	block, _ := clearsign.Decode(data)
+	if block == nil || block.ArmoredSignature == nil {
+		return nil, fmt.Errorf("Error NoCeM.Verify notice is not clearsigned")
+	}
+	nc.mux.RLock()
+	keyring := nc.keyring
+	nc.mux.RUnlock()
+	if len(keyring) == 0 {
+		return nil, fmt.Errorf("Error NoCeM.Verify empty keyring")
+	}
+	signer, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(block.Bytes), block.ArmoredSignature.Body, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error NoCeM.Verify signature err='%v'", err)
+	}
+	notice, err := ParseNoCeM(block.Plaintext)
+	if err != nil {
+		return nil, err
+	}
+	issuer := nocem_email(notice.Issuer)
+	matched := false
+	for _, identity := range signer.Identities {
+		if identity.UserId != nil && issuer != "" && strings.EqualFold(identity.UserId.Email, issuer) {
+			matched = true
+			break
+		}
+	}
+	if signer.PrimaryKey != nil {
+		notice.Signer = signer.PrimaryKey.KeyIdString()
+	}
+	if !matched {
+		return nil, fmt.Errorf("Error NoCeM.Verify issuer='%s' does not match signer key='%s'", notice.Issuer, notice.Signer)
+	}
+	return notice, nil
+} // end func NoCeM.Verify
+
+func nocem_email(issuer string) string {
+	// returns the address of "name <addr>" or a bare addr
+	if addr, err := mail.ParseAddress(issuer); err == nil {
+		return addr.Address
+	}
+	return strings.Trim(strings.TrimSpace(issuer), "<>")
+} // end func nocem_email
+
+func ParseNoCeM(text []byte) (*NoCeMNotice, error) {
+	// parses the NCM headers and body of a notice without checking a signature
+	notice := &NoCeMNotice{Groups: make(map[string][]string), Count: -1}
+	uniq := make(map[string]bool)
+	r := bufio.NewScanner(bytes.NewReader(text))
+	r.Buffer(make([]byte, 64*1024), NOCEM_MAX_NOTICE_SIZE)
+	const (
+		before = iota
+		headers
+		body
+		end
+	)
+	state := before
+	var msgid string // continuation lines add groups to this msgid
+	lc := 0
+	for r.Scan() {
+		lc++
+		line := strings.TrimRight(r.Text(), "\r")
+		switch {
+		case line == "@@BEGIN NCM HEADERS" && state == before:
+			state = headers
+			continue
+		case line == "@@BEGIN NCM BODY" && state == headers:
+			state = body
+			continue
+		case line == "@@END NCM BODY" && state == body:
+			state = end
+			continue
+		}
+		switch state {
+		case headers:
+			x := strings.SplitN(line, ":", 2)
+			if len(x) != 2 {
+				return nil, fmt.Errorf("Error ParseNoCeM lc=%d bad header line", lc)
+			}
+			value := strings.TrimSpace(x[1])
+			switch strings.ToLower(strings.TrimSpace(x[0])) {
+			case "version":
+				notice.Version = value
+			case "issuer":
+				notice.Issuer = value
+			case "type":
+				notice.Type = value
+			case "action":
+				notice.Action = strings.ToLower(value)
+			case "notice-id":
+				notice.NoticeID = value
+			case "count":
+				count, err := strconv.Atoi(value)
+				if err != nil || count < 0 {
+					return nil, fmt.Errorf("Error ParseNoCeM lc=%d bad Count='%s'", lc, value)
+				}
+				notice.Count = count
+			}
+		case body:
+			if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			fields := strings.Fields(line)
+			if line[0] != ' ' && line[0] != '\t' {
+				if !isvalidmsgid(fields[0], true) {
+					return nil, fmt.Errorf("Error ParseNoCeM lc=%d bad msgid='%s'", lc, fields[0])
+				}
+				msgid, fields = fields[0], fields[1:]
+				if !uniq[msgid] {
+					uniq[msgid] = true
+					notice.Msgids = append(notice.Msgids, msgid)
+				}
+			} else if msgid == "" {
+				return nil, fmt.Errorf("Error ParseNoCeM lc=%d continuation without msgid", lc)
+			}
+			for _, group := range fields {
+				notice.Groups[group] = append(notice.Groups[group], msgid)
+			}
+		}
+	}
+	if err := r.Err(); err != nil {
+		return nil, fmt.Errorf("Error ParseNoCeM err='%v'", err)
+	}
+	switch {
+	case state != end:
+		return nil, fmt.Errorf("Error ParseNoCeM incomplete notice state=%d", state)
+	case notice.Issuer == "" || notice.Type == "" || notice.NoticeID == "":
+		return nil, fmt.Errorf("Error ParseNoCeM missing Issuer, Type or Notice-ID")
+	case notice.Action != "" && notice.Action != "hide":
+		return nil, fmt.Errorf("Error ParseNoCeM unsupported Action='%s'", notice.Action)
+	case notice.Count >= 0 && notice.Count != len(notice.Msgids):
+		return nil, fmt.Errorf("Error ParseNoCeM Count=%d but got msgids=%d", notice.Count, len(notice.Msgids))
+	}
+	return notice, nil
+} // end func ParseNoCeM
+
+func (nc *NoCeM) Process(data []byte) (*NoCeMNotice, int, error) {
+	// verifies and applies a notice, returns the number of hidden or tombstoned lines
+	notice, err := nc.Verify(data)
+	if err != nil {
+		log.Printf("Error OV NoCeM.Process err='%v'", err)
+		return nil, 0, err
+	}
+	n, err := nc.Apply(notice)
+	return notice, n, err
+} // end func NoCeM.Process
+
+func (nc *NoCeM) Apply(notice *NoCeMNotice) (int, error) {
+	// applies a verified notice once per Notice-ID
+	if len(nc.Types) > 0 {
+		accepted := false
+		for _, t := range nc.Types {
+			if strings.EqualFold(t, notice.Type) {
+				accepted = true
+				break
+			}
+		}
+		if !accepted {
+			return 0, fmt.Errorf("Error NoCeM.Apply issuer='%s' type='%s' not accepted", notice.Issuer, notice.Type)
+		}
+	}
+	key := notice.Issuer + "\t" + notice.NoticeID
+	nc.mux.Lock()
+	if nc.applied[key] {
+		nc.mux.Unlock()
+		return 0, nil
+	}
+	if nc.applying[key] {
+		nc.mux.Unlock()
+		return 0, fmt.Errorf("Error NoCeM.Apply issuer='%s' notice='%s' is in progress", notice.Issuer, notice.NoticeID)
+	}
+	nc.applying[key] = true
+	nc.mux.Unlock()
+
+	n, err := nc.apply(notice)
+	if err == nil {
+		err = nc.save_state(key, notice)
+	}
+	nc.mux.Lock()
+	delete(nc.applying, key)
+	if err == nil {
+		nc.applied[key] = true
+	}
+	nc.mux.Unlock()
+	if err != nil {
+		log.Printf("Error OV NoCeM.Apply issuer='%s' notice='%s' err='%v'", notice.Issuer, notice.NoticeID, err)
+		return n, err
+	}
+	log.Printf("NoCeM Apply issuer='%s' notice='%s' type='%s' mode='%s' msgids=%d applied=%d", notice.Issuer, notice.NoticeID, notice.Type, nc.Mode, len(notice.Msgids), n)
+	return n, nil
+} // end func NoCeM.Apply
+
+func (nc *NoCeM) apply(notice *NoCeMNotice) (int, error) {
+	// hides or tombstones the msgids of notice, fails on the first error
+	var n int
+	switch nc.Mode {
+	case "", "hide":
+		nc.mux.Lock()
+		for _, msgid := range notice.Msgids {
+			if !nc.hidden[msgid] {
+				nc.hidden[msgid] = true
+				n++
+			}
+		}
+		nc.mux.Unlock()
+	case "tombstone":
+		if nc.Cachedir == "" {
+			return 0, fmt.Errorf("Error NoCeM.Apply tombstone without Cachedir")
+		}
+		for group, msgids := range notice.Groups {
+			file := nc.Cachedir + "/" + utils.Hash256(group) + ".overview"
+			if !utils.FileExists(file) {
+				continue
+			}
+			t, err := TombstoneOverview(file, msgids)
+			n += t
+			if err != nil {
+				return n, fmt.Errorf("Error NoCeM.Apply group='%s' err='%v'", group, err)
+			}
+		}
+	default:
+		return 0, fmt.Errorf("Error NoCeM.Apply unknown Mode='%s'", nc.Mode)
+	}
+	if nc.HashStore != nil {
+		for _, msgid := range notice.Msgids {
+			if _, err := SetStat(utils.Hash256(msgid), NOCEM_STAT, nc.HashStore); err != nil {
+				return n, fmt.Errorf("Error NoCeM.Apply SetStat msgid='%s' err='%v'", msgid, err)
+			}
+		}
+	}
+	return n, nil
+} // end func NoCeM.apply
+
+func (nc *NoCeM) LoadState(file string) error {
+	// loads hidden msgids and applied Notice-IDs from file and appends new ones to it
+	// lines: "applied\t<issuer>\t<notice-id>" or "hidden\t<msgid>"
+	fh, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	hidden, applied := make(map[string]bool), make(map[string]bool)
+	r := bufio.NewScanner(fh)
+	lc := 0
+	for r.Scan() {
+		lc++
+		x := strings.SplitN(r.Text(), "\t", 2)
+		if len(x) != 2 || x[1] == "" {
+			// a torn last line of a crash, the notice gets applied again
+			log.Printf("Error OV NoCeM.LoadState fp='%s' lc=%d bad line", filepath.Base(file), lc)
+			continue
+		}
+		switch x[0] {
+		case "applied":
+			applied[x[1]] = true
+		case "hidden":
+			hidden[x[1]] = true
+		}
+	}
+	if err := r.Err(); err != nil {
+		fh.Close()
+		return fmt.Errorf("Error NoCeM.LoadState fp='%s' err='%v'", filepath.Base(file), err)
+	}
+	nc.mux.Lock()
+	for msgid := range hidden {
+		nc.hidden[msgid] = true
+	}
+	for key := range applied {
+		nc.applied[key] = true
+	}
+	nc.mux.Unlock()
+	nc.statemux.Lock()
+	if nc.state != nil {
+		nc.state.Close()
+	}
+	nc.state = fh
+	nc.statemux.Unlock()
+	log.Printf("NoCeM LoadState fp='%s' hidden=%d applied=%d", filepath.Base(file), len(hidden), len(applied))
+	return nil
+} // end func NoCeM.LoadState
+
+func (nc *NoCeM) save_state(key string, notice *NoCeMNotice) error {
+	// appends the hidden msgids and then the key of an applied notice to the state file
+	nc.statemux.Lock()
+	defer nc.statemux.Unlock()
+	if nc.state == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	if nc.Mode == "" || nc.Mode == "hide" {
+		for _, msgid := range notice.Msgids {
+			buf.WriteString("hidden\t" + msgid + "\n")
+		}
+	}
+	buf.WriteString("applied\t" + key + "\n")
+	if _, err := nc.state.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("Error NoCeM.save_state err='%v'", err)
+	}
+	return nc.state.Sync()
+} // end func NoCeM.save_state
+
+func (nc *NoCeM) Len() int {
+	// returns the number of hidden msgids
+	nc.mux.RLock()
+	defer nc.mux.RUnlock()
+	return len(nc.hidden)
+} // end func NoCeM.Len
+
+func TombstoneOverview(file string, msgids []string) (int, error) {
+	// overwrites the first char of the msgid field with 'X' on lines listing one of msgids
+	// holds the group lock, returns the number of tombstoned lines
+	hash, err := get_hash_from_filename(file)
+	if err != nil {
+		return 0, err
+	}
+	who := "NoCeM"
+	if err := OV_handler.LockGroup(who, hash); err != nil {
+		return 0, err
+	}
+	defer OV_handler.UnlockGroup(who, hash)
+
+	targets := make(map[string]bool, len(msgids))
+	for _, msgid := range msgids {
+		targets[msgid] = true
+	}
+	fh, err := os.OpenFile(file, os.O_RDWR, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer fh.Close()
+	var offsets []int64
+	r := bufio.NewReaderSize(fh, 1024*1024)
+	var offset int64
+	for lc := 0; ; lc++ {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if len(line) == 0 || line[0] == 0 {
+			// zero-filled space before the footer
+			break
+		}
+		if lc > 0 {
+			datafields := strings.Split(line, "\t")
+			if len(datafields) >= OVERVIEW_FIELDS && targets[datafields[4]] {
+				pos := len(datafields[0]) + len(datafields[1]) + len(datafields[2]) + len(datafields[3]) + 4
+				offsets = append(offsets, offset+int64(pos))
+			}
+		}
+		offset += int64(len(line))
+		if err == io.EOF {
+			break
+		}
+	}
+	if err := tombstone_offsets(fh, offsets); err != nil {
+		return 0, err
+	}
+	if len(offsets) > 0 {
+		if err := fh.Sync(); err != nil {
+			return len(offsets), err
+		}
+	}
+	if DEBUG_OV {
+		log.Printf("TombstoneOverview fp='%s' msgids=%d tombstoned=%d", filepath.Base(file), len(msgids), len(offsets))
+	}
+	return len(offsets), nil
+} // end func TombstoneOverview
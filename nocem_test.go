@@ -0,0 +1,88 @@
+package overview
+
+import (
+	"bytes"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const nocemTestNotice = `@@BEGIN NCM HEADERS
+Version: 0.93
+Issuer: nocem@example.org
+Type: spam
+Action: hide
+Notice-ID: test-1
+Count: 2
+@@BEGIN NCM BODY
+<a1@example.com> alt.test
+<a2@example.com> alt.test misc.test
+@@END NCM BODY
+`
+
+func nocemTestSign(t *testing.T, signer *openpgp.Entity, text string) []byte {
+	// returns text clearsigned by signer
+	var buf bytes.Buffer
+	w, err := clearsign.Encode(&buf, signer.PrivateKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(text)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+} // end func nocemTestSign
+
+func TestNoCeMVerify(t *testing.T) {
+	signer, err := openpgp.NewEntity("NoCeM test", "", "nocem@example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pub bytes.Buffer
+	if err := signer.Serialize(&pub); err != nil {
+		t.Fatal(err)
+	}
+	keyfile := filepath.Join(t.TempDir(), "nocem.gpg")
+	if err := os.WriteFile(keyfile, pub.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	nc := NewNoCeM("hide", "", nil)
+	if err := nc.LoadKeyring(keyfile); err != nil {
+		t.Fatal(err)
+	}
+
+	signed := nocemTestSign(t, signer, nocemTestNotice)
+	notice, err := nc.Verify(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notice.NoticeID != "test-1" || len(notice.Msgids) != 2 || notice.Signer != signer.PrimaryKey.KeyIdString() {
+		t.Fatalf("notice=%+v", notice)
+	}
+
+	// a msgid changed after signing
+	tampered := bytes.Replace(signed, []byte("<a2@example.com>"), []byte("<a3@example.com>"), 1)
+	if bytes.Equal(tampered, signed) {
+		t.Fatal("tampering did not change the notice")
+	}
+	if _, err := nc.Verify(tampered); err == nil {
+		t.Fatal("Verify accepted a tampered notice")
+	}
+
+	// signed by the key but issued by someone else
+	other := strings.Replace(nocemTestNotice, "nocem@example.org", "other@example.org", 1)
+	if _, err := nc.Verify(nocemTestSign(t, signer, other)); err == nil {
+		t.Fatal("Verify accepted an issuer not matching the signer")
+	}
+
+	// not clearsigned
+	if _, err := nc.Verify([]byte(nocemTestNotice)); err == nil {
+		t.Fatal("Verify accepted an unsigned notice")
+	}
+} // end func TestNoCeMVerify
@@ -365,10 +365,14 @@ type OVL struct {
 }
 
 type ReturnChannelData struct {
-	Retbool   bool
-	Msgnum    uint64
-	Newsgroup string
-	Grouphash string
+	Retbool     bool
+	Msgnum      uint64
+	Newsgroup   string
+	Grouphash   string
+	Rejected    bool   // ingest filter rejected the article, answer 437/439
+	Quarantined bool   // ingest filter diverted the article to QUARANTINE_GROUP, answer 437/439
+	Filter      string // name of the ingest filter
+	Reason      string // rule id or reason of the ingest filter
 }
 
 type OV struct {
@@ -448,10 +452,10 @@ func (ov *OV) Load_Overview(maxworkers int, max_queue_size int, max_open_mmaps i
 		if known_messageids > 0 { // setup known_messageids map only if we want to
 			log.Printf("Load_Overview: cache known_messageids=%d", known_messageids)
 			Known_msgids = Known_MessageIDs{
-				v:          make(map[string]int64, known_messageids),
 				Debug:      debug_OV_handler,
 				MAP_MSGIDS: known_messageids,
 			}
+			Known_msgids.ExpireThread()
 		}
 		// prefill channel with locks so we dont open more mmap files than this available objects in channel
 		MAX_Open_overviews_chan = make(chan struct{}, max_open_mmaps)
@@ -599,10 +603,10 @@ func fail_retchan(retchan chan ReturnChannelData) ReturnChannelData {
 
 func true_retchan(msgnum uint64, newsgroup string, grouphash string, retchan chan ReturnChannelData) ReturnChannelData {
 	if retchan != nil {
-		retchan <- ReturnChannelData{true, msgnum, newsgroup, grouphash}
+		retchan <- ReturnChannelData{Retbool: true, Msgnum: msgnum, Newsgroup: newsgroup, Grouphash: grouphash}
 		return ReturnChannelData{} // dont return anything as it wont be read by anyone, data goes back via retchan
 	}
-	return ReturnChannelData{true, msgnum, newsgroup, grouphash}
+	return ReturnChannelData{Retbool: true, Msgnum: msgnum, Newsgroup: newsgroup, Grouphash: grouphash}
 } // end func true_retchan
 
 func (ov *OV) di_ov(who string, ovl OVL) []*ReturnChannelData {
@@ -610,6 +614,11 @@ func (ov *OV) di_ov(who string, ovl OVL) []*ReturnChannelData {
 	dones := 0
 	retlist := []*ReturnChannelData{}
 	var retchans []chan ReturnChannelData
+	// pre-write filters run before any group assigns a msgnum
+	decision, rejected := ov.ingest_filter(who, &ovl)
+	if rejected != nil {
+		return rejected
+	}
 	overviewline := Construct_OVL(ovl)
 
 	for _, newsgroup := range ovl.Newsgroups {
@@ -689,6 +698,12 @@ func (ov *OV) di_ov(who string, ovl OVL) []*ReturnChannelData {
 		} // end for forever
 	*/
 
+	if decision.Verdict == VerdictQuarantine {
+		for _, retdata := range retlist {
+			retdata.Quarantined, retdata.Filter, retdata.Reason = true, decision.Filter, decision.Reason
+		}
+	}
+
 	if dones == len(ovl.Newsgroups) {
 		if DEBUG_OV {
 			log.Printf("who='%s' di_ov dones=%d len_ovl.Newsgroups=%d retchans=%d retlist=%d", who, dones, len(ovl.Newsgroups), len(retchans), len(retlist))
@@ -787,6 +802,8 @@ func (ov *OV) GO_pi_ov(who string, overviewline string, newsgroup string, hash s
 			}
 		}
 	}
+	// send the line to a follower while the file is open, keeps the order per group
+	REPLICATION_FEED.emit_line(hash, newsgroup, ovfh.Last, ovl_line)
 	ovfh.Last++
 
 	// finally close the mmap
@@ -2380,6 +2397,11 @@ func Scan_Overview(file string, group string, a uint64, b uint64, fields string,
 	}
 
 	var msgnum uint64
+	var view *ViewPolicy
+	if conn != nil {
+		// every field mode: hidden articles must not show in XHDR or LISTGROUP either
+		view = GetViewPolicy(conn)
+	}
 forfilescanner:
 	for fileScanner.Scan() {
 		line := fileScanner.Text()
@@ -2451,8 +2473,8 @@ forfilescanner:
 			break
 		}
 
-		// view-filter TODO hardcoded
-		if conn != nil && fields == "all" && strings.HasSuffix(datafields[4], "googlegroups.com>") && (strings.HasPrefix(datafields[4],"=?UTF-8")||strings.HasPrefix(datafields[4]," =?UTF-8")) {
+		// view-filter
+		if view != nil && view.Hide(group, datafields) {
 			continue forfilescanner
 		}
 
@@ -468,6 +468,73 @@ func (oh *OV_Handler) process_open_request(hid int, who string, open_request Ove
 	return retval
 } // end func process_open_request
 
+func (oh *OV_Handler) LockGroup(who string, hash string) error {
+	// LockGroup takes the same per-group lock the OPENER takes in GetOpen
+	// so no writer can open the overview file until UnlockGroup is called.
+	// a parked mmap of this group gets closed with an updated footer
+	// because we want to replace or rewrite the file on disk.
+	// does nothing if Load_Overview was not called: there are no writers.
+	if hash == "" || len(hash) != 64 {
+		return fmt.Errorf("ERROR LockGroup len_hash=%d", len(hash))
+	}
+	oh.mux.Lock()
+	loaded := oh.V != nil
+	oh.mux.Unlock()
+	if !loaded {
+		return nil
+	}
+
+	signal_chan := make(chan struct{}, 1)
+	if retbool, ch := open_mmap_overviews.lockMMAP(0, who, hash, signal_chan); retbool == false && ch != nil {
+		<-ch // wait for anyone to return the unlock for this group
+	}
+
+	oh.mux.Lock()
+	mapdata, exists := oh.V[hash]
+	if !exists || !mapdata.open || mapdata.ovfh == nil {
+		oh.mux.Unlock()
+		return nil
+	}
+	if mapdata.hid != 0 {
+		oh.mux.Unlock()
+		open_mmap_overviews.unlockMMAP(0, who, false, hash)
+		return fmt.Errorf("ERROR LockGroup hash='%s' is assigned hid=%d", hash, mapdata.hid)
+	}
+	mapdata.hid = -2 // force_close
+	oh.V[hash] = mapdata
+	oh.mux.Unlock()
+
+	update_footer, force_close, grow := true, true, false
+	if err := handle_close_ov(who, mapdata.ovfh, update_footer, force_close, grow); err != nil {
+		log.Printf("%s ERROR LockGroup handle_close_ov err='%v' hash='%s'", who, err, hash)
+		// release the force_close mark or GetOpen waits on this group forever
+		oh.mux.Lock()
+		if mapdata, exists := oh.V[hash]; exists && mapdata.hid == -2 {
+			mapdata.hid = 0
+			oh.V[hash] = mapdata
+		}
+		oh.mux.Unlock()
+		open_mmap_overviews.unlockMMAP(0, who, true, hash)
+		return err
+	}
+	<-count_open_overviews // suck one out reduces len of channel
+	oh.DelHandle(hash)
+	if oh.Debug {
+		log.Printf("%s LockGroup closed parked mmap hash='%s'", who, hash)
+	}
+	return nil
+} // end func OV_Handler.LockGroup
+
+func (oh *OV_Handler) UnlockGroup(who string, hash string) {
+	oh.mux.Lock()
+	loaded := oh.V != nil
+	oh.mux.Unlock()
+	if !loaded {
+		return
+	}
+	open_mmap_overviews.unlockMMAP(0, who, true, hash)
+} // end func OV_Handler.UnlockGroup
+
 func (oh *OV_Handler) KILL(who string) {
 	log.Printf("ERROR %s KILL", who)
 	oh.STOP <- true
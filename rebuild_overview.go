@@ -0,0 +1,268 @@
+package overview
+
+/*
+ * rebuild a lost or damaged overview file from the stored article heads
+ *
+ *   src := &overview.RawArticleDir{Dir: "/restore/alt.test"}   // one raw article per file
+ *   src := &overview.StorageArticleStore{Cachedir: "/news/cache"} // nntp-storage heads and bodies, see storage_check.go
+ *   report, err := overview.RebuildOverview("alt.test", "/ov", src, true)
+ *
+ * every head with a Xref for the group becomes a line with the msgnum from the Xref,
+ * heads without one are counted as Unnumbered. the lines are sorted by msgnum,
+ * Rescan_Overview mode 999 writes the footer, then the file is swapped in
+ * like a reordered one and the .Index is rebuilt.
+ * with replace an existing file is kept as <file>.damaged, or .damaged.N if that exists,
+ * and renamed back if the swap fails.
+ */
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/go-while/go-utils"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// RawArticle is an article read by an ArticleSource
+type RawArticle struct {
+	Head   []string // header lines without line endings
+	Bytes  int      // size of the article
+	Lines  int      // lines of the body
+	Source string   // file it was read from, for logs
+}
+
+// ArticleSource iterates stored articles for RebuildOverview
+type ArticleSource interface {
+	EachArticle(fn func(art *RawArticle) error) error // stops on the first error of fn
+}
+
+// RebuildReport is the result of RebuildOverview
+type RebuildReport struct {
+	File        string `json:"file"`
+	Articles    uint64 `json:"articles"`
+	Written     uint64 `json:"written"`
+	Unnumbered  uint64 `json:"unnumbered"` // Xref without the group
+	Invalid     uint64 `json:"invalid"`    // head without valid msgid
+	Duplicates  uint64 `json:"duplicates"` // msgnum seen before, first one kept
+	FirstMsgnum uint64 `json:"first_msgnum"`
+	LastMsgnum  uint64 `json:"last_msgnum"`
+	Damaged     string `json:"damaged,omitempty"` // the replaced file was renamed to
+}
+
+func RebuildOverview(group string, cachedir string, src ArticleSource, replace bool) (*RebuildReport, error) {
+	if !IsValidGroupName(group) {
+		return nil, fmt.Errorf("ERROR overview.RebuildOverview invalid group='%s'", group)
+	}
+	who := "RebuildOverview"
+	hash := utils.Hash256(group)
+	file := filepath.Join(cachedir, hash+".overview")
+	newfile := file + ".rebuild"
+	report := &RebuildReport{File: file}
+
+	if err := OV_handler.LockGroup(who, hash); err != nil {
+		return nil, err
+	}
+	defer OV_handler.UnlockGroup(who, hash)
+	if utils.FileExists(file) && !replace {
+		return nil, fmt.Errorf("ERROR overview.RebuildOverview exists fp='%s'", filepath.Base(file))
+	}
+
+	lines := make(map[uint64]string)
+	err := src.EachArticle(func(art *RawArticle) error {
+		report.Articles++
+		msgnum, line, ok := rebuild_line(group, art)
+		switch {
+		case !ok:
+			report.Invalid++
+		case msgnum == 0:
+			report.Unnumbered++
+		case lines[msgnum] != "":
+			report.Duplicates++
+		default:
+			lines[msgnum] = line
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	if len(lines) == 0 {
+		return report, fmt.Errorf("ERROR overview.RebuildOverview no articles of group='%s'", group)
+	}
+	msgnums := make([]uint64, 0, len(lines))
+	for msgnum := range lines {
+		msgnums = append(msgnums, msgnum)
+	}
+	sort.Slice(msgnums, func(i, j int) bool { return msgnums[i] < msgnums[j] })
+	report.FirstMsgnum, report.LastMsgnum = msgnums[0], msgnums[len(msgnums)-1]
+
+	if err := rebuild_write(newfile, hash, msgnums, lines); err != nil {
+		os.Remove(newfile)
+		return report, err
+	}
+	report.Written = uint64(len(msgnums))
+	if retbool, last := Rescan_Overview(who, newfile, group, 999, false, nil, nil); !retbool || last != report.LastMsgnum {
+		os.Remove(newfile)
+		return report, fmt.Errorf("ERROR overview.RebuildOverview fix-footer failed last=%d fp='%s'", last, filepath.Base(newfile))
+	}
+	if utils.FileExists(file) {
+		damaged, err := rebuild_damaged_name(file)
+		if err != nil {
+			os.Remove(newfile)
+			return report, err
+		}
+		if err := os.Rename(file, damaged); err != nil {
+			os.Remove(newfile)
+			return report, err
+		}
+		report.Damaged = damaged
+	}
+	if !swap_reordered_overview(who, file, newfile, group) {
+		rebuild_rollback(who, file, newfile, report.Damaged, group)
+		return report, fmt.Errorf("ERROR overview.RebuildOverview swap failed fp='%s'", filepath.Base(file))
+	}
+	log.Printf("RebuildOverview group='%s' articles=%d written=%d unnumbered=%d invalid=%d duplicates=%d last=%d", group, report.Articles, report.Written, report.Unnumbered, report.Invalid, report.Duplicates, report.LastMsgnum)
+	return report, nil
+} // end func RebuildOverview
+
+func rebuild_damaged_name(file string) (string, error) {
+	// returns the first of <file>.damaged, <file>.damaged.1 ... not existing
+	damaged := file + ".damaged"
+	for i := 1; utils.FileExists(damaged); i++ {
+		if i > 1000 {
+			return "", fmt.Errorf("ERROR overview.RebuildOverview too many .damaged files fp='%s'", filepath.Base(file))
+		}
+		damaged = fmt.Sprintf("%s.damaged.%d", file, i)
+	}
+	return damaged, nil
+} // end func rebuild_damaged_name
+
+func rebuild_rollback(who string, file string, newfile string, damaged string, group string) {
+	// puts the replaced file back after a failed swap, the rebuilt one is kept as newfile
+	if damaged == "" {
+		return
+	}
+	if utils.FileExists(file) {
+		if err := os.Rename(file, newfile); err != nil {
+			log.Printf("ERROR %s rollback rename fp='%s' err='%v'", who, filepath.Base(file), err)
+			return
+		}
+	}
+	if err := os.Rename(damaged, file); err != nil {
+		log.Printf("ERROR %s rollback rename fp='%s' err='%v'", who, filepath.Base(damaged), err)
+		return
+	}
+	OVIndex.MemDropIndexCache(group, 0)
+	if !RebuildOverviewIndex(file, group) {
+		log.Printf("ERROR %s rollback RebuildOverviewIndex fp='%s'", who, filepath.Base(file))
+	}
+	log.Printf("%s rolled back fp='%s' rebuilt kept as '%s'", who, filepath.Base(file), filepath.Base(newfile))
+} // end func rebuild_rollback
+
+func rebuild_line(group string, art *RawArticle) (uint64, string, bool) {
+	// returns the msgnum of group from the Xref and the overview line without msgnum
+	// msgnum is 0 if the Xref does not list group
+	ovl := Extract_overview("?", art.Head)
+	if !isvalidmsgid(ovl.Messageid, true) || ovl.Messageid[0] != '<' {
+		return 0, "", false
+	}
+	var msgnum uint64
+	xrefs := strings.Fields(ovl.Xref)
+	for x := 1; x < len(xrefs); x++ {
+		xrefdata := strings.Split(xrefs[x], ":")
+		if len(xrefdata) == 2 && xrefdata[0] == group {
+			msgnum = utils.Str2uint64(xrefdata[1])
+			break
+		}
+	}
+	ovl.Bytes, ovl.Lines = art.Bytes, art.Lines
+	return msgnum, Construct_OVL(ovl), true
+} // end func rebuild_line
+
+func rebuild_write(newfile string, hash string, msgnums []uint64, lines map[uint64]string) error {
+	// writes header and lines, the footer is written by Rescan_Overview mode 999
+	fh, err := os.Create(newfile)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(fh, 1024*1024)
+	head_str := fmt.Sprintf("%s%d,group=%s,zeropad=%s,%s", HEADER_BEG, utils.Now(), hash, ZERO_PATTERN, HEADER_END)
+	w.WriteString(zerofill(head_str, OV_RESERVE_BEG))
+	for _, msgnum := range msgnums {
+		// same line as GO_pi_ov writes
+		fmt.Fprintf(w, "%d\t%s\t%s\n", msgnum, lines[msgnum], XREF_PREFIX)
+	}
+	if err := w.Flush(); err != nil {
+		fh.Close()
+		return err
+	}
+	return fh.Close()
+} // end func rebuild_write
+
+// RawArticleDir reads a directory of raw article files, head and body separated by an empty line
+type RawArticleDir struct {
+	Dir string
+}
+
+func (d *RawArticleDir) EachArticle(fn func(art *RawArticle) error) error {
+	return filepath.WalkDir(d.Dir, func(path string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if e.IsDir() {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		art := &RawArticle{Bytes: len(data), Source: path}
+		text := strings.ReplaceAll(string(data), "\r\n", "\n")
+		head, body := text, ""
+		if i := strings.Index(text, "\n\n"); i >= 0 {
+			head, body = text[:i], text[i+2:]
+		}
+		art.Head = strings.Split(head, "\n")
+		if body != "" {
+			art.Lines = strings.Count(strings.TrimSuffix(body, "\n"), "\n") + 1
+		}
+		return fn(art)
+	})
+} // end func RawArticleDir.EachArticle
+
+func (s *StorageArticleStore) EachArticle(fn func(art *RawArticle) error) error {
+	// reads every head below Cachedir with the size and lines of its body
+	return s.list_articles(func(msgidhash string) error {
+		headfile := s.path("head", msgidhash)
+		head, err := os.ReadFile(headfile)
+		if err != nil {
+			return err
+		}
+		art := &RawArticle{Source: headfile, Bytes: len(head)}
+		art.Head = strings.Split(strings.TrimRight(strings.ReplaceAll(string(head), "\r\n", "\n"), "\n"), "\n")
+		if body, err := os.ReadFile(s.path("body", msgidhash)); err == nil {
+			art.Bytes += len(body)
+			if len(body) > 0 {
+				art.Lines = strings.Count(strings.TrimRight(string(body), "\r\n"), "\n") + 1
+			}
+		}
+		return fn(art)
+	})
+} // end func StorageArticleStore.EachArticle
+
+func (s *StorageArticleStore) list_articles(fn func(msgidhash string) error) error {
+	// like ListArticles, stops on the first error of fn
+	var ferr error
+	err := s.ListArticles(func(msgidhash string) bool {
+		ferr = fn(msgidhash)
+		return ferr == nil
+	})
+	if ferr != nil {
+		return ferr
+	}
+	return err
+} // end func StorageArticleStore.list_articles
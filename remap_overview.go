@@ -0,0 +1,187 @@
+package overview
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/go-while/go-utils"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ReMap holds one renumbered article of ReOrderOverview
+type ReMap struct {
+	Old   uint64 // msgnum before reorder
+	New   uint64 // msgnum after reorder, 0 if the line was dropped
+	Msgid string
+}
+
+type AsortReMap []ReMap
+
+func (rm AsortReMap) Len() int      { return len(rm) }
+func (rm AsortReMap) Swap(i, j int) { rm[i], rm[j] = rm[j], rm[i] }
+func (rm AsortReMap) Less(i, j int) bool {
+	if rm[i].Old != rm[j].Old {
+		return rm[i].Old < rm[j].Old
+	}
+	if rm[i].New != rm[j].New {
+		return rm[i].New < rm[j].New
+	}
+	return rm[i].Msgid < rm[j].Msgid
+}
+
+func WriteReMap(remapfile string, remap []ReMap) bool {
+	// writes the sidecar file with one "old_msgnum new_msgnum msgid" per line
+	// storage layer can use it to relink articles
+	fh, err := os.Create(remapfile)
+	if err != nil {
+		log.Printf("Error OV WriteReMap os.Create fp='%s' err='%v'", filepath.Base(remapfile), err)
+		return false
+	}
+	w := bufio.NewWriter(fh)
+	for _, rm := range remap {
+		fmt.Fprintf(w, "%d %d %s\n", rm.Old, rm.New, rm.Msgid)
+	}
+	if err := w.Flush(); err != nil {
+		fh.Close()
+		log.Printf("Error OV WriteReMap Flush fp='%s' err='%v'", filepath.Base(remapfile), err)
+		return false
+	}
+	if err := fh.Close(); err != nil {
+		log.Printf("Error OV WriteReMap Close fp='%s' err='%v'", filepath.Base(remapfile), err)
+		return false
+	}
+	return true
+} // end func WriteReMap
+
+func ReadReMap(remapfile string) ([]ReMap, error) {
+	// reads a sidecar file written by WriteReMap
+	fh, err := os.Open(remapfile)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	var remap []ReMap
+	fileScanner := bufio.NewScanner(fh)
+	lc := 0
+	for fileScanner.Scan() {
+		lc++
+		line := fileScanner.Text()
+		if line == "" {
+			continue
+		}
+		x := strings.SplitN(line, " ", 3)
+		if len(x) != 3 || !utils.IsDigit(x[0]) || !utils.IsDigit(x[1]) {
+			return nil, fmt.Errorf("Error ReadReMap fp='%s' lc=%d bad line", filepath.Base(remapfile), lc)
+		}
+		remap = append(remap, ReMap{Old: utils.Str2uint64(x[0]), New: utils.Str2uint64(x[1]), Msgid: x[2]})
+	}
+	if err := fileScanner.Err(); err != nil {
+		return nil, err
+	}
+	return remap, nil
+} // end func ReadReMap
+
+type newsrcRange struct {
+	a uint64
+	b uint64
+}
+
+func parseNewsrcRanges(ranges string) ([]newsrcRange, error) {
+	// parses a newsrc article list "1-5,7,9-12" into sorted ranges
+	var list []newsrcRange
+	for _, part := range strings.Split(ranges, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		var r newsrcRange
+		if i := strings.Index(part, "-"); i > 0 {
+			if !utils.IsDigit(part[:i]) || !utils.IsDigit(part[i+1:]) {
+				return nil, fmt.Errorf("Error parseNewsrcRanges bad range='%s'", part)
+			}
+			r.a, r.b = utils.Str2uint64(part[:i]), utils.Str2uint64(part[i+1:])
+		} else {
+			if !utils.IsDigit(part) {
+				return nil, fmt.Errorf("Error parseNewsrcRanges bad number='%s'", part)
+			}
+			r.a = utils.Str2uint64(part)
+			r.b = r.a
+		}
+		if r.a > r.b {
+			r.a, r.b = r.b, r.a
+		}
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].a < list[j].a })
+	// merge overlapping ranges so list stays sorted by a and b
+	var merged []newsrcRange
+	for _, r := range list {
+		if n := len(merged); n > 0 && r.a <= merged[n-1].b+1 {
+			if r.b > merged[n-1].b {
+				merged[n-1].b = r.b
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged, nil
+} // end func parseNewsrcRanges
+
+func RemapNewsrcRanges(ranges string, remap []ReMap) (string, error) {
+	// translates the article list of a newsrc line through a remap from ReOrderOverview
+	// example: "1-5,7" returns the new msgnums of all old msgnums 1-5 and 7
+	// articles dropped by the reorder or unknown to the remap are omitted
+	list, err := parseNewsrcRanges(ranges)
+	if err != nil {
+		return "", err
+	}
+	var msgnums []uint64
+	for _, rm := range remap {
+		if rm.New == 0 {
+			continue
+		}
+		i := sort.Search(len(list), func(i int) bool { return list[i].b >= rm.Old })
+		for ; i < len(list) && list[i].a <= rm.Old; i++ {
+			if rm.Old >= list[i].a && rm.Old <= list[i].b {
+				msgnums = append(msgnums, rm.New)
+				break
+			}
+		}
+	}
+	sort.Slice(msgnums, func(i, j int) bool { return msgnums[i] < msgnums[j] })
+
+	var parts []string
+	for i := 0; i < len(msgnums); {
+		j := i
+		for j+1 < len(msgnums) && msgnums[j+1] <= msgnums[j]+1 {
+			j++
+		}
+		if msgnums[i] == msgnums[j] {
+			parts = append(parts, fmt.Sprintf("%d", msgnums[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", msgnums[i], msgnums[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ","), nil
+} // end func RemapNewsrcRanges
+
+func RemapNewsrcLine(line string, group string, remap []ReMap) (string, error) {
+	// translates a full .newsrc line "group: 1-5,7" or "group! 1-5,7"
+	// lines of other groups are returned unchanged
+	i := strings.IndexAny(line, ":!")
+	if i <= 0 || line[:i] != group {
+		return line, nil
+	}
+	ranges, err := RemapNewsrcRanges(line[i+1:], remap)
+	if err != nil {
+		return line, err
+	}
+	if ranges == "" {
+		return line[:i+1], nil
+	}
+	return line[:i+1] + " " + ranges, nil
+} // end func RemapNewsrcLine
@@ -0,0 +1,863 @@
+package overview
+
+/*
+ * ReOrderOverviewExternal produces the same output as ReOrderOverviewRemap
+ * but never holds the whole overview in memory.
+ *
+ * phase "split":  reads the overview line by line and spills runs sorted by msgid
+ * phase "dedupe": merges the msgid runs, drops duplicates and bad dates,
+ *                 spills runs sorted by date
+ * phase "write":  merges the date runs and writes the .new and .new.stamps file
+ * phase "rescan": Rescan_Overview 999 fixes the footer of the .new file
+ * phase "swap":   remap is written, the .new file gets swapped in
+ * phase "done":   the .new file is swapped in
+ *
+ * every finished phase (and every spilled run in phase split) is recorded
+ * in a checkpoint file in TmpDir so an interrupted run can be resumed.
+ */
+
+import (
+	"bufio"
+	"container/heap"
+	"database/sql"
+	"fmt"
+	"github.com/go-while/go-utils"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	REORDER_MAX_INMEM_SIZE int64  = 256 * 1024 * 1024 // ReOrderOverview uses ReOrderOverviewExternal for bigger files
+	REORDER_MAX_MEMORY     int    = 64 * 1024 * 1024  // default bytes of lines held in memory per run
+	REORDER_MAX_OPENRUNS   int    = 64                // default number of runs merged at once
+	REORDER_PROGRESS_EVERY uint64 = 1000000           // report progress every N lines
+)
+
+const (
+	reorder_phase_split  = "split"
+	reorder_phase_dedupe = "dedupe"
+	reorder_phase_write  = "write"
+	reorder_phase_rescan = "rescan"
+	reorder_phase_swap   = "swap"
+	reorder_phase_done   = "done"
+)
+
+// ReOrderOpts controls ReOrderOverviewExternal. zero values use defaults
+type ReOrderOpts struct {
+	TmpDir      string // spill files and checkpoint, default: file+".reorder"
+	MaxMemory   int    // bytes of lines held in memory before a run is spilled
+	MaxOpenRuns int    // runs merged at once, more runs get merged in passes
+	Resume      bool   // continue from the checkpoint in TmpDir if the overview did not change
+	Progress    func(ReOrderProgress)
+}
+
+// ReOrderProgress is passed to ReOrderOpts.Progress
+type ReOrderProgress struct {
+	File   string
+	Phase  string
+	Lines  uint64 // lines processed in this phase
+	Offset int64  // bytes read from the overview in phase split
+	Size   int64  // size of the overview
+	Runs   int    // spilled runs in this phase
+}
+
+type reorder_state struct {
+	Size   int64
+	Mtime  int64
+	Phase  string // last finished phase
+	Offset int64  // phase split: bytes of the overview stored in Runs
+	Seq    uint64 // phase split: lines of the overview stored in Runs
+	Footer int    // phase split: footer lines read
+	Runs   []string
+	Remaps []string
+}
+
+func ReOrderOverviewExternal(file string, group string, doWritestamps bool, hashdb *sql.DB, opts *ReOrderOpts) ([]ReMap, bool) {
+	// external merge sort variant of ReOrderOverviewRemap for overviews too big for memory
+	// returns the remap only if it fits into memory, the .remap sidecar has it anyways
+	debug := false
+	if opts == nil {
+		opts = &ReOrderOpts{}
+	}
+	tmpdir := opts.TmpDir
+	if tmpdir == "" {
+		tmpdir = file + ".reorder"
+	}
+	maxmem := opts.MaxMemory
+	if maxmem <= 0 {
+		maxmem = REORDER_MAX_MEMORY
+	}
+	fanin := opts.MaxOpenRuns
+	if fanin < 2 {
+		fanin = REORDER_MAX_OPENRUNS
+	}
+	newfile := file + ".new"
+	if !utils.FileExists(file) {
+		log.Printf("Error ReOrderOverviewExternal !FileExists file='%s' group='%s'", file, group)
+		return nil, false
+	}
+	hash, err := get_hash_from_filename(file)
+	if err != nil {
+		log.Printf("Error ReOrderOverviewExternal file='%s' err='%v'", filepath.Base(file), err)
+		return nil, false
+	}
+	who := "ReOrderOV"
+	if err := OV_handler.LockGroup(who, hash); err != nil {
+		log.Printf("Error ReOrderOverviewExternal LockGroup file='%s' err='%v'", filepath.Base(file), err)
+		return nil, false
+	}
+	defer OV_handler.UnlockGroup(who, hash)
+
+	// stat after LockGroup: closing a parked handle updates the footer
+	fi, err := os.Stat(file)
+	if err != nil {
+		log.Printf("Error ReOrderOverviewExternal os.Stat file='%s' err='%v'", filepath.Base(file), err)
+		return nil, false
+	}
+
+	state := &reorder_state{}
+	if opts.Resume {
+		if st, err := reorder_load_state(tmpdir); err == nil {
+			switch {
+			case st.Phase == reorder_phase_done:
+				// swapped in but crashed before cleanup
+				log.Printf("ReOrderOverviewExternal file='%s' already done, cleanup tmpdir", filepath.Base(file))
+				os.RemoveAll(tmpdir)
+				return nil, true
+			case st.Phase == reorder_phase_swap:
+				// the file may be swapped in already and differ from the checkpoint
+				state = st
+				log.Printf("ReOrderOverviewExternal file='%s' resume swap", filepath.Base(file))
+			case st.Size == fi.Size() && st.Mtime == fi.ModTime().UnixNano():
+				state = st
+				log.Printf("ReOrderOverviewExternal file='%s' resume after phase='%s' offset=%d", filepath.Base(file), state.Phase, state.Offset)
+			default:
+				log.Printf("ReOrderOverviewExternal file='%s' changed since checkpoint, restart", filepath.Base(file))
+			}
+		}
+	}
+	if state.Phase == "" {
+		if remap, done, ok := reorder_stale_newfile(who, file, newfile, group); done {
+			os.RemoveAll(tmpdir)
+			return remap, ok
+		}
+		if err := os.RemoveAll(tmpdir); err != nil {
+			log.Printf("Error ReOrderOverviewExternal RemoveAll tmpdir='%s' err='%v'", tmpdir, err)
+			return nil, false
+		}
+		if err := os.MkdirAll(tmpdir, 0755); err != nil {
+			log.Printf("Error ReOrderOverviewExternal MkdirAll tmpdir='%s' err='%v'", tmpdir, err)
+			return nil, false
+		}
+		state.Size, state.Mtime = fi.Size(), fi.ModTime().UnixNano()
+	}
+
+	progress := func(p ReOrderProgress) {
+		p.File, p.Size = file, fi.Size()
+		if opts.Progress != nil {
+			opts.Progress(p)
+			return
+		}
+		log.Printf("ReOrderOverviewExternal file='%s' phase='%s' lines=%d offset=%d/%d runs=%d", filepath.Base(file), p.Phase, p.Lines, p.Offset, p.Size, p.Runs)
+	}
+
+	rx := &reorder_ext{
+		file:     file,
+		newfile:  newfile,
+		group:    group,
+		tmpdir:   tmpdir,
+		maxmem:   maxmem,
+		fanin:    fanin,
+		state:    state,
+		progress: progress,
+		debug:    debug,
+		hashdb:   hashdb,
+		dostamps: doWritestamps,
+	}
+
+	if state.Phase == "" || state.Phase == reorder_phase_split && !rx.split_done() {
+		if !rx.split() {
+			return nil, false
+		}
+	}
+	if state.Phase == reorder_phase_split {
+		if !rx.dedupe() {
+			return nil, false
+		}
+	}
+	if state.Phase == reorder_phase_dedupe {
+		if !rx.write() {
+			return nil, false
+		}
+	}
+	if state.Phase == reorder_phase_write {
+		if !utils.FileExists(newfile) {
+			log.Printf("Error ReOrderOverviewExternal wrote no lines file='%s'", filepath.Base(file))
+			os.RemoveAll(tmpdir)
+			return nil, false
+		}
+		retbool, last := Rescan_Overview(who, newfile, group, 999, false, nil, nil)
+		if !retbool {
+			log.Printf("Error OV ReOrderOverviewExternal Rescan_Overview newfh='%s' retbool=%t last=%d", filepath.Base(newfile), retbool, last)
+			return nil, false
+		}
+		log.Printf("OK ReOrderOverviewExternal Rescan_Overview newfh='%s' retbool=%t last=%d", filepath.Base(newfile), retbool, last)
+		if !rx.checkpoint(reorder_phase_rescan) {
+			return nil, false
+		}
+	}
+	var remap []ReMap
+	if state.Phase == reorder_phase_rescan {
+		var ok bool
+		if remap, ok = rx.write_remap(); !ok {
+			return nil, false
+		}
+		// checkpoint before the rename: a resumed run must not rescan the renumbered file
+		if !rx.checkpoint(reorder_phase_swap) {
+			return nil, false
+		}
+	}
+	if state.Phase != reorder_phase_swap {
+		log.Printf("Error ReOrderOverviewExternal file='%s' unexpected phase='%s'", filepath.Base(file), state.Phase)
+		return nil, false
+	}
+	if utils.FileExists(newfile) {
+		if !swap_reordered_overview(who, file, newfile, group) {
+			return nil, false
+		}
+	} else if !finish_reordered_overview(who, file, newfile, group) {
+		// crashed after the rename of the .new file
+		return nil, false
+	}
+	rx.checkpoint(reorder_phase_done)
+	os.RemoveAll(tmpdir)
+	return remap, true
+} // end func ReOrderOverviewExternal
+
+type reorder_ext struct {
+	file     string
+	newfile  string
+	group    string
+	tmpdir   string
+	maxmem   int
+	fanin    int
+	state    *reorder_state
+	progress func(ReOrderProgress)
+	debug    bool
+	hashdb   *sql.DB
+	dostamps bool
+}
+
+func (rx *reorder_ext) split_done() bool {
+	// a checkpoint of phase split is written after every spilled run
+	// and once more with Footer == 3 when the phase finished
+	return rx.state.Footer == 3
+} // end func split_done
+
+func (rx *reorder_ext) split() bool {
+	// phase split: reads the overview from the checkpointed offset and spills runs sorted by msgid
+	// reads with bufio.Reader: no line length limit like bufio.Scanner
+	state := rx.state
+	fh, err := os.Open(rx.file)
+	if err != nil {
+		log.Printf("Error OV ReOrderOverviewExternal split os.Open file='%s' err='%v'", filepath.Base(rx.file), err)
+		return false
+	}
+	defer fh.Close()
+	if state.Offset > 0 {
+		if _, err := fh.Seek(state.Offset, io.SeekStart); err != nil {
+			log.Printf("Error OV ReOrderOverviewExternal split Seek file='%s' err='%v'", filepath.Base(rx.file), err)
+			return false
+		}
+	}
+	headerfile := filepath.Join(rx.tmpdir, "header")
+	rb := &run_buffer{kind: run_kind_msgid, dir: rx.tmpdir, max: rx.maxmem, runs: state.Runs, count: len(state.Runs)}
+	r := bufio.NewReaderSize(fh, 1024*1024)
+	offset, seq := state.Offset, state.Seq
+	var readfooter bool
+	var footer int
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			log.Printf("Error OV ReOrderOverviewExternal split read file='%s' err='%v'", filepath.Base(rx.file), err)
+			return false
+		}
+		if line == "" && err == io.EOF {
+			break
+		}
+		offset += int64(len(line))
+		// same as bufio.ScanLines used by Scan_Overview
+		line = strings.TrimSuffix(line, "\n")
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			log.Printf("Error OV ReOrderOverviewExternal i=%d line=nil", seq)
+			return false
+		}
+		if seq == 0 {
+			if len(line) > 128 {
+				log.Printf("Error OV ReOrderOverviewExternal head=%d file='%s'", len(line), filepath.Base(rx.file))
+				return false
+			}
+			if err := os.WriteFile(headerfile, []byte(line), 0644); err != nil {
+				log.Printf("Error OV ReOrderOverviewExternal write header err='%v'", err)
+				return false
+			}
+			seq++
+			continue
+		}
+		seq++
+		if !readfooter && line[0] == 0 {
+			readfooter = true
+			continue
+		}
+		if readfooter {
+			footer++
+			continue
+		}
+		datafields := strings.Split(line, "\t")
+		if len(datafields) < OVERVIEW_FIELDS {
+			log.Printf("Error OV ReOrderOverviewExternal file='%s' len(datafields)=%d < OVERVIEW_FIELDS=%d i=%d", filepath.Base(rx.file), len(datafields), OVERVIEW_FIELDS, seq-1)
+			return false
+		}
+		flushed, err := rb.add(fmt.Sprintf("%s\t%d\t%s", datafields[4], seq, line))
+		if err != nil {
+			log.Printf("Error OV ReOrderOverviewExternal split spill err='%v'", err)
+			return false
+		}
+		if flushed {
+			state.Runs, state.Offset, state.Seq = rb.runs, offset, seq
+			if !rx.checkpoint(reorder_phase_split) {
+				return false
+			}
+			rx.progress(ReOrderProgress{Phase: reorder_phase_split, Lines: seq, Offset: offset, Runs: len(rb.runs)})
+		} else if seq%REORDER_PROGRESS_EVERY == 0 {
+			rx.progress(ReOrderProgress{Phase: reorder_phase_split, Lines: seq, Offset: offset, Runs: len(rb.runs)})
+		}
+	}
+	if _, err := os.Stat(headerfile); err != nil || footer != 3 {
+		log.Printf("Error OV ReOrderOverviewExternal head err='%v' foot=%d file='%s'", err, footer, filepath.Base(rx.file))
+		return false
+	}
+	if err := rb.flush(); err != nil {
+		log.Printf("Error OV ReOrderOverviewExternal split spill err='%v'", err)
+		return false
+	}
+	state.Runs, state.Offset, state.Seq, state.Footer = rb.runs, offset, seq, footer
+	rx.progress(ReOrderProgress{Phase: reorder_phase_split, Lines: seq, Offset: offset, Runs: len(rb.runs)})
+	return rx.checkpoint(reorder_phase_split)
+} // end func split
+
+func (rx *reorder_ext) dedupe() bool {
+	// phase dedupe: merges the msgid runs, keeps the first line of every msgid
+	// and spills the lines with a valid date into runs sorted by date
+	state := rx.state
+	datebuf := &run_buffer{kind: run_kind_date, dir: rx.tmpdir, max: rx.maxmem}
+	remapbuf := &run_buffer{kind: run_kind_remap, dir: rx.tmpdir, max: rx.maxmem}
+	var prev string
+	var lines uint64
+	first := true
+	emit := func(rec *run_rec) error {
+		lines++
+		if lines%REORDER_PROGRESS_EVERY == 0 {
+			rx.progress(ReOrderProgress{Phase: reorder_phase_dedupe, Lines: lines, Runs: len(datebuf.runs)})
+		}
+		datafields := strings.Split(rec.data, "\t")
+		msgid := rec.s
+		if !first && msgid == prev {
+			if rx.debug {
+				log.Printf("Ignore Duplicate msgid='%s' file='%s' i=%d", msgid, filepath.Base(rx.file), rec.u1-1)
+			}
+			_, err := remapbuf.add(remap_record(utils.Str2uint64(datafields[0]), 0, msgid))
+			return err
+		}
+		first, prev = false, msgid
+		unixepoch, err := ParseDate(datafields[3])
+		if err != nil {
+			log.Printf("IGNORE Error OV ReOrderOverviewExternal ParseDate file='%s' i=%d err='%v' unixepoch=%d msgid='%s' subj='%s' xref='%s'", filepath.Base(rx.file), rec.u1-1, err, unixepoch, msgid, datafields[1], datafields[8])
+			_, err := remapbuf.add(remap_record(utils.Str2uint64(datafields[0]), 0, msgid))
+			return err
+		}
+		_, err = datebuf.add(fmt.Sprintf("%d\t%d\t%s", unixepoch, rec.u1, rec.data))
+		return err
+	}
+	tmpfiles, err := merge_runs(run_kind_msgid, rx.tmpdir, state.Runs, rx.fanin, emit)
+	if err == nil {
+		err = datebuf.flush()
+	}
+	if err == nil {
+		err = remapbuf.flush()
+	}
+	if err != nil {
+		log.Printf("Error OV ReOrderOverviewExternal dedupe file='%s' err='%v'", filepath.Base(rx.file), err)
+		return false
+	}
+	oldruns := state.Runs
+	state.Runs, state.Remaps = datebuf.runs, remapbuf.runs
+	if !rx.checkpoint(reorder_phase_dedupe) {
+		return false
+	}
+	rx.remove_runs(oldruns, tmpfiles)
+	rx.progress(ReOrderProgress{Phase: reorder_phase_dedupe, Lines: lines, Runs: len(datebuf.runs)})
+	return true
+} // end func dedupe
+
+func (rx *reorder_ext) write() bool {
+	// phase write: merges the date runs and writes the renumbered lines to the .new file
+	state := rx.state
+	for _, fp := range []string{rx.newfile, rx.newfile + ".stamps"} {
+		// left over from an interrupted phase write
+		if err := os.Remove(fp); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error OV ReOrderOverviewExternal write remove fp='%s' err='%v'", filepath.Base(fp), err)
+			return false
+		}
+	}
+	header, err := os.ReadFile(filepath.Join(rx.tmpdir, "header"))
+	if err != nil {
+		log.Printf("Error OV ReOrderOverviewExternal write read header err='%v'", err)
+		return false
+	}
+	// remap runs of phase dedupe stay, more runs get added here
+	remapbuf := &run_buffer{kind: run_kind_remap, dir: rx.tmpdir, max: rx.maxmem, runs: state.Remaps, count: len(state.Remaps)}
+	var newfh, stampsfh *os.File
+	var neww, stampsw *bufio.Writer
+	defer func() {
+		if newfh != nil {
+			newfh.Close()
+		}
+		if stampsfh != nil {
+			stampsfh.Close()
+		}
+	}()
+	var new_msgnum uint64 = 1
+	var lines uint64
+	emit := func(rec *run_rec) error {
+		lines++
+		if lines%REORDER_PROGRESS_EVERY == 0 {
+			rx.progress(ReOrderProgress{Phase: reorder_phase_write, Lines: lines})
+		}
+		datafields := strings.Split(rec.data, "\t")
+		old_msgnum := utils.Str2uint64(datafields[0])
+		if old_msgnum <= 0 {
+			return nil
+		}
+		msgid := datafields[4]
+		if rx.dostamps {
+			if stampsfh == nil {
+				fh, err := os.Create(rx.newfile + ".stamps")
+				if err != nil {
+					return err
+				}
+				stampsfh, stampsw = fh, bufio.NewWriter(fh)
+			}
+			fmt.Fprintf(stampsw, "%d %s\n", rec.i, utils.Hash256(msgid))
+		}
+		newline, keep := reorder_line(rx.group, datafields, old_msgnum, new_msgnum, rx.hashdb, rx.debug)
+		if !keep {
+			_, err := remapbuf.add(remap_record(old_msgnum, 0, msgid))
+			return err
+		}
+		if newfh == nil {
+			fh, err := os.Create(rx.newfile)
+			if err != nil {
+				return err
+			}
+			newfh, neww = fh, bufio.NewWriterSize(fh, 1024*1024)
+			fmt.Fprintf(neww, "%s\n", header)
+		}
+		// terminate the last line too, see ReOrderOverviewRemap
+		if _, err := fmt.Fprintf(neww, "%s\n", newline); err != nil {
+			return err
+		}
+		if _, err := remapbuf.add(remap_record(old_msgnum, new_msgnum, msgid)); err != nil {
+			return err
+		}
+		new_msgnum++
+		return nil
+	}
+	tmpfiles, err := merge_runs(run_kind_date, rx.tmpdir, state.Runs, rx.fanin, emit)
+	if err == nil {
+		err = remapbuf.flush()
+	}
+	for _, w := range []*bufio.Writer{stampsw, neww} {
+		if err == nil && w != nil {
+			err = w.Flush()
+		}
+	}
+	for _, fh := range []*os.File{stampsfh, newfh} {
+		if fh != nil {
+			if cerr := fh.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}
+	stampsfh, newfh = nil, nil
+	if err != nil {
+		log.Printf("Error OV ReOrderOverviewExternal write newfh='%s' err='%v'", filepath.Base(rx.newfile), err)
+		return false
+	}
+	log.Printf("wrote %d lines to newfh='%s'", new_msgnum-1, filepath.Base(rx.newfile))
+	oldruns := state.Runs
+	state.Runs, state.Remaps = nil, remapbuf.runs
+	if !rx.checkpoint(reorder_phase_write) {
+		return false
+	}
+	rx.remove_runs(oldruns, tmpfiles)
+	rx.progress(ReOrderProgress{Phase: reorder_phase_write, Lines: lines})
+	return true
+} // end func write
+
+func (rx *reorder_ext) write_remap() ([]ReMap, bool) {
+	// merges the remap runs into the .new.remap sidecar
+	// keeps the remap in memory while it is smaller than maxmem
+	remapfile := rx.newfile + ".remap"
+	fh, err := os.Create(remapfile)
+	if err != nil {
+		log.Printf("Error OV WriteReMap os.Create fp='%s' err='%v'", filepath.Base(remapfile), err)
+		return nil, false
+	}
+	defer fh.Close()
+	w := bufio.NewWriter(fh)
+	var remap []ReMap
+	var size int
+	keep := true
+	emit := func(rec *run_rec) error {
+		if keep {
+			size += len(rec.s) + 64
+			if size > rx.maxmem {
+				keep, remap = false, nil
+			} else {
+				remap = append(remap, ReMap{Old: rec.u1, New: rec.u2, Msgid: rec.s})
+			}
+		}
+		_, err := w.WriteString(rec.line + "\n")
+		return err
+	}
+	tmpfiles, err := merge_runs(run_kind_remap, rx.tmpdir, rx.state.Remaps, rx.fanin, emit)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = fh.Close()
+	}
+	if err != nil {
+		log.Printf("Error OV ReOrderOverviewExternal write_remap fp='%s' err='%v'", filepath.Base(remapfile), err)
+		return nil, false
+	}
+	rx.remove_runs(nil, tmpfiles)
+	return remap, true
+} // end func write_remap
+
+func (rx *reorder_ext) remove_runs(runs []string, tmpfiles []string) {
+	for _, name := range append(runs, tmpfiles...) {
+		os.Remove(filepath.Join(rx.tmpdir, name))
+	}
+} // end func remove_runs
+
+func (rx *reorder_ext) checkpoint(phase string) bool {
+	// writes the state atomically to TmpDir/checkpoint
+	rx.state.Phase = phase
+	st := rx.state
+	data := fmt.Sprintf("size=%d\nmtime=%d\nphase=%s\noffset=%d\nseq=%d\nfooter=%d\nruns=%s\nremaps=%s\n",
+		st.Size, st.Mtime, st.Phase, st.Offset, st.Seq, st.Footer, strings.Join(st.Runs, ","), strings.Join(st.Remaps, ","))
+	fp := filepath.Join(rx.tmpdir, "checkpoint")
+	if err := os.WriteFile(fp+".tmp", []byte(data), 0644); err != nil {
+		log.Printf("Error OV ReOrderOverviewExternal checkpoint err='%v'", err)
+		return false
+	}
+	if err := os.Rename(fp+".tmp", fp); err != nil {
+		log.Printf("Error OV ReOrderOverviewExternal checkpoint err='%v'", err)
+		return false
+	}
+	return true
+} // end func checkpoint
+
+func reorder_load_state(tmpdir string) (*reorder_state, error) {
+	data, err := os.ReadFile(filepath.Join(tmpdir, "checkpoint"))
+	if err != nil {
+		return nil, err
+	}
+	st := &reorder_state{Footer: -1}
+	for _, line := range strings.Split(string(data), "\n") {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		val := kv[1]
+		switch kv[0] {
+		case "size":
+			st.Size = utils.Str2int64(val)
+		case "mtime":
+			st.Mtime = utils.Str2int64(val)
+		case "phase":
+			st.Phase = val
+		case "offset":
+			st.Offset = utils.Str2int64(val)
+		case "seq":
+			st.Seq = utils.Str2uint64(val)
+		case "footer":
+			st.Footer = utils.Str2int(val)
+		case "runs":
+			if val != "" {
+				st.Runs = strings.Split(val, ",")
+			}
+		case "remaps":
+			if val != "" {
+				st.Remaps = strings.Split(val, ",")
+			}
+		}
+	}
+	switch st.Phase {
+	case reorder_phase_split, reorder_phase_dedupe, reorder_phase_write, reorder_phase_rescan, reorder_phase_swap, reorder_phase_done:
+	default:
+		return nil, fmt.Errorf("Error reorder_load_state bad phase='%s'", st.Phase)
+	}
+	if st.Footer < 0 {
+		return nil, fmt.Errorf("Error reorder_load_state no footer")
+	}
+	return st, nil
+} // end func reorder_load_state
+
+func remap_record(old uint64, new uint64, msgid string) string {
+	// same line format as WriteReMap
+	return fmt.Sprintf("%d %d %s", old, new, msgid)
+} // end func remap_record
+
+// run_rec is one line of a run file with its parsed sort key
+type run_rec struct {
+	line string // the line as stored in the run file
+	data string // overview line
+	s    string
+	i    int64
+	u1   uint64
+	u2   uint64
+}
+
+type run_kind struct {
+	name  string
+	parse func(line string) (run_rec, error)
+	less  func(a, b *run_rec) bool
+}
+
+var run_kind_msgid = &run_kind{
+	// "msgid\tseq\tline" sorted by msgid, seq
+	name: "msgid",
+	parse: func(line string) (run_rec, error) {
+		x := strings.SplitN(line, "\t", 3)
+		if len(x) != 3 {
+			return run_rec{}, fmt.Errorf("bad msgid run line")
+		}
+		return run_rec{line: line, s: x[0], u1: utils.Str2uint64(x[1]), data: x[2]}, nil
+	},
+	less: func(a, b *run_rec) bool {
+		if a.s != b.s {
+			return a.s < b.s
+		}
+		return a.u1 < b.u1
+	},
+}
+
+var run_kind_date = &run_kind{
+	// "unixepoch\tseq\tline" sorted by unixepoch, seq
+	name: "date",
+	parse: func(line string) (run_rec, error) {
+		x := strings.SplitN(line, "\t", 3)
+		if len(x) != 3 {
+			return run_rec{}, fmt.Errorf("bad date run line")
+		}
+		return run_rec{line: line, i: utils.Str2int64(x[0]), u1: utils.Str2uint64(x[1]), data: x[2]}, nil
+	},
+	less: func(a, b *run_rec) bool {
+		if a.i != b.i {
+			return a.i < b.i
+		}
+		return a.u1 < b.u1
+	},
+}
+
+var run_kind_remap = &run_kind{
+	// "old new msgid" sorted like AsortReMap
+	name: "remap",
+	parse: func(line string) (run_rec, error) {
+		x := strings.SplitN(line, " ", 3)
+		if len(x) != 3 {
+			return run_rec{}, fmt.Errorf("bad remap run line")
+		}
+		return run_rec{line: line, u1: utils.Str2uint64(x[0]), u2: utils.Str2uint64(x[1]), s: x[2]}, nil
+	},
+	less: func(a, b *run_rec) bool {
+		if a.u1 != b.u1 {
+			return a.u1 < b.u1
+		}
+		if a.u2 != b.u2 {
+			return a.u2 < b.u2
+		}
+		return a.s < b.s
+	},
+}
+
+// run_buffer collects records and spills them as sorted run files
+type run_buffer struct {
+	kind  *run_kind
+	dir   string
+	max   int
+	recs  []run_rec
+	bytes int
+	runs  []string
+	count int
+}
+
+func (rb *run_buffer) add(line string) (bool, error) {
+	rec, err := rb.kind.parse(line)
+	if err != nil {
+		return false, err
+	}
+	rb.recs = append(rb.recs, rec)
+	rb.bytes += len(line) + 128
+	if rb.bytes < rb.max {
+		return false, nil
+	}
+	return true, rb.flush()
+} // end func run_buffer.add
+
+func (rb *run_buffer) flush() error {
+	if len(rb.recs) == 0 {
+		return nil
+	}
+	recs := rb.recs
+	sort.Slice(recs, func(i, j int) bool { return rb.kind.less(&recs[i], &recs[j]) })
+	name := fmt.Sprintf("%s.%d", rb.kind.name, rb.count)
+	fh, err := os.Create(filepath.Join(rb.dir, name))
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fh)
+	for i := range recs {
+		if _, err := w.WriteString(recs[i].line + "\n"); err != nil {
+			fh.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+	rb.count++
+	rb.runs = append(rb.runs, name)
+	rb.recs, rb.bytes = nil, 0
+	return nil
+} // end func run_buffer.flush
+
+func merge_runs(kind *run_kind, dir string, runs []string, fanin int, emit func(rec *run_rec) error) ([]string, error) {
+	// merges runs in passes of fanin runs until one pass can emit all records in order
+	// returns the intermediate files, inputs are not removed so a phase can be restarted
+	var tmpfiles []string
+	for level := 0; len(runs) > fanin; level++ {
+		var next []string
+		for i := 0; i < len(runs); i += fanin {
+			j := i + fanin
+			if j > len(runs) {
+				j = len(runs)
+			}
+			name := fmt.Sprintf("%s.m%d.%d", kind.name, level, len(next))
+			fh, err := os.Create(filepath.Join(dir, name))
+			if err != nil {
+				return tmpfiles, err
+			}
+			tmpfiles = append(tmpfiles, name)
+			w := bufio.NewWriter(fh)
+			err = merge_k(kind, dir, runs[i:j], func(rec *run_rec) error {
+				_, err := w.WriteString(rec.line + "\n")
+				return err
+			})
+			if err == nil {
+				err = w.Flush()
+			}
+			if cerr := fh.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return tmpfiles, err
+			}
+			next = append(next, name)
+		}
+		runs = next
+	}
+	return tmpfiles, merge_k(kind, dir, runs, emit)
+} // end func merge_runs
+
+type run_item struct {
+	rec run_rec
+	r   *bufio.Reader
+}
+
+type run_heap struct {
+	kind  *run_kind
+	items []*run_item
+}
+
+func (h *run_heap) Len() int           { return len(h.items) }
+func (h *run_heap) Less(i, j int) bool { return h.kind.less(&h.items[i].rec, &h.items[j].rec) }
+func (h *run_heap) Swap(i, j int)      { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *run_heap) Push(x interface{}) { h.items = append(h.items, x.(*run_item)) }
+func (h *run_heap) Pop() interface{} {
+	n := len(h.items)
+	item := h.items[n-1]
+	h.items = h.items[:n-1]
+	return item
+}
+
+func (item *run_item) next(kind *run_kind) (bool, error) {
+	line, err := item.r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	if line == "" {
+		return false, nil
+	}
+	item.rec, err = kind.parse(strings.TrimSuffix(line, "\n"))
+	return err == nil, err
+} // end func run_item.next
+
+func merge_k(kind *run_kind, dir string, runs []string, emit func(rec *run_rec) error) error {
+	// k-way merge of sorted run files
+	h := &run_heap{kind: kind}
+	for _, name := range runs {
+		fh, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		item := &run_item{r: bufio.NewReaderSize(fh, 64*1024)}
+		ok, err := item.next(kind)
+		if err != nil {
+			return err
+		}
+		if ok {
+			h.items = append(h.items, item)
+		}
+	}
+	heap.Init(h)
+	for h.Len() > 0 {
+		item := h.items[0]
+		if err := emit(&item.rec); err != nil {
+			return err
+		}
+		ok, err := item.next(kind)
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+	return nil
+} // end func merge_k
@@ -0,0 +1,143 @@
+package overview
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/go-while/go-utils"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func reorderTestFile(t *testing.T, dir string, group string, n int) string {
+	// writes n lines with dates out of order and every 7th msgid repeated, returns the closed file
+	replicationTestLoad()
+	dates := []string{"Mon, 02 Jan 2006 15:04:05 -0700", "Sun, 01 Jan 2006 15:04:05 -0700", "Tue, 03 Jan 2006 15:04:05 -0700", "not a date", "Thu, 05 Jan 2006 10:04:05 -0700"}
+	hash := utils.Hash256(group)
+	for i := 0; i < n; i++ {
+		msgid := fmt.Sprintf("<r%d.%s@x>", i, group)
+		if i%7 == 6 {
+			msgid = fmt.Sprintf("<r%d.%s@x>", i-3, group)
+		}
+		ovl := OVL{Subject: fmt.Sprintf("subj %d", i), From: "a@b", Date: dates[(i*3)%len(dates)], Messageid: msgid, Bytes: 100, Lines: 3}
+		if r := Overview.GO_pi_ov("t", Construct_OVL(ovl), group, hash, dir, nil); !r.Retbool {
+			t.Fatalf("GO_pi_ov failed i=%d", i)
+		}
+	}
+	file := filepath.Join(dir, hash+".overview")
+	if ovfh, err := Open_ov("t", file); err == nil {
+		Close_ov("t", ovfh, true, true)
+	}
+	return file
+} // end func reorderTestFile
+
+func reorderTestCopy(t *testing.T, file string) string {
+	// copies file to a new dir with the same name
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(t.TempDir(), filepath.Base(file))
+	if err := os.WriteFile(dst, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dst
+} // end func reorderTestCopy
+
+func reorderTestCompare(t *testing.T, want string, got string) {
+	// overview without the footer, .remap and .stamps have to be identical
+	for _, ext := range []string{"", ".remap", ".stamps"} {
+		a, err := os.ReadFile(want + ext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(got + ext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ext == "" {
+			// the footer has the time of the rescan
+			a, b = a[:len(a)-OV_RESERVE_END], b[:len(b)-OV_RESERVE_END]
+		}
+		if len(a) == 0 || !bytes.Equal(a, b) {
+			t.Fatalf("ext='%s' differs len=%d len=%d", ext, len(a), len(b))
+		}
+	}
+	if utils.FileExists(got+".new") || utils.FileExists(got+".reorder") {
+		t.Fatal(".new or tmpdir left")
+	}
+} // end func reorderTestCompare
+
+func TestReOrderExternalSameAsInMemory(t *testing.T) {
+	group := "alt.test.reorderext"
+	file := reorderTestFile(t, t.TempDir(), group, 200)
+	ext := reorderTestCopy(t, file)
+	inmem, ok := ReOrderOverviewRemap(file, group, true, nil)
+	if !ok {
+		t.Fatal("ReOrderOverviewRemap failed")
+	}
+	runs := 0
+	opts := &ReOrderOpts{MaxMemory: 2000, MaxOpenRuns: 3, Progress: func(p ReOrderProgress) {
+		if p.Phase == reorder_phase_split && p.Runs > runs {
+			runs = p.Runs
+		}
+	}}
+	remap, ok := ReOrderOverviewExternal(ext, group, true, nil, opts)
+	if !ok {
+		t.Fatal("ReOrderOverviewExternal failed")
+	}
+	if runs < 4 {
+		t.Fatalf("runs=%d: MaxMemory did not force spills", runs)
+	}
+	// the remap is only returned while it fits into MaxMemory, the .remap sidecar has it
+	if remap != nil || len(inmem) == 0 {
+		t.Fatalf("remap=%d inmem=%d", len(remap), len(inmem))
+	}
+	reorderTestCompare(t, file, ext)
+} // end func TestReOrderExternalSameAsInMemory
+
+func TestReOrderExternalResume(t *testing.T) {
+	// stops in a phase like a crash and resumes from the checkpoint
+	group := "alt.test.reorderresume"
+	file := reorderTestFile(t, t.TempDir(), group, 200)
+	ext := reorderTestCopy(t, file)
+	if _, ok := ReOrderOverviewRemap(file, group, true, nil); !ok {
+		t.Fatal("ReOrderOverviewRemap failed")
+	}
+	type stop struct{}
+	run := func(resume bool, stopat func(p ReOrderProgress) bool) (ok bool, stopped bool) {
+		// a panic in Progress stops the run like a crash, the deferred UnlockGroup runs
+		defer func() {
+			if r := recover(); r != nil {
+				if _, isstop := r.(stop); !isstop {
+					panic(r)
+				}
+				stopped = true
+			}
+		}()
+		_, ok = ReOrderOverviewExternal(ext, group, true, nil, &ReOrderOpts{MaxMemory: 2000, MaxOpenRuns: 3, Resume: resume, Progress: func(p ReOrderProgress) {
+			if stopat != nil && stopat(p) {
+				panic(stop{})
+			}
+		}})
+		return ok, false
+	}
+	// stops after some spilled runs of split
+	if _, stopped := run(false, func(p ReOrderProgress) bool { return p.Phase == reorder_phase_split && p.Runs == 2 }); !stopped {
+		t.Fatal("split did not stop")
+	}
+	if st, err := reorder_load_state(ext + ".reorder"); err != nil || st.Phase != reorder_phase_split || len(st.Runs) != 2 {
+		t.Fatalf("split checkpoint=%+v err='%v'", st, err)
+	}
+	// resumes split, stops after the checkpoint of the merge in dedupe
+	if _, stopped := run(true, func(p ReOrderProgress) bool { return p.Phase == reorder_phase_dedupe }); !stopped {
+		t.Fatal("dedupe did not stop")
+	}
+	if st, err := reorder_load_state(ext + ".reorder"); err != nil || st.Phase != reorder_phase_dedupe {
+		t.Fatalf("dedupe checkpoint=%+v err='%v'", st, err)
+	}
+	if ok, _ := run(true, nil); !ok {
+		t.Fatal("resume failed")
+	}
+	reorderTestCompare(t, file, ext)
+} // end func TestReOrderExternalResume
@@ -0,0 +1,602 @@
+package overview
+
+/*
+ * replication of overview files with the same numbering to a follower
+ *
+ * primary: every line GO_pi_ov writes and every tombstone (NoCeM, expiry by VerifyStorage,
+ * Repair) is sent to REPLICATION_FEED as one JSON line with an increasing Seq.
+ * events are queued and written by a goroutine, ingest never waits for the writer.
+ * a full queue or a write error stops the feed: Done() is closed, Err() tells why,
+ * and the followers have to be seeded again.
+ * write the feed to a local append-only file and serve followers from that file,
+ * a follower conn as writer would fill the queue as soon as it is slow.
+ *
+ *   fh, _ := os.OpenFile("/ov/feed.log", os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+ *   seq, _ := overview.LastFeedSeq(fh) // continue an existing feed
+ *   overview.REPLICATION_FEED = overview.NewChangeFeed(fh, seq)
+ *   go func() { <-overview.REPLICATION_FEED.Done(); alert(overview.REPLICATION_FEED.Err()) }()
+ *
+ * follower: applies the events with Write_ov keeping the msgnums.
+ * a line has to be the next one after the footer's last=, a missing line stops with an error.
+ * a line applied before has to be the same as in the event, else the files differ.
+ * events up to the checkpoint are skipped, so a follower restarted from an older
+ * checkpoint catches up. a new follower starts at Seq 1, or at the Seq passed to Seed
+ * when its files were copied from the primary.
+ *
+ *   f, _ := overview.NewFollower("/ov", "/ov/feed.checkpoint")
+ *   err := f.Follow(conn) // any io.Reader, returns at EOF
+ *
+ * ReOrderOverview and RebuildOverview renumber a file on the primary and send ChangeResync:
+ * the follower stops there until the file is copied again and Seed is called.
+ *
+ * the follower runs in its own process: open files are cached by group hash,
+ * not by cachedir.
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/go-while/go-utils"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	ChangeLine      = "line"
+	ChangeTombstone = "tombstone"
+	ChangeResync    = "resync" // file renumbered on the primary, has to be copied
+)
+
+var (
+	REPLICATION_FEED        *ChangeFeed // nil does not record changes
+	REPLICATION_QUEUE       = 100000    // events queued for the feed writer, a full queue stops the feed
+	FOLLOW_CHECKPOINT_EVERY = 1000      // events between writes of the follower checkpoint
+)
+
+// ChangeEvent is one change of an overview file
+type ChangeEvent struct {
+	Seq    uint64 `json:"seq"`
+	Op     string `json:"op"` // ChangeLine, ChangeTombstone or ChangeResync
+	Group  string `json:"group,omitempty"`
+	Hash   string `json:"hash"`
+	Msgnum uint64 `json:"msgnum"`
+	Line   string `json:"line,omitempty"`  // ChangeLine: the line as written, without "\n"
+	Msgid  string `json:"msgid,omitempty"` // ChangeTombstone: msgid of the line
+}
+
+// ChangeFeed writes ChangeEvents to an append-only io.Writer
+type ChangeFeed struct {
+	mux     sync.Mutex
+	w       io.Writer
+	seq     uint64 // last Seq queued
+	written uint64 // last Seq written
+	err     error
+	closed  bool
+	queue   chan *feed_item
+	done    chan struct{} // closed when the feed stops
+	exited  chan struct{} // closed when the writer returned
+}
+
+type feed_item struct {
+	seq     uint64
+	data    []byte
+	flushed chan struct{} // Flush marker, no data
+}
+
+func NewChangeFeed(w io.Writer, seq uint64) *ChangeFeed {
+	// seq is the last Seq already in the feed, 0 for a new one
+	// starts the writer goroutine, Close stops it
+	size := REPLICATION_QUEUE
+	if size <= 0 {
+		size = 1
+	}
+	f := &ChangeFeed{w: w, seq: seq, written: seq, queue: make(chan *feed_item, size), done: make(chan struct{}), exited: make(chan struct{})}
+	go f.writer()
+	return f
+} // end func NewChangeFeed
+
+func (f *ChangeFeed) writer() {
+	// writes the queued events until Close, after a stop it only drains the queue
+	defer close(f.exited)
+	for item := range f.queue {
+		if item.flushed != nil {
+			close(item.flushed)
+			continue
+		}
+		if f.Err() != nil {
+			continue
+		}
+		if _, err := f.w.Write(item.data); err != nil {
+			f.stop(fmt.Errorf("ERROR overview.ChangeFeed seq=%d write err='%v'", item.seq, err))
+			continue
+		}
+		f.mux.Lock()
+		f.written = item.seq
+		f.mux.Unlock()
+	}
+} // end func ChangeFeed.writer
+
+func (f *ChangeFeed) stop(err error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.stop_locked(err)
+} // end func ChangeFeed.stop
+
+func (f *ChangeFeed) stop_locked(err error) {
+	// records the first error and closes done, caller holds f.mux
+	if f.err != nil {
+		return
+	}
+	f.err = err
+	close(f.done)
+	log.Printf("%v: feed stopped, followers need a new seed", err)
+} // end func ChangeFeed.stop_locked
+
+func (f *ChangeFeed) Seq() uint64 {
+	// returns the Seq of the last event written
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.written
+} // end func ChangeFeed.Seq
+
+func (f *ChangeFeed) Err() error {
+	// returns the error that stopped the feed
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.err
+} // end func ChangeFeed.Err
+
+func (f *ChangeFeed) Done() <-chan struct{} {
+	// closed when the feed stopped on a full queue or a write error
+	return f.done
+} // end func ChangeFeed.Done
+
+func (f *ChangeFeed) Flush() error {
+	// waits until the events queued before are written
+	f.mux.Lock()
+	if f.closed {
+		f.mux.Unlock()
+		return f.Err()
+	}
+	item := &feed_item{flushed: make(chan struct{})}
+	select {
+	case f.queue <- item:
+	default:
+		// emit stops the feed if the writer does not catch up
+		f.mux.Unlock()
+		return fmt.Errorf("ERROR overview.ChangeFeed Flush queue full=%d", cap(f.queue))
+	}
+	f.mux.Unlock()
+	<-item.flushed
+	return f.Err()
+} // end func ChangeFeed.Flush
+
+func (f *ChangeFeed) Close() error {
+	// writes the queued events and stops the writer, later events are dropped
+	f.mux.Lock()
+	if !f.closed {
+		f.closed = true
+		close(f.queue)
+	}
+	f.mux.Unlock()
+	<-f.exited
+	return f.Err()
+} // end func ChangeFeed.Close
+
+func (f *ChangeFeed) emit(events ...*ChangeEvent) {
+	// queues events without waiting for the writer
+	// a full queue stops the feed: a gap would break every follower
+	if f == nil || len(events) == 0 {
+		return
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.err != nil || f.closed {
+		return
+	}
+	for _, ev := range events {
+		if ev == nil {
+			continue
+		}
+		ev.Seq = f.seq + 1
+		data, err := json.Marshal(ev)
+		if err != nil {
+			f.stop_locked(fmt.Errorf("ERROR overview.ChangeFeed seq=%d err='%v'", ev.Seq, err))
+			return
+		}
+		select {
+		case f.queue <- &feed_item{seq: ev.Seq, data: append(data, '\n')}:
+			f.seq++
+		default:
+			f.stop_locked(fmt.Errorf("ERROR overview.ChangeFeed seq=%d queue full=%d", ev.Seq, cap(f.queue)))
+			return
+		}
+	}
+} // end func ChangeFeed.emit
+
+func (f *ChangeFeed) emit_line(hash string, group string, msgnum uint64, line string) {
+	if f == nil {
+		return
+	}
+	f.emit(&ChangeEvent{Op: ChangeLine, Group: group, Hash: hash, Msgnum: msgnum, Line: strings.TrimSuffix(line, "\n")})
+} // end func ChangeFeed.emit_line
+
+func (f *ChangeFeed) emit_resync(file string, group string) {
+	// called after a swap renumbered file, followers can not apply it line by line
+	if f == nil {
+		return
+	}
+	hash, err := get_hash_from_filename(file)
+	if err != nil {
+		log.Printf("ERROR overview.ChangeFeed resync err='%v'", err)
+		return
+	}
+	f.emit(&ChangeEvent{Op: ChangeResync, Group: group, Hash: hash})
+} // end func ChangeFeed.emit_resync
+
+func (f *ChangeFeed) tombstone_events(fh *os.File, offsets []int64) []*ChangeEvent {
+	// returns the events of the lines having their msgid at offsets, called before tombstoning
+	// an event is nil if its line can not be read
+	if f == nil || len(offsets) == 0 {
+		return nil
+	}
+	hash, err := get_hash_from_filename(fh.Name())
+	if err != nil {
+		log.Printf("ERROR overview.ChangeFeed tombstone err='%v'", err)
+		return nil
+	}
+	events := make([]*ChangeEvent, 0, len(offsets))
+	for _, pos := range offsets {
+		msgnum, msgid, err := line_at(fh, pos)
+		if err != nil {
+			log.Printf("ERROR overview.ChangeFeed tombstone pos=%d err='%v' fp='%s'", pos, err, filepath.Base(fh.Name()))
+			events = append(events, nil)
+			continue
+		}
+		events = append(events, &ChangeEvent{Op: ChangeTombstone, Hash: hash, Msgnum: msgnum, Msgid: msgid})
+	}
+	return events
+} // end func ChangeFeed.tombstone_events
+
+func line_at(fh *os.File, pos int64) (uint64, string, error) {
+	// returns msgnum and msgid of the line containing pos
+	start := pos
+	buf := make([]byte, 512)
+	for start > int64(OV_RESERVE_BEG) {
+		n := int64(len(buf))
+		if start-n < int64(OV_RESERVE_BEG) {
+			n = start - int64(OV_RESERVE_BEG)
+		}
+		if _, err := fh.ReadAt(buf[:n], start-n); err != nil {
+			return 0, "", err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			start = start - n + int64(i) + 1
+			break
+		}
+		start -= n
+	}
+	line, err := bufio.NewReader(io.NewSectionReader(fh, start, 1024*1024)).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return 0, "", err
+	}
+	fields := strings.Split(line, "\t")
+	if len(fields) < OVERVIEW_FIELDS {
+		return 0, "", fmt.Errorf("line_at len(fields)=%d", len(fields))
+	}
+	return utils.Str2uint64(fields[0]), fields[4], nil
+} // end func line_at
+
+func LastFeedSeq(r io.Reader) (uint64, error) {
+	// returns the Seq of the last event in a feed
+	var seq uint64
+	err := read_feed(r, func(ev *ChangeEvent) error {
+		seq = ev.Seq
+		return nil
+	})
+	return seq, err
+} // end func LastFeedSeq
+
+func read_feed(r io.Reader, fn func(ev *ChangeEvent) error) error {
+	// decodes one event per line until EOF, a cut off last line is ignored
+	br := bufio.NewReaderSize(r, 1024*1024)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if err == io.EOF {
+			// a partial line is written again by the primary
+			return nil
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		ev := &ChangeEvent{}
+		if jerr := json.Unmarshal(line, ev); jerr != nil {
+			return fmt.Errorf("ERROR overview.read_feed err='%v' line='%s'", jerr, bytes.TrimSpace(line))
+		}
+		if ferr := fn(ev); ferr != nil {
+			return ferr
+		}
+	}
+} // end func read_feed
+
+// Follower applies a ChangeFeed to the overview files below Cachedir
+type Follower struct {
+	Cachedir   string
+	Checkpoint string // file keeping the Seq of the last applied event, "" keeps it in memory
+	seq        uint64
+	pending    int                       // events applied since the checkpoint was written
+	cursors    map[string]*follow_cursor // last line found per file, replays continue there
+}
+
+// follow_cursor is the offset of the last line follow_find returned
+type follow_cursor struct {
+	msgnum uint64
+	offset int64
+}
+
+func NewFollower(cachedir string, checkpoint string) (*Follower, error) {
+	f := &Follower{Cachedir: cachedir, Checkpoint: checkpoint}
+	if checkpoint == "" {
+		return f, nil
+	}
+	data, err := os.ReadFile(checkpoint)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return f, nil
+		}
+		return nil, err
+	}
+	if f.seq, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err != nil {
+		return nil, fmt.Errorf("ERROR overview.NewFollower checkpoint='%s' err='%v'", checkpoint, err)
+	}
+	return f, nil
+} // end func NewFollower
+
+func (f *Follower) Seq() uint64 {
+	// returns the Seq of the last applied event
+	return f.seq
+} // end func Follower.Seq
+
+func (f *Follower) Seed(seq uint64) error {
+	// the files below Cachedir were copied from the primary when its feed was at seq:
+	// Follow skips events up to seq and continues with seq+1
+	f.seq = seq
+	f.cursors = nil // the files were replaced
+	return f.SaveCheckpoint()
+} // end func Follower.Seed
+
+func (f *Follower) Follow(r io.Reader) error {
+	// applies the events of r until EOF and writes the checkpoint
+	err := read_feed(r, func(ev *ChangeEvent) error {
+		if ev.Seq <= f.seq {
+			return nil
+		}
+		if ev.Seq != f.seq+1 {
+			// a new follower has to start at Seq 1 or be seeded
+			return fmt.Errorf("ERROR overview.Follower seq=%d after seq=%d: events missing", ev.Seq, f.seq)
+		}
+		if err := f.Apply(ev); err != nil {
+			return err
+		}
+		f.seq = ev.Seq
+		f.pending++
+		if f.pending >= FOLLOW_CHECKPOINT_EVERY {
+			return f.SaveCheckpoint()
+		}
+		return nil
+	})
+	if cerr := f.SaveCheckpoint(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
+} // end func Follower.Follow
+
+func (f *Follower) SaveCheckpoint() error {
+	if f.Checkpoint == "" {
+		f.pending = 0
+		return nil
+	}
+	tmp := f.Checkpoint + ".tmp"
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf("%d\n", f.seq)), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, f.Checkpoint); err != nil {
+		return err
+	}
+	f.pending = 0
+	return nil
+} // end func Follower.SaveCheckpoint
+
+func (f *Follower) Apply(ev *ChangeEvent) error {
+	// applies one event, events applied before are skipped
+	if ev.Hash == "" && ev.Group != "" {
+		ev.Hash = utils.Hash256(ev.Group)
+	}
+	if ev.Op == ChangeResync && len(ev.Hash) == 64 {
+		return fmt.Errorf("ERROR overview.Follower seq=%d group='%s' renumbered on the primary: copy fp='%s.overview' and Seed(%d)", ev.Seq, ev.Group, ev.Hash, ev.Seq)
+	}
+	if len(ev.Hash) != 64 || ev.Msgnum == 0 {
+		return fmt.Errorf("ERROR overview.Follower seq=%d invalid hash='%s' msgnum=%d", ev.Seq, ev.Hash, ev.Msgnum)
+	}
+	file := f.Cachedir + "/" + ev.Hash + ".overview"
+	if f.cursors == nil {
+		f.cursors = make(map[string]*follow_cursor)
+	}
+	cur := f.cursors[file]
+	if cur == nil {
+		cur = &follow_cursor{}
+		f.cursors[file] = cur
+	}
+	switch ev.Op {
+	case ChangeLine:
+		return follow_line(file, ev, cur)
+	case ChangeTombstone:
+		return follow_tombstone(file, ev, cur)
+	}
+	return fmt.Errorf("ERROR overview.Follower seq=%d unknown op='%s'", ev.Seq, ev.Op)
+} // end func Follower.Apply
+
+func follow_line(file string, ev *ChangeEvent, cur *follow_cursor) error {
+	// writes the line if its msgnum is the next after the footer's last=
+	who := "Follower"
+	if !strings.HasPrefix(ev.Line, fmt.Sprintf("%d\t", ev.Msgnum)) || strings.ContainsAny(ev.Line, "\r\n") {
+		return fmt.Errorf("ERROR overview.Follower seq=%d line does not match msgnum=%d", ev.Seq, ev.Msgnum)
+	}
+	ovfh, err := Open_ov(who, file)
+	if err != nil || ovfh == nil {
+		return fmt.Errorf("ERROR overview.Follower seq=%d Open_ov err='%v'", ev.Seq, err)
+	}
+	next := ovfh.Last
+	if next == 0 {
+		next = 1
+	}
+	if ev.Msgnum != next {
+		Close_ov(who, ovfh, false, false)
+		if ev.Msgnum < next {
+			// applied before: the line has to be the same, a tombstone later in the feed may be set
+			line, _, err := follow_find(file, ev.Msgnum, cur)
+			if err != nil {
+				return fmt.Errorf("ERROR overview.Follower seq=%d msgnum=%d below footer last=%d: %v", ev.Seq, ev.Msgnum, next, err)
+			}
+			if line != ev.Line && !is_tombstoned(line, ev.Line) {
+				return fmt.Errorf("ERROR overview.Follower seq=%d msgnum=%d differs from the line applied before fp='%s'", ev.Seq, ev.Msgnum, filepath.Base(file))
+			}
+			return nil
+		}
+		return fmt.Errorf("ERROR overview.Follower seq=%d msgnum=%d but footer last=%d: msgnums %d-%d missing fp='%s'", ev.Seq, ev.Msgnum, next, next, ev.Msgnum-1, filepath.Base(file))
+	}
+	new_ovfh, err, errstr := Write_ov(who, ovfh, ev.Line+"\n", false, false, false, false)
+	if err != nil {
+		Close_ov(who, ovfh, false, false)
+		return fmt.Errorf("ERROR overview.Follower seq=%d Write_ov err='%v' errstr='%s'", ev.Seq, err, errstr)
+	}
+	if new_ovfh != nil && new_ovfh.Mmap_handle != nil {
+		ovfh = new_ovfh
+	}
+	ovfh.Last = ev.Msgnum + 1
+	if _, err := Update_Footer(who, ovfh, who); err != nil {
+		Close_ov(who, ovfh, false, false)
+		return err
+	}
+	return Close_ov(who, ovfh, true, false)
+} // end func follow_line
+
+func is_tombstoned(line string, orig string) bool {
+	// true if line is orig with its msgid tombstoned
+	lf, of := strings.Split(line, "\t"), strings.Split(orig, "\t")
+	if len(lf) < OVERVIEW_FIELDS || len(lf) != len(of) || len(of[4]) == 0 || of[4][0] != '<' {
+		return false
+	}
+	lf[4] = "<" + strings.TrimPrefix(lf[4], "X")
+	return strings.Join(lf, "\t") == orig
+} // end func is_tombstoned
+
+func follow_find(file string, msgnum uint64, cur *follow_cursor) (string, int64, error) {
+	// returns the line with msgnum without "\n" and its offset
+	// starts at cur if it is not after msgnum: a replay does not rescan the file for every line
+	fh, err := os.Open(file)
+	if err != nil {
+		return "", 0, err
+	}
+	defer fh.Close()
+	if cur != nil && cur.msgnum > 0 && cur.msgnum <= msgnum {
+		line, offset, err := follow_scan(fh, cur.offset, msgnum, cur.msgnum)
+		if err != nil {
+			return "", 0, err
+		}
+		if line != "" {
+			cur.msgnum, cur.offset = msgnum, offset
+			return line, offset, nil
+		}
+	}
+	line, offset, err := follow_scan(fh, int64(OV_RESERVE_BEG), msgnum, 0)
+	if err != nil {
+		return "", 0, err
+	}
+	if line == "" {
+		return "", 0, fmt.Errorf("msgnum=%d not found fp='%s'", msgnum, filepath.Base(file))
+	}
+	if cur != nil {
+		cur.msgnum, cur.offset = msgnum, offset
+	}
+	return line, offset, nil
+} // end func follow_find
+
+func follow_scan(fh *os.File, offset int64, msgnum uint64, first uint64) (string, int64, error) {
+	// reads lines from offset until msgnum, "" if not found
+	// first > 0 is the msgnum expected at offset, another line there returns ""
+	if _, err := fh.Seek(offset, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+	want := fmt.Sprintf("%d\t", msgnum)
+	r := bufio.NewReaderSize(fh, 1024*1024)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", 0, err
+		}
+		if len(line) == 0 || line[0] == 0 {
+			break
+		}
+		if first > 0 {
+			if !strings.HasPrefix(line, fmt.Sprintf("%d\t", first)) {
+				// the file changed below the cursor
+				break
+			}
+			first = 0
+		}
+		if strings.HasPrefix(line, want) {
+			return strings.TrimSuffix(line, "\n"), offset, nil
+		}
+		offset += int64(len(line))
+		if err == io.EOF {
+			break
+		}
+	}
+	return "", 0, nil
+} // end func follow_find
+
+func follow_tombstone(file string, ev *ChangeEvent, cur *follow_cursor) error {
+	// tombstones the line with msgnum and msgid under the group lock
+	who := "Follower"
+	if err := OV_handler.LockGroup(who, ev.Hash); err != nil {
+		return err
+	}
+	defer OV_handler.UnlockGroup(who, ev.Hash)
+	line, offset, err := follow_find(file, ev.Msgnum, cur)
+	if err != nil {
+		return fmt.Errorf("ERROR overview.Follower seq=%d tombstone %v", ev.Seq, err)
+	}
+	fields := strings.Split(line, "\t")
+	if len(fields) < OVERVIEW_FIELDS || len(fields[4]) == 0 {
+		return fmt.Errorf("ERROR overview.Follower seq=%d tombstone msgnum=%d bad line fp='%s'", ev.Seq, ev.Msgnum, filepath.Base(file))
+	}
+	if fields[4][0] != '<' {
+		// tombstoned before
+		return nil
+	}
+	if fields[4] != ev.Msgid {
+		return fmt.Errorf("ERROR overview.Follower seq=%d tombstone msgnum=%d msgid='%s' != '%s' fp='%s'", ev.Seq, ev.Msgnum, fields[4], ev.Msgid, filepath.Base(file))
+	}
+	fh, err := os.OpenFile(file, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	// not tombstone_offsets: a follower does not feed its own changes
+	pos := offset + int64(len(fields[0])+len(fields[1])+len(fields[2])+len(fields[3])+4)
+	if _, err := fh.WriteAt([]byte{'X'}, pos); err != nil {
+		return err
+	}
+	return fh.Sync()
+} // end func follow_tombstone
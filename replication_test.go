@@ -0,0 +1,125 @@
+package overview
+
+import (
+	"fmt"
+	"github.com/go-while/go-utils"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var replication_test_load sync.Once
+
+func replicationTestLoad() {
+	// the follower writes with Open_ov/Write_ov, they need the handler
+	replication_test_load.Do(func() {
+		AUTOINDEX = false
+		Overview.Load_Overview(2, 2, 8, 0, 2, 3, false, false, make(chan bool, 1), false)
+	})
+} // end func replicationTestLoad
+
+func replicationTestLine(group string, msgnum uint64) string {
+	return fmt.Sprintf("%d\tsubj %d\ta@b\tMon, 02 Jan 2006 15:04:05 -0700\t<%d.%s@x>\t\t100\t3\tnntp %s:%d", msgnum, msgnum, msgnum, group, group, msgnum)
+} // end func replicationTestLine
+
+func replicationTestFollow(f *Follower, seq uint64, events ...*ChangeEvent) error {
+	// sends events through a ChangeFeed starting after seq over an io.Pipe to f
+	pr, pw := io.Pipe()
+	go func() {
+		feed := NewChangeFeed(pw, seq)
+		feed.emit(events...)
+		pw.CloseWithError(feed.Close())
+	}()
+	err := f.Follow(pr)
+	pr.Close() // unblocks the feed if Follow stopped early
+	return err
+} // end func replicationTestFollow
+
+func TestFollowerPipe(t *testing.T) {
+	replicationTestLoad()
+	group := "alt.test.follower"
+	var events []*ChangeEvent
+	for n := uint64(1); n <= 3; n++ {
+		events = append(events, &ChangeEvent{Op: ChangeLine, Group: group, Msgnum: n, Line: replicationTestLine(group, n)})
+	}
+	events = append(events, &ChangeEvent{Op: ChangeTombstone, Group: group, Msgnum: 2, Msgid: "<2." + group + "@x>"})
+
+	dir := t.TempDir()
+	f, err := NewFollower(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replicationTestFollow(f, 0, events...); err != nil {
+		t.Fatal(err)
+	}
+	if f.Seq() != 4 {
+		t.Fatalf("seq=%d want 4", f.Seq())
+	}
+	file := dir + "/" + utils.Hash256(group) + ".overview"
+	line, _, err := follow_find(file, 2, nil)
+	if err != nil || !is_tombstoned(line, events[1].Line) {
+		t.Fatalf("line 2='%s' err='%v' is not tombstoned", line, err)
+	}
+
+	// replayed lines applied before are accepted if they match, tombstone included
+	f2, _ := NewFollower(dir, "")
+	if err := replicationTestFollow(f2, 0, events...); err != nil {
+		t.Fatal(err)
+	}
+	// a replayed line differing from the file is an error
+	changed := *events[0]
+	changed.Line = strings.Replace(changed.Line, "subj 1", "subj X", 1)
+	f3, _ := NewFollower(dir, "")
+	if err := replicationTestFollow(f3, 0, &changed); err == nil {
+		t.Fatal("no error for a line differing from the one applied before")
+	}
+} // end func TestFollowerPipe
+
+func TestFollowerStartSeq(t *testing.T) {
+	replicationTestLoad()
+	group := "alt.test.followerseq"
+	line := func() *ChangeEvent {
+		return &ChangeEvent{Op: ChangeLine, Group: group, Msgnum: 1, Line: replicationTestLine(group, 1)}
+	}
+	f, _ := NewFollower(t.TempDir(), "")
+	// a new follower does not start in the middle of a feed
+	if err := replicationTestFollow(f, 4, line()); err == nil || f.Seq() != 0 {
+		t.Fatalf("follower started at seq=5 err='%v'", err)
+	}
+	// seeded it continues after the seed
+	if err := f.Seed(4); err != nil {
+		t.Fatal(err)
+	}
+	if err := replicationTestFollow(f, 4, line()); err != nil || f.Seq() != 5 {
+		t.Fatalf("seeded follower seq=%d err='%v'", f.Seq(), err)
+	}
+	// a resync event stops the follower
+	if err := replicationTestFollow(f, 5, &ChangeEvent{Op: ChangeResync, Group: group}); err == nil || f.Seq() != 5 {
+		t.Fatalf("resync event seq=%d err='%v'", f.Seq(), err)
+	}
+} // end func TestFollowerStartSeq
+
+func TestChangeFeedQueueFull(t *testing.T) {
+	// a writer that does not read stops the feed instead of blocking emit
+	queue := REPLICATION_QUEUE
+	REPLICATION_QUEUE = 2
+	defer func() { REPLICATION_QUEUE = queue }()
+	pr, pw := io.Pipe()
+	feed := NewChangeFeed(pw, 0)
+	for n := uint64(1); n <= 5; n++ {
+		feed.emit(&ChangeEvent{Op: ChangeLine, Group: "alt.test.feedfull", Msgnum: n, Line: replicationTestLine("alt.test.feedfull", n)})
+	}
+	select {
+	case <-feed.Done():
+	default:
+		t.Fatal("feed not stopped with a full queue")
+	}
+	if feed.Err() == nil {
+		t.Fatal("stopped feed without Err")
+	}
+	pr.Close() // unblocks the writer
+	if err := feed.Close(); err == nil {
+		t.Fatal("Close returned no error for a stopped feed")
+	}
+} // end func TestChangeFeedQueueFull
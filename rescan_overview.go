@@ -3,6 +3,7 @@ package overview
 import (
 	"database/sql"
 	"fmt"
+	"io"
 	//"github.com/edsrzf/mmap-go"
 	"github.com/go-while/go-utils"
 	"log"
@@ -20,21 +21,28 @@ type CHECK_GROUPS struct {
 	file_path string
 }
 
+func RescanHelp(w io.Writer) {
+	// writes the rescan modes to w, Verify and Repair take named options instead
+	fmt.Fprintln(w, "--rescan-mode=help:")
+	fmt.Fprintln(w, " > OVERVIEW RESCAN options: no-fix, scan-only")
+	fmt.Fprintln(w, "   mode: 0 == full rescan with verify fields")
+	fmt.Fprintln(w, "   mode: 1 == check only header")
+	fmt.Fprintln(w, "   mode: 2 == check only footer")
+	fmt.Fprintln(w, "   mode: 3 == like mode 1 + 2 + count only lines and match msgnums==lines")
+	fmt.Fprintln(w, "   mode: 4 == like mode 0 but checks footer after (not before) verify lines/fields")
+	fmt.Fprintln(w, "   mode: 5 == like mode 0 but checks every msgid if head+body exists in RESCAN_STORE")
+	fmt.Fprintln(w, "   ")
+	fmt.Fprintln(w, " > FIX / REBUILD options")
+	fmt.Fprintln(w, "   mode: 997 == like mode 3 with quíck rebuild ActiveMap")
+	fmt.Fprintln(w, "   mode: 998 == like mode 0 with deep check and safer but slower rebuild ActiveMap")
+	fmt.Fprintln(w, "   mode: 999 == like mode 4 with try fix-footer!")
+	fmt.Fprintln(w, "   mode: 1000 == only insert messageidhash to mysql")
+	fmt.Fprintln(w, "   mode: 1001 == only insert short messageidhash with offset into overview to mysql")
+} // end func RescanHelp
+
 func Rescan_help() {
-	fmt.Println("--rescan-mode=help:")
-	fmt.Println(" > OVERVIEW RESCAN options: no-fix, scan-only")
-	fmt.Println("   mode: 0 == full rescan with verify fields")
-	fmt.Println("   mode: 1 == check only header")
-	fmt.Println("   mode: 2 == check only footer")
-	fmt.Println("   mode: 3 == like mode 1 + 2 + count only lines and match msgnums==lines")
-	fmt.Println("   mode: 4 == like mode 0 but checks footer after (not before) verify lines/fields")
-	// FIXME TODO fmt.Println("   mode: 5 == like mode 0 but checks every msgid if head+body exists on disk")
-	fmt.Println("   ")
-	fmt.Println(" > FIX / REBUILD options")
-	fmt.Println("   mode: 997 == like mode 3 with quíck rebuild ActiveMap")
-	fmt.Println("   mode: 998 == like mode 0 with deep check and safer but slower rebuild ActiveMap")
-	fmt.Println("   mode: 999 == like mode 4 with try fix-footer!")
-	fmt.Println("   mode: 1000 == only insert messageidhash to mysql")
+	// Deprecated: prints RescanHelp and exits, use RescanHelp
+	RescanHelp(os.Stdout)
 	os.Exit(0)
 }
 
@@ -61,6 +69,9 @@ func Rescan_Overview(who string, file_path string, group string, mode int, DEBUG
 	// verify fields
 	// check footer
 
+	if mode == 5 {
+		return rescan_storage(who, file_path, group, DEBUG)
+	}
 	if mode < 1000 {
 		log.Printf(" -> Start Rescan_Overview: fp='%s' group='%s' mode=%d", file_path, group, mode)
 	}
@@ -93,6 +104,18 @@ func Rescan_Overview(who string, file_path string, group string, mode int, DEBUG
 	endindex := len_mmap - 1
 
 	msgidhashmap := make(map[string][]Msgidhash_item)
+	shorthashmap := make(map[string][]Shorthash_item)
+	var fileid uint32
+	if mode == 1001 {
+		if db == nil {
+			log.Printf("ERROR Rescan_OV mode=1001 mysql_db=nil")
+			return false, 0
+		}
+		if fileid, err = ShortHashFileID(file_path, db); err != nil {
+			log.Printf("ERROR Rescan_OV mode=1001 ShortHashFileID err='%v'", err)
+			return false, 0
+		}
+	}
 
 	if mode < 1000 {
 		log.Printf(" --> rescan_OV mode=%d len=%d startindex=%d", mode, len_mmap, startindex)
@@ -128,6 +151,7 @@ func Rescan_Overview(who string, file_path string, group string, mode int, DEBUG
 	uniq_msgids := make(map[string]int)
 	var list_msgids []string
 	badfooter := false
+	next_beg := startindex // offset of the next line
 
 	if mode < 1000 {
 		log.Printf("rescan_OV: startindex=%d endindex=%d", startindex, endindex)
@@ -153,7 +177,7 @@ rescan_OV:
 
 			// found frees: <nul> bytes
 			if frees > 0 {
-				if mode == 1000 {
+				if mode == 1000 || mode == 1001 {
 					break rescan_OV
 				}
 				log.Printf(" --> Rescan_OV frees=%d@i=%d tabs=%d newlines=%d fp='%s'", frees, i, tabs, newlines, filepath.Base(file_path))
@@ -298,6 +322,8 @@ rescan_OV:
 				log.Printf("ERROR Rescan_OV#1 @line=%d newlines=%d tabs=%d startindex=%d position=%d", lines, newlines, tabs, startindex, position)
 				return false, 0
 			}
+			line_beg := next_beg // len(line) counts runes of bytes >= 0x80 twice
+			next_beg = position + 1
 			last_newline_pos = position
 
 			if position == OV_RESERVE_BEG && tabs == 0 {
@@ -386,11 +412,14 @@ rescan_OV:
 						}
 						return false, 0
 					}
-					key := string(messageidhash[0:3]) // printhashsql cut first N chars
+					key := string(messageidhash[0:write_width()]) // printhashsql cut first N chars
 					var item Msgidhash_item
 					item.Hash = messageidhash
 					item.Size = bytes
 					msgidhashmap[key] = append(msgidhashmap[key], item)
+					if OV_MsgidBloom != nil {
+						OV_MsgidBloom.Add(messageidhash)
+					}
 					// insert sql
 					last_line, last_newlines, last_tabs, last_beg = line, newlines, tabs, position-len(line) // capture
 					line, newlines, tabs = "", 0, 0                                                          // reset looped values and try to find next line
@@ -399,11 +428,16 @@ rescan_OV:
 				}
 
 				if mode == 1001 {
-					// insert to mysql: shorted messageidhash with offsets into history file
-					if db == nil {
-						log.Printf("ERROR Rescan_OV mode=1001 mysql_db=nil")
-						return false, 0
+					// insert to mysql: shorted messageidhash with offset of the line in this overview file
+					if len(fields[4]) > 0 && (fields[4][0] == '<' || fields[4][0] == 'X') { // a tombstone has 'X' over '<'
+						messageidhash := utils.Hash256("<"+fields[4][1:])
+						key, _ := short_key(messageidhash)
+						shorthashmap[key] = append(shorthashmap[key], Shorthash_item{Hash: messageidhash, File: fileid, Offset: int64(line_beg)})
 					}
+					last_line, last_newlines, last_tabs, last_beg = line, newlines, tabs, position-len(line) // capture
+					line, newlines, tabs = "", 0, 0                                                          // reset looped values and try to find next line
+					position++
+					continue rescan_OV
 				}
 
 				msgid := fields[4]
@@ -413,6 +447,10 @@ rescan_OV:
 				full_xref_str := fields[8]
 
 				// start verify fields
+				if len(msgid) > 1 && msgid[0] == 'X' {
+					// tombstone: 'X' over '<', see tombstone_offsets
+					msgid = "<" + msgid[1:]
+				}
 				if !isvalidmsgid(msgid, false) {
 					log.Printf("ERROR Rescan_OV#5 @line=%d !isvalidmsgid msgnum=%d", lines, msgnum)
 					return false, 0
@@ -520,6 +558,28 @@ rescan_OV:
 		return true, last_msgnum
 	}
 
+	if mode == 1001 {
+		var sql_ins int
+		for key, list := range shorthashmap {
+			for len(list) > 0 {
+				n := len(list)
+				if n > Flushmax {
+					n = Flushmax
+				}
+				if err := ShortMsgIDhash2mysqlMany(key, list[:n], db); err != nil {
+					log.Printf("ERROR Rescan_OV mode=1001 group='%s' err='%v'", group, err)
+					return false, last_msgnum
+				}
+				sql_ins += n
+				list = list[n:]
+			}
+		}
+		if DEBUG {
+			log.Printf("Rescan_OV mode=1001 group='%s' sql_ins=%d", group, sql_ins)
+		}
+		return true, last_msgnum
+	}
+
 	var gibb int
 	toend := len_mmap - position
 	last_end := last_beg + len(last_line)
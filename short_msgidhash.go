@@ -0,0 +1,375 @@
+package overview
+
+/*
+ * short msgidhashs with offsets (Rescan mode 1001)
+ *
+ * instead of the full hash the s_xxx tables store the first SHORT_HASH_LEN hex chars
+ * of a msgidhash plus a file id and the offset of a line in that file.
+ * a row needs ~21 bytes instead of ~66 in the h_xxx tables.
+ *
+ * short hashs collide: a lookup reads every referenced line and confirms it by
+ *   field 4 is the message-id (overview files) or
+ *   field 0 is the full msgidhash (history.log)
+ * a tombstoned overview line confirms as dropped.
+ *
+ * setup:
+ *   overview.ShortHashCreateSchema(db, "InnoDB")
+ *   overview.SHORT_HASH_DB = db // IsMsgidHashSQL asks the s_xxx tables, swaps reindex them
+ * backfill:
+ *   overview.Rescan_Overview(who, file, group, 1001, false, db, nil)
+ *
+ * the s_xxx tables have no stat column: SetStat writes the stat to the h_xxx tables,
+ * IsMsgidHashSQL reads them first and the s_xxx tables only if no h_xxx row exists.
+ * OV_MsgidBloom does not know short hashs and is not asked for them.
+ *
+ * a rewritten overview file (reorder, rebuild) gets new offsets:
+ * finish_reordered_overview calls ShortHashReindex if SHORT_HASH_DB is set.
+ *
+ * file ids are kept in msgidhash_files. the s_xxx tables always have SHORT_HASH_WIDTH,
+ * MigrateShardWidth does not touch them.
+ */
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/go-while/go-utils"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	SHORT_HASH_LEN   = 16        // hex chars of a msgidhash kept in the s_xxx tables
+	SHORT_HASH_WIDTH = 2         // width of the s_xxx table names
+	SHORT_LINE_MAX   = 64 * 1024 // max length of a referenced line
+
+	SHORT_HASH_DB *sql.DB = nil // enables the s_xxx tables in IsMsgidHashSQL and ShortHashReindex on swaps
+
+	short_files = &short_file_cache{ids: make(map[string]uint32), paths: make(map[uint32]string)}
+)
+
+type short_file_cache struct {
+	mux   sync.RWMutex
+	ids   map[string]uint32 // key: file path
+	paths map[uint32]string // key: file id
+}
+
+// Shorthash_item is a row of the s_xxx tables
+type Shorthash_item struct {
+	Hash   string // full msgidhash, cut when inserted
+	File   uint32
+	Offset int64
+}
+
+// ShortHashRef points to the line confirming a msgidhash
+type ShortHashRef struct {
+	File      string
+	Offset    int64
+	Line      string
+	Tombstone bool // the line is tombstoned, the article was removed
+}
+
+func ShortHashCreateSchema(db *sql.DB, engine string) error {
+	// creates msgidhash_files and the s_xxx tables if missing
+	if engine == "" {
+		engine = "InnoDB"
+	}
+	if err := check_width(SHORT_HASH_WIDTH); err != nil {
+		return err
+	}
+	if SHORT_HASH_LEN <= SHORT_HASH_WIDTH || SHORT_HASH_LEN > 64 {
+		return fmt.Errorf("ERROR overview.ShortHashCreateSchema SHORT_HASH_LEN=%d", SHORT_HASH_LEN)
+	}
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS `msgidhash_files` (`id` int(10) unsigned NOT NULL AUTO_INCREMENT, `path` varchar(255) NOT NULL, PRIMARY KEY (`id`), UNIQUE KEY (`path`)) ENGINE=InnoDB DEFAULT CHARSET=latin1;"); err != nil {
+		log.Printf("ERROR overview.ShortHashCreateSchema files err='%v'", err)
+		return err
+	}
+	for _, key := range shard_keys(SHORT_HASH_WIDTH) {
+		query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS `s_%s` (  `hash` char(%d) NOT NULL,  `file` int(10) unsigned NOT NULL,  `offset` int(10) unsigned NOT NULL, PRIMARY KEY (`hash`, `file`, `offset`)) ENGINE=%s DEFAULT CHARSET=latin1 COLLATE=latin1_bin;", key, SHORT_HASH_LEN-SHORT_HASH_WIDTH, engine)
+		if _, err := db.Exec(query); err != nil {
+			log.Printf("ERROR overview.ShortHashCreateSchema table='s_%s' err='%v'", key, err)
+			return err
+		}
+	}
+	return nil
+} // end func ShortHashCreateSchema
+
+func ShortHashFileID(file_path string, db *sql.DB) (uint32, error) {
+	// returns the id of file_path, registers it if new
+	short_files.mux.RLock()
+	id, exists := short_files.ids[file_path]
+	short_files.mux.RUnlock()
+	if exists {
+		return id, nil
+	}
+	if len(file_path) > 255 {
+		return 0, fmt.Errorf("ERROR overview.ShortHashFileID len(path)=%d > 255", len(file_path))
+	}
+	if _, err := db.Exec("INSERT IGNORE INTO msgidhash_files (path) VALUES (?)", file_path); err != nil {
+		log.Printf("ERROR overview.ShortHashFileID insert path='%s' err='%v'", file_path, err)
+		return 0, err
+	}
+	if err := db.QueryRow("SELECT id FROM msgidhash_files WHERE path = ?", file_path).Scan(&id); err != nil {
+		log.Printf("ERROR overview.ShortHashFileID select path='%s' err='%v'", file_path, err)
+		return 0, err
+	}
+	short_files.set(id, file_path)
+	return id, nil
+} // end func ShortHashFileID
+
+func short_file_path(id uint32, db *sql.DB) (string, error) {
+	short_files.mux.RLock()
+	file_path, exists := short_files.paths[id]
+	short_files.mux.RUnlock()
+	if exists {
+		return file_path, nil
+	}
+	if err := db.QueryRow("SELECT path FROM msgidhash_files WHERE id = ?", id).Scan(&file_path); err != nil {
+		return "", err
+	}
+	short_files.set(id, file_path)
+	return file_path, nil
+} // end func short_file_path
+
+func (c *short_file_cache) set(id uint32, file_path string) {
+	c.mux.Lock()
+	c.ids[file_path] = id
+	c.paths[id] = file_path
+	c.mux.Unlock()
+} // end func short_file_cache.set
+
+func short_key(messageidhash string) (string, string) {
+	// returns table key and the stored part of the short hash
+	return messageidhash[:SHORT_HASH_WIDTH], messageidhash[SHORT_HASH_WIDTH:SHORT_HASH_LEN]
+} // end func short_key
+
+func check_short_item(item Shorthash_item) error {
+	if len(item.Hash) != 64 || item.File == 0 || item.Offset < 0 || item.Offset > math.MaxUint32 {
+		return fmt.Errorf("ERROR overview.ShortMsgIDhash2mysql bad item hash='%s' file=%d offset=%d", item.Hash, item.File, item.Offset)
+	}
+	return nil
+} // end func check_short_item
+
+func ShortMsgIDhash2mysql(messageidhash string, file uint32, offset int64, db *sql.DB) (bool, error) {
+	// stores the short messageidhash pointing to offset in file, false if exists
+	item := Shorthash_item{Hash: messageidhash, File: file, Offset: offset}
+	if err := check_short_item(item); err != nil {
+		return false, err
+	}
+	key, short := short_key(messageidhash)
+	res, err := db.Exec("INSERT IGNORE INTO s_"+key+" (hash, file, offset) VALUES (?,?,?)", short, file, offset)
+	if err != nil {
+		log.Printf("ERROR overview.ShortMsgIDhash2mysql err='%v'", err)
+		return false, err
+	}
+	rowCnt, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowCnt == 1, nil
+} // end func ShortMsgIDhash2mysql
+
+func ShortMsgIDhash2mysqlMany(key string, list []Shorthash_item, db *sql.DB) error {
+	// inserts list into s_key, existing rows are ignored
+	// lock wait timeouts and deadlocks are retried like HashWriter does
+	if len(list) == 0 {
+		return nil
+	}
+	var vals []interface{}
+	query := "INSERT IGNORE INTO s_" + key + " (hash, file, offset) VALUES "
+	for _, item := range list {
+		if err := check_short_item(item); err != nil {
+			return err
+		}
+		ikey, short := short_key(item.Hash)
+		if ikey != key {
+			return fmt.Errorf("ERROR overview.ShortMsgIDhash2mysqlMany key=%s hash='%s'", key, item.Hash)
+		}
+		query += "(?,?,?),"
+		vals = append(vals, short, item.File, item.Offset)
+	}
+	query = strings.TrimSuffix(query, ",")
+	cfg := HashWriterConfig{MaxRetries: 10, BackoffBase: 100 * time.Millisecond, BackoffMax: 30 * time.Second}
+	insert := func() error { _, err := db.Exec(query, vals...); return err }
+	if err := insert_retry(context.Background(), key, insert, cfg); err != nil {
+		log.Printf("ERROR overview.ShortMsgIDhash2mysqlMany key=%s list=%d err='%v'", key, len(list), err)
+		return err
+	}
+	return nil
+} // end func ShortMsgIDhash2mysqlMany
+
+func IsShortMsgidHash(messageidhash string, db *sql.DB) (bool, *ShortHashRef, error) {
+	// looks up the short messageidhash and confirms it by reading the referenced lines
+	if len(messageidhash) != 64 {
+		return false, nil, fmt.Errorf("ERROR overview.IsShortMsgidHash len(messageidhash)=%d != 64", len(messageidhash))
+	}
+	key, short := short_key(messageidhash)
+	rows, err := db.Query("SELECT file, offset FROM s_"+key+" WHERE hash = ?", short)
+	if err != nil {
+		log.Printf("ERROR overview.IsShortMsgidHash err='%v'", err)
+		return false, nil, err
+	}
+	type ref struct {
+		file   uint32
+		offset int64
+	}
+	var refs []ref
+	for rows.Next() {
+		var r ref
+		if err := rows.Scan(&r.file, &r.offset); err != nil {
+			rows.Close()
+			return false, nil, err
+		}
+		refs = append(refs, r)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return false, nil, err
+	}
+	// read the lines after rows is closed, short_file_path may need a connection
+	for _, r := range refs {
+		file_path, err := short_file_path(r.file, db)
+		if err != nil {
+			log.Printf("ERROR overview.IsShortMsgidHash file=%d err='%v'", r.file, err)
+			continue
+		}
+		line, err := ReadLineAt(file_path, r.offset)
+		if err != nil {
+			// file expired or rewritten, another ref may confirm
+			continue
+		}
+		if confirmed, tombstone := short_confirm(line, messageidhash); confirmed {
+			return true, &ShortHashRef{File: file_path, Offset: r.offset, Line: line, Tombstone: tombstone}, nil
+		}
+	}
+	return false, nil, nil
+} // end func IsShortMsgidHash
+
+func short_dupe_check(messageidhash string) (bool, bool, string, error) {
+	// IsMsgidHashSQL without h_xxx row: asks the s_xxx tables if SHORT_HASH_DB is set
+	// returns found, drop if tombstoned and no stat: the s_xxx tables have none
+	if SHORT_HASH_DB == nil {
+		return false, false, "", nil
+	}
+	found, ref, err := IsShortMsgidHash(messageidhash, SHORT_HASH_DB)
+	if err != nil || !found {
+		return false, false, "", err
+	}
+	return true, ref.Tombstone, "", nil
+} // end func short_dupe_check
+
+func ReadLineAt(file_path string, offset int64) (string, error) {
+	// returns the line starting at offset without newline
+	fh, err := os.Open(file_path)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+	buf := make([]byte, 4096)
+	var line []byte
+	for len(line) < SHORT_LINE_MAX {
+		n, err := fh.ReadAt(buf, offset+int64(len(line)))
+		if i := strings.IndexByte(string(buf[:n]), '\n'); i >= 0 {
+			return string(append(line, buf[:i]...)), nil
+		}
+		line = append(line, buf[:n]...)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("ERROR overview.ReadLineAt no newline fp='%s' offset=%d", file_path, offset)
+} // end func ReadLineAt
+
+func short_confirm(line string, messageidhash string) (confirmed bool, tombstone bool) {
+	// a tombstone has 'X' over the '<' of the msgid
+	fields := strings.Split(line, "\t")
+	if fields[0] == messageidhash {
+		return true, false // history.log
+	}
+	if len(fields) < OVERVIEW_FIELDS || fields[4] == "" {
+		return false, false
+	}
+	switch fields[4][0] {
+	case '<':
+		return utils.Hash256(fields[4]) == messageidhash, false
+	case 'X':
+		if utils.Hash256("<"+fields[4][1:]) == messageidhash {
+			return true, true
+		}
+	}
+	return false, false
+} // end func short_confirm
+
+func ShortHashReindex(file_path string, db *sql.DB) (int, error) {
+	// deletes the rows of file_path and inserts the offsets of its current lines
+	// lookups miss the msgidhashs of file_path until it returns
+	id, err := ShortHashFileID(file_path, db)
+	if err != nil {
+		return 0, err
+	}
+	fh, err := os.Open(file_path)
+	if err != nil {
+		return 0, err
+	}
+	defer fh.Close()
+	if _, err := fh.Seek(int64(OV_RESERVE_BEG), io.SeekStart); err != nil {
+		return 0, err
+	}
+	bykey := make(map[string][]Shorthash_item)
+	r := bufio.NewReaderSize(fh, 1024*1024)
+	offset := int64(OV_RESERVE_BEG)
+	for {
+		line, rerr := r.ReadString('\n')
+		if rerr != nil && rerr != io.EOF {
+			return 0, rerr
+		}
+		if len(line) == 0 || line[0] == 0 {
+			// zero-filled space before the footer
+			break
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) >= OVERVIEW_FIELDS && len(fields[4]) > 0 && (fields[4][0] == '<' || fields[4][0] == 'X') {
+			msgid := "<" + fields[4][1:]
+			messageidhash := utils.Hash256(msgid)
+			key, _ := short_key(messageidhash)
+			bykey[key] = append(bykey[key], Shorthash_item{Hash: messageidhash, File: id, Offset: offset})
+		}
+		offset += int64(len(line))
+		if rerr == io.EOF {
+			break
+		}
+	}
+	for _, key := range shard_keys(SHORT_HASH_WIDTH) {
+		if _, err := db.Exec("DELETE FROM s_"+key+" WHERE file = ?", id); err != nil {
+			log.Printf("ERROR overview.ShortHashReindex table='s_%s' err='%v'", key, err)
+			return 0, err
+		}
+	}
+	var inserted int
+	for key, list := range bykey {
+		for len(list) > 0 {
+			n := len(list)
+			if n > Flushmax {
+				n = Flushmax
+			}
+			if err := ShortMsgIDhash2mysqlMany(key, list[:n], db); err != nil {
+				return inserted, err
+			}
+			inserted += n
+			list = list[n:]
+		}
+	}
+	if DEBUG_OV {
+		log.Printf("ShortHashReindex fp='%s' file=%d inserted=%d", file_path, id, inserted)
+	}
+	return inserted, nil
+} // end func ShortHashReindex
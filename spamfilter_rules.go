@@ -0,0 +1,352 @@
+package overview
+
+/*
+ * spamfilter rule files
+ *
+ * one rule per line, fields separated by a single TAB, lines starting with # are comments
+ *
+ *   id <TAB> field <TAB> kind <TAB> pattern
+ *
+ *   subj-0001	subj	contains	paypal.txt
+ *   from-0001	from	suffix	@example.invalid
+ *   subj-0002	subj	regex	(?i)^buy .* online$
+ *   from-0002	from	wildmat	*@*.example.com,!*@ok.example.com
+ *
+ * field: subj, from, msgid
+ * kind: match, prefix, suffix, contains (case insensitive)
+ *       exact (case sensitive match)
+ *       normalized (pattern equals the subject normalized like FloodFilter counts it)
+ *       regex (Go regexp syntax, case sensitive unless the pattern sets (?i))
+ *       wildmat (INN style: * ? [..], comma separated list, ! negates, last match wins, case insensitive)
+ *
+ * the pattern is everything after the third TAB, leading and trailing spaces are kept.
+ * ids have to be unique over all loaded files and are logged when a rule fires.
+ */
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	OV_Spamfilter          SPAMFILTER
+	SPAMFILTER_RULES_EXT   = ".rules" // files loaded from a rules directory
+	builtin_spamrules_once sync.Once
+	builtin_spamrules_map  map[string][]*SpamRule
+)
+
+// SpamRule is one rule of a SPAMFILTER
+type SpamRule struct {
+	Id      string
+	Field   string // "subj", "from" or "msgid"
+	Kind    string // match, exact, normalized, prefix, suffix, contains, regex, wildmat
+	Pattern string
+	lower   string
+	re      *regexp.Regexp
+	wild    []wildmat_pattern
+}
+
+type wildmat_pattern struct {
+	negate bool
+	re     *regexp.Regexp
+}
+
+func NewSpamRule(id string, field string, kind string, pattern string) (*SpamRule, error) {
+	switch field {
+	case "subj", "from", "msgid":
+	default:
+		return nil, fmt.Errorf("Error NewSpamRule id='%s' unknown field='%s'", id, field)
+	}
+	return compile_rule(id, field, kind, pattern)
+} // end func NewSpamRule
+
+func compile_rule(id string, field string, kind string, pattern string) (*SpamRule, error) {
+	// compiles a rule without checking field, used by spamfilter and view rules
+	if id == "" || pattern == "" {
+		return nil, fmt.Errorf("Error NewSpamRule id='%s' empty id or pattern", id)
+	}
+	rule := &SpamRule{Id: id, Field: field, Kind: kind, Pattern: pattern, lower: strings.ToLower(pattern)}
+	switch kind {
+	case "match", "exact", "normalized", "prefix", "suffix", "contains":
+	case "regex":
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Error NewSpamRule id='%s' regex err='%v'", id, err)
+		}
+		rule.re = re
+	case "wildmat":
+		for _, wm := range strings.Split(pattern, ",") {
+			var wp wildmat_pattern
+			if strings.HasPrefix(wm, "!") {
+				wp.negate, wm = true, wm[1:]
+			}
+			re, err := regexp.Compile("(?is)^" + wildmat_to_regex(wm) + "$")
+			if err != nil {
+				return nil, fmt.Errorf("Error NewSpamRule id='%s' wildmat err='%v'", id, err)
+			}
+			wp.re = re
+			rule.wild = append(rule.wild, wp)
+		}
+	default:
+		return nil, fmt.Errorf("Error NewSpamRule id='%s' unknown kind='%s'", id, kind)
+	}
+	return rule, nil
+} // end func compile_rule
+
+func (rule *SpamRule) Match(input string, lower string) bool {
+	// lower is strings.ToLower(input), callers lower the input once for all rules
+	switch rule.Kind {
+	case "match":
+		return lower == rule.lower
+	case "exact":
+		return input == rule.Pattern
+	case "normalized":
+		return flood_subject(input) == rule.Pattern
+	case "prefix":
+		return strings.HasPrefix(lower, rule.lower)
+	case "suffix":
+		return strings.HasSuffix(lower, rule.lower)
+	case "contains":
+		return strings.Contains(lower, rule.lower)
+	case "regex":
+		return rule.re.MatchString(input)
+	case "wildmat":
+		matched := false
+		for _, wp := range rule.wild {
+			if wp.re.MatchString(input) {
+				matched = !wp.negate
+			}
+		}
+		return matched
+	}
+	return false
+} // end func SpamRule.Match
+
+func wildmat_to_regex(wm string) string {
+	// converts one wildmat pattern to a regexp without anchors
+	var sb strings.Builder
+	for i := 0; i < len(wm); i++ {
+		switch c := wm[i]; c {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		case '\\':
+			if i+1 < len(wm) {
+				i++
+				sb.WriteString(regexp.QuoteMeta(wm[i : i+1]))
+			} else {
+				sb.WriteString(`\\`)
+			}
+		case '[':
+			j := strings.IndexByte(wm[i+1:], ']')
+			if j < 0 {
+				sb.WriteString(`\[`)
+				continue
+			}
+			class := wm[i+1 : i+1+j]
+			if strings.HasPrefix(class, "^") || strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += j + 1
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return sb.String()
+} // end func wildmat_to_regex
+
+func builtin_spamrules() map[string][]*SpamRule {
+	// rules of the hardcoded BAD_* lists, used while no rule files are loaded
+	// the kinds keep how the lists matched before rule files:
+	// BAD_SUBJ_MATCH compared case sensitive, BAD_FROM_SUFFIX compared the whole From
+	builtin_spamrules_once.Do(func() {
+		rules := make(map[string][]*SpamRule)
+		add := func(field string, kind string, list []string) {
+			for i, pattern := range list {
+				rule, err := NewSpamRule(fmt.Sprintf("builtin.%s.%s.%d", field, kind, i), field, kind, pattern)
+				if err != nil {
+					log.Printf("Error OV builtin_spamrules err='%v'", err)
+					continue
+				}
+				rules[field] = append(rules[field], rule)
+			}
+		}
+		add("subj", "exact", BAD_SUBJ_MATCH)
+		add("subj", "prefix", BAD_SUBJ_PREFIX)
+		add("subj", "suffix", BAD_SUBJ_SUFFIX)
+		add("subj", "contains", BAD_SUBJ_CONTAINS)
+		add("from", "match", BAD_FROM_MATCH)
+		add("from", "match", BAD_FROM_SUFFIX)
+		add("from", "contains", BAD_FROM_CONTAINS)
+		builtin_spamrules_map = rules
+	})
+	return builtin_spamrules_map
+} // end func builtin_spamrules
+
+func (s *SPAMFILTER) LoadRules(paths ...string) error {
+	// loads rule files, a directory loads all files ending in SPAMFILTER_RULES_EXT
+	// replaces the builtin rules, a failed load keeps the active rules
+	rules, signature, err := load_rules(paths, NewSpamRule)
+	if err != nil {
+		return err
+	}
+	s.mux.Lock()
+	s.paths, s.rules, s.signature = paths, rules, signature
+	s.mux.Unlock()
+	log.Printf("SPAMFILTER LoadRules paths=%d subj=%d from=%d msgid=%d", len(paths), len(rules["subj"]), len(rules["from"]), len(rules["msgid"]))
+	return nil
+} // end func SPAMFILTER.LoadRules
+
+func (s *SPAMFILTER) Reload(force bool) (bool, error) {
+	// reloads the rule files if a file changed, was added or removed
+	// returns true if rules got reloaded
+	s.mux.RLock()
+	paths, signature := s.paths, s.signature
+	s.mux.RUnlock()
+	if len(paths) == 0 {
+		return false, nil
+	}
+	if !force {
+		files, err := spamrule_files(paths)
+		if err != nil {
+			return false, err
+		}
+		if spamrule_signature(files) == signature {
+			return false, nil
+		}
+	}
+	if err := s.LoadRules(paths...); err != nil {
+		log.Printf("Error OV SPAMFILTER Reload err='%v'", err)
+		return false, err
+	}
+	return true, nil
+} // end func SPAMFILTER.Reload
+
+func (s *SPAMFILTER) Watch(interval time.Duration, stop chan struct{}) {
+	// reloads rules on SIGHUP (always) and every interval if a file changed
+	// run as goroutine, returns when stop gets closed
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	if interval <= 0 {
+		interval = 60 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hup:
+			log.Printf("SPAMFILTER Watch got SIGHUP, reload rules")
+			s.Reload(true)
+		case <-ticker.C:
+			s.Reload(false)
+		} // end select
+	} // end for
+} // end func SPAMFILTER.Watch
+
+func spamrule_files(paths []string) ([]os.FileInfo, error) {
+	// returns the rule files of paths with Name() as full path, sorted
+	var files []os.FileInfo
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			files = append(files, spamrule_fileinfo{fi, path})
+			continue
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || !strings.HasSuffix(entry.Name(), SPAMFILTER_RULES_EXT) {
+				continue
+			}
+			efi, err := entry.Info()
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, spamrule_fileinfo{efi, filepath.Join(path, entry.Name())})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	return files, nil
+} // end func spamrule_files
+
+type spamrule_fileinfo struct {
+	os.FileInfo
+	path string
+}
+
+func (fi spamrule_fileinfo) Name() string { return fi.path }
+
+func spamrule_signature(files []os.FileInfo) string {
+	var sb strings.Builder
+	for _, fi := range files {
+		fmt.Fprintf(&sb, "%s:%d:%d\n", fi.Name(), fi.Size(), fi.ModTime().UnixNano())
+	}
+	return sb.String()
+} // end func spamrule_signature
+
+func load_rules(paths []string, newrule func(id string, field string, kind string, pattern string) (*SpamRule, error)) (map[string][]*SpamRule, string, error) {
+	// loads rule files, newrule checks the field
+	files, err := spamrule_files(paths)
+	if err != nil {
+		return nil, "", err
+	}
+	rules := make(map[string][]*SpamRule)
+	ids := make(map[string]string)
+	for _, fi := range files {
+		fh, err := os.Open(fi.Name())
+		if err != nil {
+			return nil, "", err
+		}
+		fileScanner := bufio.NewScanner(fh)
+		lc := 0
+		for fileScanner.Scan() {
+			lc++
+			line := fileScanner.Text()
+			if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			x := strings.SplitN(line, "\t", 4)
+			if len(x) != 4 {
+				fh.Close()
+				return nil, "", fmt.Errorf("Error load_rules fp='%s' lc=%d need 4 TAB separated fields", fi.Name(), lc)
+			}
+			rule, err := newrule(x[0], x[1], x[2], x[3])
+			if err != nil {
+				fh.Close()
+				return nil, "", fmt.Errorf("%v fp='%s' lc=%d", err, fi.Name(), lc)
+			}
+			if prev, exists := ids[rule.Id]; exists {
+				fh.Close()
+				return nil, "", fmt.Errorf("Error load_rules fp='%s' lc=%d duplicate id='%s' first in '%s'", fi.Name(), lc, rule.Id, prev)
+			}
+			ids[rule.Id] = fi.Name()
+			rules[rule.Field] = append(rules[rule.Field], rule)
+		}
+		err = fileScanner.Err()
+		fh.Close()
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	return rules, spamrule_signature(files), nil
+} // end func load_rules
@@ -0,0 +1,280 @@
+package overview
+
+/*
+ * Rescan mode 5: check the articles of overview lines exist in storage
+ *
+ * the storage backend is reached through ArticleStore, set RESCAN_STORE for Rescan_Overview.
+ * StorageArticleStore reads the head and body files nntp-storage writes below its cachedir,
+ * the path of a file is storage.Get_cache_path:
+ *
+ *   store := &overview.StorageArticleStore{Cachedir: "/news/cache"}
+ *
+ * VerifyStorage reports overview lines without head or body and can tombstone
+ * lines having neither. StorageOrphans lists stored articles no overview file lists.
+ */
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/go-while/go-utils"
+	"github.com/go-while/nntp-storage"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	RESCAN_STORE     ArticleStore // used by Rescan_Overview mode 5
+	RESCAN_TOMBSTONE bool         // mode 5 tombstones lines whose head and body are gone
+)
+
+// ArticleStore tells if head and body of an article are stored
+type ArticleStore interface {
+	HasArticle(msgidhash string) (head bool, body bool, err error)
+}
+
+// ArticleLister lists all stored articles, StorageOrphans needs it
+type ArticleLister interface {
+	ListArticles(fn func(msgidhash string) bool) error // stops when fn returns false
+}
+
+// StorageArticleStore is the nntp-storage cache of heads and bodies
+type StorageArticleStore struct {
+	Cachedir string
+}
+
+func (s *StorageArticleStore) path(kind string, msgidhash string) string {
+	// kind: "head" or "body"
+	return storage.Get_cache_path(s.Cachedir, kind, msgidhash)
+} // end func StorageArticleStore.path
+
+func (s *StorageArticleStore) HasArticle(msgidhash string) (bool, bool, error) {
+	if len(msgidhash) != 64 {
+		return false, false, fmt.Errorf("ERROR overview.StorageArticleStore len(msgidhash)=%d != 64", len(msgidhash))
+	}
+	head, err := file_exists(s.path("head", msgidhash))
+	if err != nil {
+		return false, false, err
+	}
+	body, err := file_exists(s.path("body", msgidhash))
+	return head, body, err
+} // end func StorageArticleStore.HasArticle
+
+func (s *StorageArticleStore) ListArticles(fn func(msgidhash string) bool) error {
+	// walks Cachedir, a file is a head if it is at the head path of the hash its name starts with
+	stop := fmt.Errorf("stop")
+	err := filepath.WalkDir(s.Cachedir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || len(d.Name()) < 64 {
+			return nil
+		}
+		msgidhash := d.Name()[:64]
+		if filepath.Clean(s.path("head", msgidhash)) != filepath.Clean(path) {
+			return nil
+		}
+		if !fn(msgidhash) {
+			return stop
+		}
+		return nil
+	})
+	if err == stop {
+		return nil
+	}
+	return err
+} // end func StorageArticleStore.ListArticles
+
+func file_exists(path string) (bool, error) {
+	// like utils.FileExists but returns errors other than not exist
+	_, err := os.Stat(path)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+} // end func file_exists
+
+// StorageReport is the result of VerifyStorage
+type StorageReport struct {
+	File       string        `json:"file"`
+	Checked    uint64        `json:"checked"`
+	Missing    []VerifyIssue `json:"missing,omitempty"` // Field: "head", "body" or "article"
+	Tombstoned int           `json:"tombstoned"`
+}
+
+func VerifyStorage(file string, store ArticleStore, tombstone bool) (*StorageReport, error) {
+	// checks every live line of file has head and body in store
+	// with tombstone lines missing both are tombstoned, the group lock is held
+	// only to check the lines and the store again and to write the tombstones
+	if store == nil {
+		return nil, fmt.Errorf("ERROR overview.VerifyStorage store=nil")
+	}
+	hash, err := get_hash_from_filename(file)
+	if err != nil {
+		return nil, err
+	}
+	fh, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	report := &StorageReport{File: file}
+	var gone []storage_gone // lines missing head and body
+	r := bufio.NewReaderSize(fh, 1024*1024)
+	var offset int64
+	for lc := uint64(0); ; lc++ {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] == 0 {
+			// zero-filled space before the footer
+			break
+		}
+		fields := strings.Split(line, "\t")
+		if lc > 0 && len(fields) >= OVERVIEW_FIELDS && len(fields[4]) > 0 && fields[4][0] == '<' {
+			report.Checked++
+			msgidhash := utils.Hash256(fields[4])
+			head, body, serr := store.HasArticle(msgidhash)
+			if serr != nil {
+				return nil, serr
+			}
+			if !head || !body {
+				issue := VerifyIssue{Offset: offset, Line: lc, Msgnum: utils.Str2uint64(fields[0]), Msgid: fields[4], Reason: "not in storage"}
+				switch {
+				case !head && !body:
+					issue.Field = "article"
+					gone = append(gone, storage_gone{msgid: fields[4], msgidhash: msgidhash, offset: offset + int64(len(fields[0])+len(fields[1])+len(fields[2])+len(fields[3])+4)})
+				case !head:
+					issue.Field = "head"
+				default:
+					issue.Field = "body"
+				}
+				report.Missing = append(report.Missing, issue)
+			}
+		}
+		offset += int64(len(line))
+		if err == io.EOF {
+			break
+		}
+	}
+	if tombstone && len(gone) > 0 {
+		n, err := storage_tombstone(file, hash, store, gone)
+		report.Tombstoned = n
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+} // end func VerifyStorage
+
+type storage_gone struct {
+	msgid     string
+	msgidhash string
+	offset    int64 // of the msgid field
+}
+
+func storage_tombstone(file string, hash string, store ArticleStore, gone []storage_gone) (int, error) {
+	// tombstones the lines of gone under the group lock
+	// skips lines changed since they were read and articles stored again meanwhile
+	who := "VerifyStorage"
+	if err := OV_handler.LockGroup(who, hash); err != nil {
+		return 0, err
+	}
+	defer OV_handler.UnlockGroup(who, hash)
+	fh, err := os.OpenFile(file, os.O_RDWR, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer fh.Close()
+	var offsets []int64
+	for _, g := range gone {
+		buf := make([]byte, len(g.msgid)+1)
+		if _, err := fh.ReadAt(buf, g.offset); err != nil || string(buf) != g.msgid+"\t" {
+			continue
+		}
+		head, body, err := store.HasArticle(g.msgidhash)
+		if err != nil {
+			return 0, err
+		}
+		if head || body {
+			continue
+		}
+		offsets = append(offsets, g.offset)
+	}
+	if len(offsets) == 0 {
+		return 0, nil
+	}
+	if err := tombstone_offsets(fh, offsets); err != nil {
+		return 0, err
+	}
+	if err := fh.Sync(); err != nil {
+		return len(offsets), err
+	}
+	return len(offsets), nil
+} // end func storage_tombstone
+
+func StorageOrphans(files []string, lister ArticleLister) ([]string, error) {
+	// returns the msgidhashs of stored articles no live line of files lists
+	listed := make(map[string]struct{})
+	for _, file := range files {
+		fh, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		r := bufio.NewReaderSize(fh, 1024*1024)
+		for lc := 0; ; lc++ {
+			line, err := r.ReadString('\n')
+			if len(line) == 0 || line[0] == 0 {
+				break
+			}
+			fields := strings.Split(line, "\t")
+			if lc > 0 && len(fields) >= OVERVIEW_FIELDS && len(fields[4]) > 0 && fields[4][0] == '<' {
+				listed[utils.Hash256(fields[4])] = struct{}{}
+			}
+			if err != nil {
+				break
+			}
+		}
+		fh.Close()
+	}
+	var orphans []string
+	err := lister.ListArticles(func(msgidhash string) bool {
+		if _, exists := listed[msgidhash]; !exists {
+			orphans = append(orphans, msgidhash)
+		}
+		return true
+	})
+	return orphans, err
+} // end func StorageOrphans
+
+func rescan_storage(who string, file_path string, group string, DEBUG bool) (bool, uint64) {
+	// Rescan_Overview mode 5: mode 0 and VerifyStorage with RESCAN_STORE
+	if RESCAN_STORE == nil {
+		log.Printf("ERROR Rescan_OV mode=5 RESCAN_STORE=nil")
+		return false, 0
+	}
+	retbool, last_msgnum := Rescan_Overview(who, file_path, group, 0, DEBUG, nil, nil)
+	if !retbool {
+		return false, last_msgnum
+	}
+	report, err := VerifyStorage(file_path, RESCAN_STORE, RESCAN_TOMBSTONE)
+	if err != nil {
+		log.Printf("ERROR Rescan_OV mode=5 VerifyStorage err='%v' fp='%s'", err, filepath.Base(file_path))
+		return false, last_msgnum
+	}
+	for _, issue := range report.Missing {
+		if DEBUG {
+			log.Printf("Rescan_OV mode=5 missing %s msgnum=%d msgid='%s' fp='%s'", issue.Field, issue.Msgnum, issue.Msgid, filepath.Base(file_path))
+		}
+	}
+	log.Printf("Rescan_OV mode=5 group='%s' checked=%d missing=%d tombstoned=%d", group, report.Checked, len(report.Missing), report.Tombstoned)
+	return len(report.Missing) == report.Tombstoned, last_msgnum
+} // end func rescan_storage
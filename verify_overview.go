@@ -0,0 +1,507 @@
+package overview
+
+/*
+ * Verify and Repair: the structured form of Rescan_Overview
+ *
+ *   report, err := overview.Verify(file, overview.VerifyOptions{Header: true, Footer: true, Lines: true, Fields: true})
+ *   if !report.OK() {
+ *       log.Printf("%s", report.Suggest)
+ *       err = overview.Repair(report, report.Suggest)
+ *   }
+ *
+ * Verify only reads the file and never logs, everything found is in the report.
+ * Repair applies the chosen actions in a fixed order:
+ *   trim-garbage, tombstone-duplicates, tombstone-bad-lines, fix-footer
+ * Repair holds the group lock through all actions and fails before the first one
+ * if the file changed since Verify.
+ *
+ * delete-file removes the file and ignores the other actions. it is never suggested:
+ * a file without a repair sets Unrepairable and the caller has to pass delete-file itself.
+ *
+ * VerifyOptionsFromMode maps the old rescan mode numbers to options.
+ */
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/go-while/go-utils"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RepairAction names a fix Repair can apply
+type RepairAction string
+
+const (
+	RepairTrimGarbage         RepairAction = "trim-garbage"         // zero the bytes after the last good line
+	RepairTombstoneDuplicates RepairAction = "tombstone-duplicates" // tombstone all but the first line of a msgid
+	RepairTombstoneBadLines   RepairAction = "tombstone-bad-lines"  // tombstone lines with bad fields
+	RepairFixFooter           RepairAction = "fix-footer"           // rewrite the footer, like rescan mode 999
+	RepairDeleteFile          RepairAction = "delete-file"          // removes the file, never suggested
+)
+
+const (
+	CheckSkipped = "skipped"
+	CheckOK      = "ok"
+	CheckBad     = "bad"
+)
+
+// VerifyOptions selects the checks of Verify
+type VerifyOptions struct {
+	Header    bool   // check the header
+	Footer    bool   // check the footer and compare last= and Findex= with the lines
+	Lines     bool   // read all lines: count, msgnum gaps, duplicates
+	Fields    bool   // verify the fields of every line, implies Lines
+	Group     string // expected group, empty: taken from the xrefs
+	MaxIssues int    // max entries per issue list, default 1000
+}
+
+// VerifyIssue is a problem at an offset of the file
+type VerifyIssue struct {
+	Offset int64  `json:"offset"`
+	Line   uint64 `json:"line"`
+	Msgnum uint64 `json:"msgnum,omitempty"`
+	Msgid  string `json:"msgid,omitempty"`
+	Field  string `json:"field,omitempty"`
+	Reason string `json:"reason"`
+	First  int64  `json:"first,omitempty"` // duplicates: offset of the first line
+	msgidx int64  // offset of the msgid field, -1 if none
+}
+
+// MsgnumGap are missing msgnums From..To
+type MsgnumGap struct {
+	From uint64 `json:"from"`
+	To   uint64 `json:"to"`
+}
+
+// VerifyReport is the result of Verify
+type VerifyReport struct {
+	File         string         `json:"file"`
+	Group        string         `json:"group,omitempty"`
+	Size         int64          `json:"size"`
+	Header       string         `json:"header"`
+	HeaderErr    string         `json:"header_err,omitempty"`
+	Footer       string         `json:"footer"`
+	FooterErr    string         `json:"footer_err,omitempty"`
+	FooterLast   uint64         `json:"footer_last"`
+	FooterIndex  int64          `json:"footer_findex"`
+	Lines        uint64         `json:"lines"`
+	Tombstones   uint64         `json:"tombstones"`
+	FirstMsgnum  uint64         `json:"first_msgnum"`
+	LastMsgnum   uint64         `json:"last_msgnum"`
+	DataEnd      int64          `json:"data_end"`        // offset after the last good line
+	Garbage      int64          `json:"garbage"`         // non-nul bytes between DataEnd and the footer
+	Gaps         []MsgnumGap    `json:"gaps,omitempty"`  // missing msgnums
+	Order        []VerifyIssue  `json:"order,omitempty"` // msgnum not above the previous one
+	Duplicates   []VerifyIssue  `json:"duplicates,omitempty"`
+	BadLines     []VerifyIssue  `json:"bad_lines,omitempty"`
+	Truncated    bool           `json:"truncated,omitempty"` // an issue list hit MaxIssues
+	Suggest      []RepairAction `json:"suggest,omitempty"`
+	Unrepairable string         `json:"unrepairable,omitempty"` // why no repair can help, only delete-file is left
+	mtime        int64          // unixnano, Repair fails if the file changed
+}
+
+func (r *VerifyReport) OK() bool {
+	return len(r.Suggest) == 0 && r.Unrepairable == "" && r.Header != CheckBad && r.Footer != CheckBad && len(r.Gaps) == 0 && len(r.Order) == 0
+} // end func VerifyReport.OK
+
+func VerifyOptionsFromMode(mode int) (VerifyOptions, []RepairAction, error) {
+	// returns the options and repairs of a rescan mode, see Rescan_help
+	switch mode {
+	case 0, 4:
+		return VerifyOptions{Header: true, Footer: true, Lines: true, Fields: true}, nil, nil
+	case 1:
+		return VerifyOptions{Header: true}, nil, nil
+	case 2:
+		return VerifyOptions{Footer: true}, nil, nil
+	case 3:
+		return VerifyOptions{Header: true, Footer: true, Lines: true}, nil, nil
+	case 999:
+		return VerifyOptions{Header: true, Footer: true, Lines: true, Fields: true}, []RepairAction{RepairFixFooter}, nil
+	}
+	return VerifyOptions{}, nil, fmt.Errorf("ERROR overview.VerifyOptionsFromMode mode=%d has no options", mode)
+} // end func VerifyOptionsFromMode
+
+func Verify(file string, opts VerifyOptions) (*VerifyReport, error) {
+	// checks file as selected by opts, returns an error only if file can not be read
+	if opts.Fields {
+		opts.Lines = true
+	}
+	if opts.MaxIssues <= 0 {
+		opts.MaxIssues = 1000
+	}
+	report := &VerifyReport{File: file, Group: opts.Group, Header: CheckSkipped, Footer: CheckSkipped}
+	hash, err := get_hash_from_filename(file)
+	if err != nil {
+		return nil, err
+	}
+	fh, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	fi, err := fh.Stat()
+	if err != nil {
+		return nil, err
+	}
+	report.Size, report.mtime = fi.Size(), fi.ModTime().UnixNano()
+	if report.Size < int64(OV_RESERVE_BEG+OV_RESERVE_END) {
+		report.Header, report.Footer = CheckBad, CheckBad
+		report.HeaderErr = fmt.Sprintf("size=%d too small", report.Size)
+		report.Unrepairable = report.HeaderErr
+		return report, nil
+	}
+
+	if opts.Header {
+		buf := make([]byte, OV_RESERVE_BEG)
+		if _, err := fh.ReadAt(buf, 0); err != nil {
+			return nil, err
+		}
+		report.Header, report.HeaderErr = CheckOK, verify_header(string(buf), hash)
+		if report.HeaderErr != "" {
+			report.Header = CheckBad
+		}
+	}
+
+	footer_beg := report.Size - int64(OV_RESERVE_END)
+	if opts.Footer {
+		buf := make([]byte, OV_RESERVE_END)
+		if _, err := fh.ReadAt(buf, footer_beg); err != nil {
+			return nil, err
+		}
+		report.Footer = CheckOK
+		report.FooterLast, report.FooterIndex, report.FooterErr = verify_footer(string(buf))
+		if report.FooterErr != "" {
+			report.Footer = CheckBad
+		}
+	}
+
+	if opts.Lines {
+		if err := verify_lines(fh, footer_beg, hash, opts, report); err != nil {
+			return nil, err
+		}
+		if report.Footer == CheckOK {
+			// last= is the msgnum of the next line, GO_pi_ov writes the current one while the file is open
+			if report.FooterLast != report.LastMsgnum && report.FooterLast != report.LastMsgnum+1 {
+				report.Footer, report.FooterErr = CheckBad, fmt.Sprintf("last=%d != last msgnum=%d", report.FooterLast, report.LastMsgnum)
+			} else if report.FooterIndex != report.DataEnd {
+				report.Footer, report.FooterErr = CheckBad, fmt.Sprintf("Findex=%d != data end=%d", report.FooterIndex, report.DataEnd)
+			}
+		}
+	}
+
+	if report.Header == CheckBad {
+		// the group of a file with a broken header is unknown
+		report.Unrepairable = "header: " + report.HeaderErr
+		return report, nil
+	}
+	if report.Garbage > 0 {
+		report.Suggest = append(report.Suggest, RepairTrimGarbage)
+	}
+	if len(report.Duplicates) > 0 {
+		report.Suggest = append(report.Suggest, RepairTombstoneDuplicates)
+	}
+	if len(report.BadLines) > 0 {
+		report.Suggest = append(report.Suggest, RepairTombstoneBadLines)
+	}
+	if report.Footer == CheckBad || report.Garbage > 0 {
+		report.Suggest = append(report.Suggest, RepairFixFooter)
+	}
+	return report, nil
+} // end func Verify
+
+func verify_header(header string, hash string) string {
+	// returns what is wrong with header or ""
+	if !strings.HasPrefix(header, HEADER_BEG) {
+		return "missing " + strings.TrimSpace(HEADER_BEG)
+	}
+	if !strings.HasSuffix(header, HEADER_END) {
+		return "missing EOH"
+	}
+	for _, field := range strings.Split(header, ",") {
+		if strings.HasPrefix(field, "group=") && field[6:] != hash {
+			return fmt.Sprintf("group=%s != file hash", field[6:])
+		}
+	}
+	return ""
+} // end func verify_header
+
+func verify_footer(footer string) (uint64, int64, string) {
+	// returns last= and Findex= of footer and what is wrong with it or ""
+	if !strings.HasPrefix(footer, FOOTER_BEG) {
+		return 0, 0, "missing EOV"
+	}
+	if !strings.HasSuffix(footer, ","+FOOTER_END) {
+		return 0, 0, "missing EOF"
+	}
+	foot := strings.Split(footer, ",")
+	if len(foot) != SIZEOF_FOOT {
+		return 0, 0, fmt.Sprintf("fields=%d != %d", len(foot), SIZEOF_FOOT)
+	}
+	if !strings.HasPrefix(foot[1], "last=") || !strings.HasPrefix(foot[2], "Findex=") {
+		return 0, 0, "missing last= or Findex="
+	}
+	last, findex := foot[1][5:], foot[2][7:]
+	if !utils.IsDigit(last) || !utils.IsDigit(findex) {
+		return 0, 0, fmt.Sprintf("bad last='%s' Findex='%s'", last, findex)
+	}
+	return utils.Str2uint64(last), int64(utils.Str2int(findex)), ""
+} // end func verify_footer
+
+func verify_lines(fh *os.File, footer_beg int64, hash string, opts VerifyOptions, report *VerifyReport) error {
+	// reads the lines between header and footer into report
+	offset := int64(OV_RESERVE_BEG)
+	report.DataEnd = offset
+	r := bufio.NewReaderSize(io.NewSectionReader(fh, offset, footer_beg-offset), 1024*1024)
+	first := make(map[string]int64) // key: msgid, value: offset of the first line
+	add := func(list *[]VerifyIssue, issue VerifyIssue) {
+		if len(*list) >= opts.MaxIssues {
+			report.Truncated = true
+			return
+		}
+		*list = append(*list, issue)
+	}
+	var lc uint64
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if nul := strings.IndexByte(line, 0); nul >= 0 || err == io.EOF {
+			// end of data: padding follows, anything else is garbage
+			if nul < 0 {
+				nul = len(line)
+			}
+			report.Garbage += int64(nul)
+			for _, c := range []byte(line[nul:]) {
+				if c != 0 {
+					report.Garbage++
+				}
+			}
+			for err == nil {
+				var c byte
+				if c, err = r.ReadByte(); err == nil && c != 0 {
+					report.Garbage++
+				}
+			}
+			if err != io.EOF {
+				return err
+			}
+			return nil
+		}
+		lc++
+		issue := verify_line(line[:len(line)-1], offset, lc, hash, opts, report)
+		switch {
+		case issue.Reason == "tombstone":
+			report.Tombstones++
+		case issue.Reason != "":
+			add(&report.BadLines, issue)
+		}
+		if issue.Msgnum > 0 {
+			switch {
+			case report.LastMsgnum == 0:
+				report.FirstMsgnum = issue.Msgnum
+			case issue.Msgnum <= report.LastMsgnum:
+				add(&report.Order, VerifyIssue{Offset: offset, Line: lc, Msgnum: issue.Msgnum, Reason: fmt.Sprintf("msgnum after %d", report.LastMsgnum)})
+			case issue.Msgnum > report.LastMsgnum+1:
+				if len(report.Gaps) < opts.MaxIssues {
+					report.Gaps = append(report.Gaps, MsgnumGap{From: report.LastMsgnum + 1, To: issue.Msgnum - 1})
+				} else {
+					report.Truncated = true
+				}
+			}
+			if issue.Msgnum > report.LastMsgnum {
+				report.LastMsgnum = issue.Msgnum
+			}
+		}
+		if issue.Reason == "" && issue.Msgid != "" {
+			if at, dup := first[issue.Msgid]; dup {
+				add(&report.Duplicates, VerifyIssue{Offset: offset, Line: lc, Msgnum: issue.Msgnum, Msgid: issue.Msgid, Reason: "duplicate msgid", First: at, msgidx: issue.msgidx})
+			} else {
+				first[issue.Msgid] = offset
+			}
+		}
+		report.Lines++
+		offset += int64(len(line))
+		report.DataEnd = offset
+	}
+} // end func verify_lines
+
+func verify_line(line string, offset int64, lc uint64, hash string, opts VerifyOptions, report *VerifyReport) VerifyIssue {
+	// returns the msgnum and msgid of line, Reason is set if something is wrong
+	issue := VerifyIssue{Offset: offset, Line: lc, msgidx: -1}
+	fields := strings.Split(line, "\t")
+	if len(fields) < OVERVIEW_FIELDS {
+		issue.Reason = fmt.Sprintf("fields=%d < %d", len(fields), OVERVIEW_FIELDS)
+		return issue
+	}
+	issue.Msgnum = utils.Str2uint64(fields[0])
+	issue.msgidx = offset + int64(len(fields[0])+len(fields[1])+len(fields[2])+len(fields[3])+4)
+	if fields[4] == "" || fields[4][0] == 'X' {
+		issue.Reason = "tombstone"
+		return issue
+	}
+	issue.Msgid = fields[4]
+	bad := func(field string, reason string) VerifyIssue {
+		issue.Field, issue.Reason = field, reason
+		return issue
+	}
+	if issue.Msgnum == 0 {
+		return bad("msgnum", fmt.Sprintf("bad msgnum='%s'", fields[0]))
+	}
+	if !opts.Fields {
+		return issue
+	}
+	if !isvalidmsgid(fields[4], true) {
+		return bad("msgid", "invalid msgid")
+	}
+	if utils.Str2int(fields[6]) <= 0 {
+		return bad("bytes", fmt.Sprintf("bad bytes='%s'", fields[6]))
+	}
+	if utils.Str2int(fields[7]) <= 0 {
+		return bad("lines", fmt.Sprintf("bad lines='%s'", fields[7]))
+	}
+	// GO_pi_ov writes only the prefix, check full xrefs like Rescan_Overview
+	xrefs := strings.Split(fields[8], " ")
+	if len(xrefs) < 2 || xrefs[0] != XREF_PREFIX {
+		return issue
+	}
+	for x := 1; x < len(xrefs); x++ {
+		xrefdata := strings.Split(xrefs[x], ":")
+		if len(xrefdata) != 2 || !IsValidGroupName(xrefdata[0]) {
+			return bad("xref", fmt.Sprintf("bad xref='%s'", xrefs[x]))
+		}
+		if x > 1 {
+			continue
+		}
+		// the first xref is this group
+		if report.Group == "" && utils.Hash256(xrefdata[0]) == hash {
+			report.Group = xrefdata[0]
+		}
+		if xrefdata[0] != report.Group {
+			return bad("xref", fmt.Sprintf("xref group='%s' != group", xrefdata[0]))
+		}
+		if utils.Str2uint64(xrefdata[1]) != issue.Msgnum {
+			return bad("xref", fmt.Sprintf("xref msgnum=%s != msgnum", xrefdata[1]))
+		}
+	}
+	return issue
+} // end func verify_line
+
+func Repair(report *VerifyReport, actions []RepairAction) error {
+	// applies actions to report.File, report has to be fresh from Verify
+	want := make(map[RepairAction]bool, len(actions))
+	for _, action := range actions {
+		switch action {
+		case RepairTrimGarbage, RepairTombstoneDuplicates, RepairTombstoneBadLines, RepairFixFooter, RepairDeleteFile:
+			want[action] = true
+		default:
+			return fmt.Errorf("ERROR overview.Repair unknown action='%s'", action)
+		}
+	}
+	hash, err := get_hash_from_filename(report.File)
+	if err != nil {
+		return err
+	}
+	// the lock is held through all actions, fix-footer included:
+	// Rescan_Overview does not lock and would race with GO_pi_ov
+	who := "Repair"
+	if err := OV_handler.LockGroup(who, hash); err != nil {
+		return err
+	}
+	defer OV_handler.UnlockGroup(who, hash)
+	if err := repair_unchanged(report); err != nil {
+		return err
+	}
+	if want[RepairDeleteFile] {
+		log.Printf("Repair delete-file fp='%s'", filepath.Base(report.File))
+		return os.Remove(report.File)
+	}
+	if want[RepairTrimGarbage] || want[RepairTombstoneDuplicates] || want[RepairTombstoneBadLines] {
+		if err := repair_inplace(report, want); err != nil {
+			return err
+		}
+	}
+	if want[RepairFixFooter] {
+		if retbool, _ := Rescan_Overview(who, report.File, report.Group, 999, false, nil, nil); !retbool {
+			return fmt.Errorf("ERROR overview.Repair fix-footer failed fp='%s'", filepath.Base(report.File))
+		}
+	}
+	return nil
+} // end func Repair
+
+func repair_unchanged(report *VerifyReport) error {
+	// fails if report.File changed since Verify, caller holds the group lock
+	fi, err := os.Stat(report.File)
+	if err != nil {
+		return err
+	}
+	if fi.Size() != report.Size || fi.ModTime().UnixNano() != report.mtime {
+		return fmt.Errorf("ERROR overview.Repair fp='%s' changed since Verify size=%d/%d: verify again", filepath.Base(report.File), fi.Size(), report.Size)
+	}
+	return nil
+} // end func repair_unchanged
+
+func repair_inplace(report *VerifyReport, want map[RepairAction]bool) error {
+	// writes tombstones and zeros into report.File, caller holds the group lock
+	// and checked the file did not change since Verify
+	fh, err := os.OpenFile(report.File, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	var issues []VerifyIssue
+	if want[RepairTombstoneDuplicates] {
+		issues = append(issues, report.Duplicates...)
+	}
+	if want[RepairTombstoneBadLines] {
+		issues = append(issues, report.BadLines...)
+	}
+	var offsets []int64
+	b := make([]byte, 1)
+	for _, issue := range issues {
+		if issue.msgidx < 0 {
+			continue
+		}
+		if _, err := fh.ReadAt(b, issue.msgidx); err != nil {
+			return err
+		}
+		switch b[0] {
+		case '<':
+			offsets = append(offsets, issue.msgidx)
+		case 'X':
+			// tombstoned since Verify
+		default:
+			return fmt.Errorf("ERROR overview.Repair fp='%s' offset=%d is not a msgid: verify again", filepath.Base(report.File), issue.msgidx)
+		}
+	}
+	if err := tombstone_offsets(fh, offsets); err != nil {
+		return err
+	}
+	if want[RepairTrimGarbage] && report.Garbage > 0 {
+		zeros := make([]byte, report.Size-int64(OV_RESERVE_END)-report.DataEnd)
+		if _, err := fh.WriteAt(zeros, report.DataEnd); err != nil {
+			return err
+		}
+	}
+	return fh.Sync()
+} // end func repair_inplace
+
+func tombstone_offsets(fh *os.File, offsets []int64) error {
+	// overwrites the first char of the msgid fields at offsets with 'X'
+	// and sends the tombstones to REPLICATION_FEED
+	events := REPLICATION_FEED.tombstone_events(fh, offsets)
+	for i, pos := range offsets {
+		if _, err := fh.WriteAt([]byte{'X'}, pos); err != nil {
+			if i < len(events) {
+				REPLICATION_FEED.emit(events[:i]...)
+			}
+			return err
+		}
+	}
+	REPLICATION_FEED.emit(events...)
+	return nil
+} // end func tombstone_offsets
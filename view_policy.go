@@ -0,0 +1,221 @@
+package overview
+
+/*
+ * read-side view policies
+ *
+ * a ViewPolicy hides overview lines from readers in Scan_Overview, in XOVER, XHDR and LISTGROUP.
+ * stored data is never changed, operators change rules at runtime.
+ *
+ * policy lookup for a reader conn:
+ *   1. SetConnViewPolicy(conn, policy), e.g. the user class after AUTHINFO
+ *   2. SetListenerViewPolicy(conn.LocalAddr().String(), policy)
+ *   3. DefaultViewPolicy
+ *
+ * rule files use the spamfilter format (see spamfilter_rules.go) with fields:
+ *   subj, from, msgid, refs, xref, group
+ * a "group" rule matches the scanned group and hides all its lines.
+ */
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	VIEW_STAT_TTL   time.Duration = 5 * time.Minute // stats of MySQLViewStat and StoreViewStat are cached this long
+	VIEW_STAT_CACHE int           = 1000000         // msgids in the stat cache
+	// DefaultViewPolicy applies to readers without listener or conn policy
+	DefaultViewPolicy = &ViewPolicy{Name: "default", Filters: ViewChain}
+	view_policies     = &view_policy_map{
+		listeners: make(map[string]*ViewPolicy),
+		conns:     make(map[net.Conn]*ViewPolicy),
+	}
+)
+
+type view_policy_map struct {
+	mux       sync.RWMutex
+	listeners map[string]*ViewPolicy   // key: local addr
+	conns     map[net.Conn]*ViewPolicy // key: reader conn
+}
+
+// ViewPolicy decides which overview lines a reader sees
+type ViewPolicy struct {
+	mux       sync.RWMutex
+	Name      string
+	Filters   *FilterChain              // a verdict other than VerdictAccept hides the line
+	HideStats string                    // hide lines whose msgidhash stat is one of these chars, e.g. "r"
+	Stat      func(msgid string) string // returns the stat of a msgid, see MySQLViewStat and StoreViewStat (cached)
+	paths     []string
+	signature string
+	rules     []*SpamRule
+}
+
+func NewViewRule(id string, field string, kind string, pattern string) (*SpamRule, error) {
+	switch field {
+	case "subj", "from", "msgid", "refs", "xref", "group":
+	default:
+		return nil, fmt.Errorf("Error NewViewRule id='%s' unknown field='%s'", id, field)
+	}
+	return compile_rule(id, field, kind, pattern)
+} // end func NewViewRule
+
+func (vp *ViewPolicy) SetRules(rules []*SpamRule) {
+	// replaces the rules, use NewViewRule to create them
+	vp.mux.Lock()
+	vp.rules = rules
+	vp.mux.Unlock()
+} // end func ViewPolicy.SetRules
+
+func (vp *ViewPolicy) LoadRules(paths ...string) error {
+	// loads rule files like SPAMFILTER.LoadRules, a failed load keeps the active rules
+	rulemap, signature, err := load_rules(paths, NewViewRule)
+	if err != nil {
+		return err
+	}
+	var rules []*SpamRule
+	for _, field := range []string{"group", "msgid", "subj", "from", "refs", "xref"} {
+		rules = append(rules, rulemap[field]...)
+	}
+	vp.mux.Lock()
+	vp.paths, vp.rules, vp.signature = paths, rules, signature
+	vp.mux.Unlock()
+	log.Printf("ViewPolicy '%s' LoadRules paths=%d rules=%d", vp.Name, len(paths), len(rules))
+	return nil
+} // end func ViewPolicy.LoadRules
+
+func (vp *ViewPolicy) Reload(force bool) (bool, error) {
+	// reloads the rule files if a file changed, was added or removed
+	vp.mux.RLock()
+	paths, signature := vp.paths, vp.signature
+	vp.mux.RUnlock()
+	if len(paths) == 0 {
+		return false, nil
+	}
+	if !force {
+		files, err := spamrule_files(paths)
+		if err != nil {
+			return false, err
+		}
+		if spamrule_signature(files) == signature {
+			return false, nil
+		}
+	}
+	if err := vp.LoadRules(paths...); err != nil {
+		log.Printf("Error OV ViewPolicy '%s' Reload err='%v'", vp.Name, err)
+		return false, err
+	}
+	return true, nil
+} // end func ViewPolicy.Reload
+
+func (vp *ViewPolicy) Hide(group string, datafields []string) bool {
+	// returns true if the reader must not see this overview line
+	if vp == nil || len(datafields) < OVERVIEW_FIELDS {
+		return false
+	}
+	vp.mux.RLock()
+	rules, filters, hidestats, stat := vp.rules, vp.Filters, vp.HideStats, vp.Stat
+	vp.mux.RUnlock()
+	for _, rule := range rules {
+		var input string
+		switch rule.Field {
+		case "group":
+			input = group
+		case "subj":
+			input = datafields[1]
+		case "from":
+			input = datafields[2]
+		case "msgid":
+			input = datafields[4]
+		case "refs":
+			input = datafields[5]
+		case "xref":
+			input = datafields[8]
+		}
+		if input != "" && rule.Match(input, strings.ToLower(input)) {
+			if DEBUG_OV {
+				log.Printf("ViewPolicy '%s' hide id='%s' group='%s' msgid='%s'", vp.Name, rule.Id, group, datafields[4])
+			}
+			return true
+		}
+	}
+	if filters != nil {
+		ovl := Parse_OVL(datafields)
+		if verdict, _, _ := filters.Run(&ovl, nil); verdict != VerdictAccept {
+			return true
+		}
+	}
+	if hidestats != "" && stat != nil {
+		if s := stat(datafields[4]); s != "" && strings.Contains(hidestats, s) {
+			return true
+		}
+	}
+	return false
+} // end func ViewPolicy.Hide
+
+func MySQLViewStat(db *sql.DB) func(msgid string) string {
+	// returns a ViewPolicy.Stat func reading the stat from the msgidhash tables
+	return StoreViewStat(NewMySQLStore(db))
+} // end func MySQLViewStat
+
+func cached_view_stat(lookup func(msgid string) (string, error)) func(msgid string) string {
+	// caches stats, also empty ones, for VIEW_STAT_TTL:
+	// readers scan the same groups over and over, one lookup per line would hit the db for every line
+	// failed lookups are not cached
+	cache := &Known_MessageIDs{TTL: VIEW_STAT_TTL, MAP_MSGIDS: VIEW_STAT_CACHE}
+	return func(msgid string) string {
+		if stat, cached := cache.Value(msgid); cached {
+			return stat
+		}
+		stat, err := lookup(msgid)
+		if err != nil {
+			return ""
+		}
+		cache.SetValue(msgid, stat)
+		return stat
+	}
+} // end func cached_view_stat
+
+func SetListenerViewPolicy(localaddr string, policy *ViewPolicy) {
+	// sets the policy for all readers connected to localaddr, nil removes it
+	view_policies.mux.Lock()
+	defer view_policies.mux.Unlock()
+	if policy == nil {
+		delete(view_policies.listeners, localaddr)
+		return
+	}
+	view_policies.listeners[localaddr] = policy
+} // end func SetListenerViewPolicy
+
+func SetConnViewPolicy(conn net.Conn, policy *ViewPolicy) {
+	// sets the policy for one reader conn, nil removes it
+	// frontend has to remove it when the conn closes
+	view_policies.mux.Lock()
+	defer view_policies.mux.Unlock()
+	if policy == nil {
+		delete(view_policies.conns, conn)
+		return
+	}
+	view_policies.conns[conn] = policy
+} // end func SetConnViewPolicy
+
+func GetViewPolicy(conn net.Conn) *ViewPolicy {
+	view_policies.mux.RLock()
+	defer view_policies.mux.RUnlock()
+	if conn == nil {
+		return DefaultViewPolicy
+	}
+	if policy := view_policies.conns[conn]; policy != nil {
+		return policy
+	}
+	if addr := conn.LocalAddr(); addr != nil {
+		if policy := view_policies.listeners[addr.String()]; policy != nil {
+			return policy
+		}
+	}
+	return DefaultViewPolicy
+} // end func GetViewPolicy